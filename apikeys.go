@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const apiKeyPrefix = "acg_"
+
+// Scopes an API key can be granted. ScopeAdmin implies every other scope.
+const (
+	ScopeJobsRead  = "jobs:read"
+	ScopeJobsWrite = "jobs:write"
+	ScopeAdmin     = "admin"
+)
+
+var validScopes = map[string]bool{
+	ScopeJobsRead:  true,
+	ScopeJobsWrite: true,
+	ScopeAdmin:     true,
+}
+
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %v", err)
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// hashToken returns the stored form of an API key or session token. Both
+// carry at least 192 bits of randomness, so a plain SHA-256 is enough; no
+// salt or stretching needed.
+func hashToken(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func createAPIKey(workspaceID int, name string, scopes []string, limits QuotaLimits) (*CreateAPIKeyResponse, error) {
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return nil, fmt.Errorf("invalid scope: %s", scope)
+		}
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	prefix := key[:len(apiKeyPrefix)+8]
+	now := time.Now()
+
+	result, err := db.Exec(`INSERT INTO api_keys (workspace_id, name, prefix, key_hash, scopes, daily_job_limit, monthly_job_limit, daily_token_limit, monthly_token_limit, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		workspaceID, name, prefix, hashToken(key), strings.Join(scopes, " "), limits.DailyJobs, limits.MonthlyJobs, limits.DailyTokens, limits.MonthlyTokens, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API key: %v", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API key ID: %v", err)
+	}
+
+	return &CreateAPIKeyResponse{
+		APIKey: APIKey{
+			ID:          int(id),
+			WorkspaceID: workspaceID,
+			Name:        name,
+			Prefix:      prefix,
+			Scopes:      scopes,
+			CreatedAt:   now,
+			QuotaLimits: limits,
+		},
+		Key: key,
+	}, nil
+}
+
+const apiKeyColumns = `id, workspace_id, name, prefix, scopes, created_at, last_used_at, revoked_at, daily_job_limit, monthly_job_limit, daily_token_limit, monthly_token_limit`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	var scopes string
+	var lastUsed, revoked sql.NullTime
+	if err := row.Scan(&key.ID, &key.WorkspaceID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &lastUsed, &revoked,
+		&key.DailyJobs, &key.MonthlyJobs, &key.DailyTokens, &key.MonthlyTokens); err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Fields(scopes)
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		key.RevokedAt = &revoked.Time
+	}
+	return &key, nil
+}
+
+func listAPIKeys(workspaceID int) ([]APIKey, error) {
+	rows, err := db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE workspace_id = ? ORDER BY id`, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %v", err)
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %v", err)
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// lookupAPIKey finds an active key by its plaintext value and records its use.
+func lookupAPIKey(key string) (*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL`
+	apiKey, err := scanAPIKey(db.QueryRow(query, hashToken(key)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("API key not found")
+		}
+		return nil, fmt.Errorf("failed to look up API key: %v", err)
+	}
+
+	if _, err := db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, time.Now(), apiKey.ID); err != nil {
+		slog.Error("failed to record API key use", "key_id", apiKey.ID, "error", err)
+	}
+	return apiKey, nil
+}
+
+func apiKeyQuotaLimits(id int) (QuotaLimits, error) {
+	var l QuotaLimits
+	err := db.QueryRow(`SELECT daily_job_limit, monthly_job_limit, daily_token_limit, monthly_token_limit FROM api_keys WHERE id = ?`, id).
+		Scan(&l.DailyJobs, &l.MonthlyJobs, &l.DailyTokens, &l.MonthlyTokens)
+	if err != nil {
+		return l, fmt.Errorf("failed to get API key limits: %v", err)
+	}
+	return l, nil
+}
+
+func revokeAPIKey(workspaceID, id int) error {
+	result, err := db.Exec(`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND workspace_id = ? AND revoked_at IS NULL`, time.Now(), id, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("API key not found")
+	}
+	return nil
+}
+
+// ensureBootstrapKey creates an admin key on first start so the instance is
+// never left without a way in. The key is logged once and never stored.
+func ensureBootstrapKey() error {
+	var active int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM api_keys WHERE revoked_at IS NULL`).Scan(&active); err != nil {
+		return fmt.Errorf("failed to count API keys: %v", err)
+	}
+	if active > 0 {
+		return nil
+	}
+
+	created, err := createAPIKey(defaultWorkspaceID, "bootstrap-admin", []string{ScopeAdmin}, QuotaLimits{})
+	if err != nil {
+		return err
+	}
+	slog.Warn("no API keys found - created admin key; store it now, it will not be shown again", "name", created.Name, "key", created.Key)
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
+// Principal is the authenticated caller of an API request: either an API
+// key (KeyID set) or a logged-in dashboard user (UserID set).
+type Principal struct {
+	KeyID       int
+	UserID      int
+	WorkspaceID int
+	Name        string
+	Role        string
+	Scopes      []string
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// JobFilter returns the jobs this caller may see. Writers are limited to
+// their own jobs; API keys, editors and admins see everything.
+func (p *Principal) JobFilter() JobFilter {
+	filter := JobFilter{WorkspaceID: p.WorkspaceID}
+	if p.UserID != 0 && p.Role == RoleWriter {
+		id := p.UserID
+		filter.UserID = &id
+	}
+	return filter
+}
+
+// CanAccessJob reports whether the caller may read or modify job.
+func (p *Principal) CanAccessJob(job *Job) bool {
+	filter := p.JobFilter()
+	if job.WorkspaceID != filter.WorkspaceID {
+		return false
+	}
+	return filter.UserID == nil || (job.UserID != nil && *job.UserID == *filter.UserID)
+}
+
+func (p *Principal) Owner() JobOwner {
+	owner := JobOwner{WorkspaceID: p.WorkspaceID}
+	if p.KeyID != 0 {
+		id := p.KeyID
+		owner.APIKeyID = &id
+	}
+	if p.UserID != 0 {
+		id := p.UserID
+		owner.UserID = &id
+	}
+	return owner
+}
+
+// IsInstanceAdmin reports whether the caller administers every workspace,
+// which is reserved for admins of the default workspace.
+func (p *Principal) IsInstanceAdmin() bool {
+	return p.WorkspaceID == defaultWorkspaceID && p.HasScope(ScopeAdmin)
+}
+
+// Actor describes the caller for log lines
+func (p *Principal) Actor() string {
+	if p.UserID != 0 {
+		return "user " + p.Name
+	}
+	return "key " + p.Name
+}
+
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalContextKey).(*Principal)
+	return p
+}
+
+// authMiddleware resolves the API key sent as a bearer token or in the
+// X-API-Key header, falling back to the dashboard session cookie. Session
+// requests that change state must echo the session's CSRF token in the
+// X-CSRF-Token header. Scope checks are left to requireScope on each route.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+			key = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		}
+
+		var principal *Principal
+		if key != "" {
+			apiKey, err := lookupAPIKey(key)
+			if err != nil {
+				writeErrorResponse(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			principal = &Principal{KeyID: apiKey.ID, WorkspaceID: apiKey.WorkspaceID, Name: apiKey.Name, Scopes: apiKey.Scopes}
+		} else {
+			session, user, err := sessionFromRequest(r)
+			if err != nil {
+				writeErrorResponse(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+			if !isSafeMethod(r.Method) && !validCSRFToken(r.Header.Get("X-CSRF-Token"), session) {
+				writeErrorResponse(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			principal = &Principal{UserID: user.ID, WorkspaceID: user.WorkspaceID, Name: user.Username, Role: user.Role, Scopes: roleScopes[user.Role]}
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey, principal)
+		ctx = withLogAttrs(ctx, "actor", principal.Actor(), "workspace_id", principal.WorkspaceID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func sessionFromRequest(r *http.Request) (*Session, *User, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lookupSession(cookie.Value)
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func validCSRFToken(token string, session *Session) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) == 1
+}
+
+func requireInstanceAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return requireScope(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !principalFromContext(r.Context()).IsInstanceAdmin() {
+			writeErrorResponse(w, "Instance admin required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := principalFromContext(r.Context())
+		if p == nil {
+			writeErrorResponse(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !p.HasScope(scope) {
+			writeErrorResponse(w, "Missing scope "+scope, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowedOrigins comes from server.cors_allowed_origins. Without it no
+// cross-origin access is granted.
+func allowedOrigins() map[string]bool {
+	origins := make(map[string]bool)
+	for _, o := range cfg.Server.CORSAllowedOrigins {
+		origins[o] = true
+	}
+	return origins
+}
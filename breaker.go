@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Each llama-server has a circuit breaker in this process. After
+// generator.breaker_threshold consecutive failures the circuit opens and the
+// backend is skipped for generator.breaker_cooldown. Then it is half open:
+// one job is let through as a probe, closing the circuit if it succeeds and
+// opening it again if it fails.
+
+// Circuit states, as reported by /api/status
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// circuitStateValues are the values of acg_backend_circuit_state
+var circuitStateValues = map[string]float64{
+	CircuitClosed:   0,
+	CircuitHalfOpen: 1,
+	CircuitOpen:     2,
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	url      string
+	state    string
+	failures int
+	openedAt time.Time
+	// probing is set while the half-open probe is running
+	probing bool
+}
+
+// BackendStatus is a llama-server's circuit as this process sees it
+type BackendStatus struct {
+	URL      string     `json:"url"`
+	State    string     `json:"state"`
+	Failures int        `json:"consecutive_failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+var breakers = struct {
+	sync.Mutex
+	byURL map[string]*circuitBreaker
+}{byURL: make(map[string]*circuitBreaker)}
+
+func backendBreaker(url string) *circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b, ok := breakers.byURL[url]
+	if !ok {
+		b = &circuitBreaker{url: url, state: CircuitClosed}
+		breakers.byURL[url] = b
+		backendCircuitState.WithLabelValues(url).Set(circuitStateValues[CircuitClosed])
+	}
+	return b
+}
+
+// allow reports whether a request may go to the backend. Once the cooldown
+// has passed, the first caller gets through as the probe.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < cfg.Generator.BreakerCooldown {
+			return false
+		}
+		b.setState(CircuitHalfOpen)
+		b.probing = true
+		return true
+	case CircuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record counts the result of a request allowed through
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		if b.state != CircuitClosed {
+			loggerFrom(ctx).Info("backend recovered, circuit closed", "backend_url", b.url)
+		}
+		b.failures = 0
+		b.setState(CircuitClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= cfg.Generator.BreakerThreshold {
+		if b.state != CircuitOpen {
+			loggerFrom(ctx).Warn("backend failing, circuit opened", "backend_url", b.url, "failures", b.failures, "cooldown", cfg.Generator.BreakerCooldown.String())
+		}
+		b.openedAt = time.Now()
+		b.setState(CircuitOpen)
+	}
+}
+
+// release lets a request allowed through go without counting its result,
+// for a job cancelled mid-call. A half-open circuit waits for the next probe.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// closed reports whether the circuit is closed, without probing
+func (b *circuitBreaker) closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == CircuitClosed
+}
+
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	backendCircuitState.WithLabelValues(b.url).Set(circuitStateValues[state])
+}
+
+func (b *circuitBreaker) status() BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BackendStatus{URL: b.url, State: b.state, Failures: b.failures}
+	if b.state == CircuitOpen && cfg.Generator.BreakerCooldown <= time.Since(b.openedAt) {
+		// Open until the next job probes it
+		s.State = CircuitHalfOpen
+	}
+	if b.state != CircuitClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+// backendStatuses lists the circuit of every llama-server this process has
+// called, by URL
+func backendStatuses() []BackendStatus {
+	breakers.Lock()
+	list := make([]*circuitBreaker, 0, len(breakers.byURL))
+	for _, b := range breakers.byURL {
+		list = append(list, b)
+	}
+	breakers.Unlock()
+
+	statuses := make([]BackendStatus, 0, len(list))
+	for _, b := range list {
+		statuses = append(statuses, b.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].URL < statuses[j].URL
+	})
+	return statuses
+}
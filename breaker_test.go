@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	defer func(threshold int, cooldown time.Duration) {
+		cfg.Generator.BreakerThreshold, cfg.Generator.BreakerCooldown = threshold, cooldown
+	}(cfg.Generator.BreakerThreshold, cfg.Generator.BreakerCooldown)
+	cfg.Generator.BreakerThreshold = 3
+	cfg.Generator.BreakerCooldown = time.Minute
+
+	ctx := context.Background()
+	failed := errors.New("connection refused")
+	b := backendBreaker("http://breaker-test:8080")
+
+	for i := 0; i < 2; i++ {
+		b.record(ctx, failed)
+	}
+	if !b.allow() || b.state != CircuitClosed {
+		t.Fatalf("circuit is %s after 2 failures, want closed", b.state)
+	}
+	b.record(ctx, failed)
+	if b.allow() || b.state != CircuitOpen {
+		t.Fatalf("circuit is %s after 3 failures, want open", b.state)
+	}
+
+	// After the cooldown one probe goes through; a failed probe reopens
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	if s := b.status(); s.State != CircuitHalfOpen {
+		t.Errorf("status reports %s after the cooldown, want half_open", s.State)
+	}
+	if !b.allow() {
+		t.Fatal("probe was refused after the cooldown")
+	}
+	if b.allow() {
+		t.Error("second request allowed while the probe is running")
+	}
+	b.record(ctx, failed)
+	if b.allow() || b.state != CircuitOpen {
+		t.Fatalf("circuit is %s after a failed probe, want open", b.state)
+	}
+
+	// A successful probe closes the circuit and resets the count
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	b.allow()
+	b.record(ctx, nil)
+	if !b.closed() || b.failures != 0 {
+		t.Errorf("circuit is %s with %d failures after a good probe, want closed with 0", b.state, b.failures)
+	}
+	if s := b.status(); s.OpenedAt != nil {
+		t.Error("closed circuit reports an opened_at time")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	defer func(threshold int) { cfg.Generator.BreakerThreshold = threshold }(cfg.Generator.BreakerThreshold)
+	cfg.Generator.BreakerThreshold = 2
+
+	ctx := context.Background()
+	b := backendBreaker("http://breaker-test:8081")
+	b.record(ctx, errors.New("timeout"))
+	b.record(ctx, nil)
+	b.record(ctx, errors.New("timeout"))
+	if !b.closed() {
+		t.Error("failures separated by a success opened the circuit")
+	}
+}
+
+func TestCircuitBreakerCancelledProbe(t *testing.T) {
+	defer func(threshold int, cooldown time.Duration) {
+		cfg.Generator.BreakerThreshold, cfg.Generator.BreakerCooldown = threshold, cooldown
+	}(cfg.Generator.BreakerThreshold, cfg.Generator.BreakerCooldown)
+	cfg.Generator.BreakerThreshold = 1
+	cfg.Generator.BreakerCooldown = time.Minute
+
+	b := backendBreaker("http://breaker-test:8082")
+	b.record(context.Background(), errors.New("timeout"))
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	if !b.allow() {
+		t.Fatal("probe was refused after the cooldown")
+	}
+
+	// The job is cancelled mid-probe: the next job probes instead
+	b.release()
+	if b.state != CircuitHalfOpen || b.failures != 1 {
+		t.Errorf("circuit is %s with %d failures after a cancelled probe, want half_open with 1", b.state, b.failures)
+	}
+	if !b.allow() {
+		t.Fatal("no new probe allowed after a cancelled one")
+	}
+	if b.allow() {
+		t.Error("second request allowed while the new probe is running")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Before a llama-server job runs, its prompt and the output it asks for are
+// fitted into the model's context window. The prompt is counted by the
+// server's tokenizer when it answers, and estimated otherwise. Output that
+// does not fit is generated in parts or, when chunked is false, capped.
+
+const (
+	// defaultContextLength is llama.cpp's n_ctx when nothing says otherwise
+	defaultContextLength = 2048
+	// minOutputTokens is the least room a prompt must leave for output
+	minOutputTokens = 128
+	// budgetProbeTimeout bounds asking a llama-server about its context
+	// and counting tokens with it
+	budgetProbeTimeout = 5 * time.Second
+)
+
+// Where a context length came from
+const (
+	ContextFromConfig  = "config"
+	ContextFromServer  = "server"
+	ContextFromModel   = "model"
+	ContextFromDefault = "default"
+)
+
+// TokenBudget is how a job's generation fits the model's context window
+type TokenBudget struct {
+	ContextLength int    `json:"context_length"`
+	ContextSource string `json:"context_source"`
+	PromptTokens  int    `json:"prompt_tokens"`
+	// Counted is set when the server's tokenizer counted the prompt,
+	// rather than it being estimated
+	Counted bool `json:"counted"`
+	// Requested is the output the job asked for, MaxTokens what each
+	// generation call may produce
+	Requested int  `json:"requested_tokens"`
+	MaxTokens int  `json:"max_tokens"`
+	Chunked   bool `json:"chunked,omitempty"`
+}
+
+// Capped reports whether the job gets less output than it asked for
+func (b *TokenBudget) Capped() bool {
+	return !b.Chunked && b.MaxTokens < b.Requested
+}
+
+// apply sets the budget's limit and mode on a job's params. A chunked job
+// without a word count gets the one its requested tokens make, since that
+// is what its sections share.
+func (b *TokenBudget) apply(params GenerationParams) GenerationParams {
+	params.MaxTokens = b.MaxTokens
+	chunked := b.Chunked
+	params.Chunked = &chunked
+	if b.Chunked && params.WordCount == 0 {
+		// English averages about four tokens for every three words
+		params.WordCount = b.Requested * 3 / 4
+	}
+	return params
+}
+
+// planBudget fits a generation into the context window of the generator's
+// llama-server. It fails when the prompt leaves too little room for any
+// output.
+func (g *LLMGenerator) planBudget(ctx context.Context, jobType, prompt string, params GenerationParams) (*TokenBudget, error) {
+	b := &TokenBudget{Requested: params.tokenLimit()}
+	b.ContextLength, b.ContextSource = g.contextLength(ctx)
+	b.PromptTokens, b.Counted = g.promptTokens(ctx, prompt)
+
+	available := b.ContextLength - b.PromptTokens
+	if available < minOutputTokens {
+		return b, fmt.Errorf("the prompt is %d tokens but the model's context window is %d, leaving less than the %d tokens needed for output",
+			b.PromptTokens, b.ContextLength, minOutputTokens)
+	}
+	b.MaxTokens = b.Requested
+	if b.MaxTokens > available {
+		b.MaxTokens = available
+	}
+
+	// Long articles are written in parts unless the job says not to;
+	// translations must stay whole
+	switch {
+	case jobType == JobTypeTranslate:
+	case params.Chunked != nil:
+		b.Chunked = *params.Chunked
+	default:
+		b.Chunked = b.Requested > available
+	}
+	return b, nil
+}
+
+// checkJobFits fails a job for a llama-server workspace whose prompt could
+// never fit the model, before it is queued. It estimates, so the worker
+// checks again.
+func checkJobFits(ctx context.Context, ws *Workspace, req CreateJobRequest) error {
+	if ws.Backend != BackendLlamaServer || req.Type == JobTypeTranslate {
+		return nil
+	}
+	window := cfg.Generator.ContextLength
+	if window == 0 {
+		modelPath := ws.ModelPath
+		if req.Model != "" {
+			if m, err := lookupModel(req.Model); err == nil {
+				modelPath = m.Path
+			}
+		} else if modelPath == "" {
+			modelPath = findModel()
+		}
+		window = modelContextLength(modelPath)
+	}
+	if window == 0 {
+		window = defaultContextLength
+	}
+	jobType := req.Type
+	if jobType == "" {
+		jobType = "blog"
+	}
+	rendered := renderPrompt(ctx, ws.ID, jobType, req.Topic, req.Params)
+	if steps := pipelineFor(ctx, ws, jobType); steps != nil {
+		rendered = outlinePrompt(steps, req.Topic, req.Params)
+	}
+	prompt := estimateTokens(rendered)
+	if prompt+minOutputTokens > window {
+		return fmt.Errorf("the prompt is about %d tokens but the model's context window is %d, leaving less than the %d tokens needed for output",
+			prompt, window, minOutputTokens)
+	}
+	return nil
+}
+
+// contextLength is the context window generations get: generator.context_length,
+// else what the llama-server reports, else the model file's, else llama.cpp's default
+func (g *LLMGenerator) contextLength(ctx context.Context) (int, string) {
+	if cfg.Generator.ContextLength > 0 {
+		return cfg.Generator.ContextLength, ContextFromConfig
+	}
+	if g.backend == BackendLlamaServer {
+		n, err := g.serverContextLength(ctx)
+		if err == nil && n > 0 {
+			return n, ContextFromServer
+		}
+		if err != nil {
+			loggerFrom(ctx).Debug("could not get context length from llama-server", "backend_url", g.backendURL, "error", err)
+		}
+	}
+	if n := modelContextLength(g.modelPath); n > 0 {
+		return n, ContextFromModel
+	}
+	return defaultContextLength, ContextFromDefault
+}
+
+// modelContextLength is the context length in a model file's metadata, or
+// 0 when the file is missing or does not say
+func modelContextLength(path string) int {
+	if path == "" {
+		return 0
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return modelInfo(path, fi).ContextLength
+}
+
+// promptTokens counts a prompt's tokens with the llama-server's tokenizer,
+// reporting whether it did, or estimates them
+func (g *LLMGenerator) promptTokens(ctx context.Context, prompt string) (int, bool) {
+	if g.backend == BackendLlamaServer {
+		n, err := g.serverTokenCount(ctx, prompt)
+		if err == nil {
+			return n, true
+		}
+		loggerFrom(ctx).Debug("could not count tokens with llama-server, estimating", "backend_url", g.backendURL, "error", err)
+	}
+	return estimateTokens(prompt), false
+}
+
+// serverContextLength reads n_ctx from the llama-server's /props
+func (g *LLMGenerator) serverContextLength(ctx context.Context) (int, error) {
+	var props struct {
+		DefaultGenerationSettings struct {
+			NCtx int `json:"n_ctx"`
+		} `json:"default_generation_settings"`
+	}
+	if err := g.probe(ctx, http.MethodGet, "/props", nil, &props); err != nil {
+		return 0, err
+	}
+	return props.DefaultGenerationSettings.NCtx, nil
+}
+
+// serverTokenCount tokenizes text with the llama-server's /tokenize
+func (g *LLMGenerator) serverTokenCount(ctx context.Context, text string) (int, error) {
+	var result struct {
+		Tokens []json.RawMessage `json:"tokens"`
+	}
+	if err := g.probe(ctx, http.MethodPost, "/tokenize", map[string]string{"content": text}, &result); err != nil {
+		return 0, err
+	}
+	return len(result.Tokens), nil
+}
+
+// probe makes a quick call to the generator's own llama-server, unless its
+// circuit is open
+func (g *LLMGenerator) probe(ctx context.Context, method, path string, request, response interface{}) error {
+	if !backendBreaker(g.backendURL).closed() {
+		return fmt.Errorf("circuit is not closed")
+	}
+	ctx, cancel := context.WithTimeout(ctx, budgetProbeTimeout)
+	defer cancel()
+
+	var body bytes.Buffer
+	if request != nil {
+		if err := json.NewEncoder(&body).Encode(request); err != nil {
+			return fmt.Errorf("failed to encode request: %v", err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.backendURL+path, &body)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Generations that would come out the same every time are cached in the
+// database, shared by every worker. The key covers everything the output
+// depends on: backend, model file, topic, rendered prompt and parameters.
+// It also covers the workspace, so output is never shared between tenants.
+// Only output that passed the quality checks is stored.
+
+// Cache lookup results, as counted by acg_generation_cache_requests_total
+const (
+	CacheHit    = "hit"
+	CacheMiss   = "miss"
+	CacheBypass = "bypass"
+)
+
+// BackendCache is recorded as the backend of a job served from the cache
+const BackendCache = "cache"
+
+func cacheEnabled() bool {
+	return cfg.Generator.CacheTTL > 0
+}
+
+// deterministic reports whether the generator would give the same output
+// for the same input: the local backend always does, llama-server only
+// with a fixed seed or no sampling
+func (g *LLMGenerator) deterministic(params GenerationParams) bool {
+	if g.backend != BackendLlamaServer {
+		return true
+	}
+	return params.Seed != nil || (params.Temperature != nil && *params.Temperature == 0)
+}
+
+// cacheKey hashes everything the output depends on. The model file's size
+// and modification time are included so a replaced file misses.
+func (g *LLMGenerator) cacheKey(workspaceID int, topic, prompt string, params GenerationParams) string {
+	model := g.modelPath
+	if fi, err := os.Stat(g.modelPath); err == nil {
+		model = fmt.Sprintf("%s:%d:%d", g.modelPath, fi.Size(), fi.ModTime().UnixNano())
+	}
+	data, _ := json.Marshal(struct {
+		Workspace  int              `json:"workspace_id"`
+		Backend    string           `json:"backend"`
+		BackendURL string           `json:"backend_url"`
+		Model      string           `json:"model"`
+		Topic      string           `json:"topic"`
+		Prompt     string           `json:"prompt"`
+		Params     GenerationParams `json:"params"`
+		MaxTokens  int              `json:"max_tokens"`
+	}{workspaceID, g.backend, g.backendURL, model, topic, prompt, params, params.tokenLimit()})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupGeneration finds a job's generation in the cache. It returns the
+// key to store fresh output under, or "" when the cache is bypassed: the
+// job opted out, its last output failed the quality checks, or the
+// generation would not come out the same again.
+func lookupGeneration(ctx context.Context, job *Job, g *LLMGenerator, prompt string, params GenerationParams) (key, output string, hit bool) {
+	if !cacheEnabled() {
+		return "", "", false
+	}
+	if job.NoCache || job.Quality != nil || !g.deterministic(params) {
+		generationCacheRequests.WithLabelValues(CacheBypass).Inc()
+		return "", "", false
+	}
+	key = g.cacheKey(job.WorkspaceID, job.Topic, prompt, params)
+	output, hit, err := cachedOutput(ctx, key)
+	if err != nil {
+		loggerFrom(ctx).Error("failed to read generation cache", "error", err)
+	}
+	if hit {
+		generationCacheRequests.WithLabelValues(CacheHit).Inc()
+	} else {
+		generationCacheRequests.WithLabelValues(CacheMiss).Inc()
+	}
+	return key, output, hit
+}
+
+// cacheable reports whether the last content came from the workspace's own
+// backend, rather than a fallback after its llama-server failed
+func (g *LLMGenerator) cacheable() bool {
+	return g.backend != BackendLlamaServer || (g.usedBackend == BackendLlamaServer && g.usedURL == g.backendURL)
+}
+
+// cachedOutput returns the cached output for key, if there is a fresh one
+func cachedOutput(ctx context.Context, key string) (string, bool, error) {
+	var output string
+	err := dbQueryRow(ctx, "cachedOutput", `SELECT output FROM generation_cache WHERE key = ? AND created_at >= ?`,
+		key, time.Now().Add(-cfg.Generator.CacheTTL)).Scan(&output)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read generation cache: %v", err)
+	}
+	if _, err := dbExec(ctx, "touchCachedOutput", `UPDATE generation_cache SET last_used_at = ? WHERE key = ?`, time.Now(), key); err != nil {
+		return "", false, fmt.Errorf("failed to update generation cache: %v", err)
+	}
+	return output, true, nil
+}
+
+// storeCachedOutput caches output under key, then evicts expired entries
+// and the least recently used ones over the size limits
+func storeCachedOutput(ctx context.Context, key, output string) error {
+	now := time.Now()
+	_, err := dbExec(ctx, "storeCachedOutput", `INSERT INTO generation_cache (key, output, size, created_at, last_used_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET output = excluded.output, size = excluded.size, created_at = excluded.created_at, last_used_at = excluded.last_used_at`,
+		key, output, len(output), now, now)
+	if err != nil {
+		return fmt.Errorf("failed to store in generation cache: %v", err)
+	}
+
+	if _, err := dbExec(ctx, "expireCachedOutputs", `DELETE FROM generation_cache WHERE created_at < ?`, now.Add(-cfg.Generator.CacheTTL)); err != nil {
+		return fmt.Errorf("failed to expire generation cache: %v", err)
+	}
+	_, err = dbExec(ctx, "evictCachedOutputs", `DELETE FROM generation_cache WHERE key IN (
+		SELECT key FROM (
+			SELECT key, ROW_NUMBER() OVER recent AS n, SUM(size) OVER recent AS total
+			FROM generation_cache WINDOW recent AS (ORDER BY last_used_at DESC, key)
+		) WHERE n > ? OR total > ?)`,
+		cfg.Generator.CacheMaxEntries, cfg.Generator.CacheMaxBytes)
+	if err != nil {
+		return fmt.Errorf("failed to evict from generation cache: %v", err)
+	}
+	return nil
+}
+
+// clearCache empties the generation cache, returning how many outputs it held
+func clearCache(ctx context.Context) (int, error) {
+	result, err := dbExec(ctx, "clearCache", `DELETE FROM generation_cache`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clear generation cache: %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A long article is generated in parts: first a title and outline, then
+// each section on its own, given the outline and the end of the section
+// before. Each call fits the context window where the whole article would
+// not. The parts are put together in the format of the built-in template.
+
+const (
+	// outlineTokens is the most an outline may take
+	outlineTokens = 300
+	// minSections and maxSections bound how many parts an outline may have
+	minSections = 2
+	maxSections = 12
+	// continuityChars is how much of the previous section a section sees
+	continuityChars = 600
+)
+
+var outlineItem = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)])\s+(.+)$`)
+
+const outlineRequest = `Before writing anything else, reply with only the article's plan: its title on the first line, then one line per section starting with "- ". Do not write the article yet.`
+
+const sectionPrompt = `You are writing the article "{{title}}" about {{topic}}.
+
+Its sections are:
+{{outline}}
+{{previous}}
+Write only the section "{{section}}", {{word_count}}, in plain paragraphs without a heading.`
+
+// complete generates on one llama-server, in parts when params ask for it
+func (g *LLMGenerator) complete(ctx context.Context, url, topic, prompt string, params GenerationParams) (string, error) {
+	if params.Chunked != nil && *params.Chunked {
+		return g.chunkedGeneration(ctx, url, topic, prompt, params)
+	}
+	return g.llamaServerGeneration(ctx, url, prompt, params)
+}
+
+// chunkedGeneration writes an article outline first, then section by
+// section. params.MaxTokens bounds every call.
+func (g *LLMGenerator) chunkedGeneration(ctx context.Context, url, topic, prompt string, params GenerationParams) (string, error) {
+	logger := loggerFrom(ctx)
+	outlineParams := params
+	outlineParams.MaxTokens = min(outlineTokens, params.MaxTokens)
+	plan, err := g.llamaServerGeneration(ctx, url, prompt+"\n\n"+outlineRequest, outlineParams)
+	if err != nil {
+		return "", fmt.Errorf("outline: %v", err)
+	}
+	title, sections := parseOutline(plan)
+	if title == "" {
+		title = topic
+	}
+	if len(sections) < minSections {
+		return "", fmt.Errorf("outline has %d sections, at least %d are needed", len(sections), minSections)
+	}
+
+	// The article's length is shared between its sections
+	sectionWords := max(params.WordCount/len(sections), 50)
+	logger.Info("generating in parts", "sections", len(sections), "words_per_section", sectionWords)
+
+	var outline strings.Builder
+	for _, s := range sections {
+		outline.WriteString("- " + s + "\n")
+	}
+
+	var article strings.Builder
+	article.WriteString("## OUTLINE\n" + outline.String() + "\n## ARTICLE\n\n# " + title + "\n")
+	previous := ""
+	for i, section := range sections {
+		sectionParams := params
+		sectionParams.WordCount = sectionWords
+		sectionParams.MaxTokens = min(sectionWords*4/3+100, params.MaxTokens)
+
+		// The model's own text goes in with the parameters in one pass
+		sectionRequest := applyParams(sectionPrompt, topic, sectionParams,
+			"{{title}}", title,
+			"{{outline}}", outline.String(),
+			"{{previous}}", previousText(previous),
+			"{{section}}", section,
+		)
+		text, err := g.llamaServerGeneration(ctx, url, sectionRequest, sectionParams)
+		if err != nil {
+			return "", fmt.Errorf("section %d of %d: %v", i+1, len(sections), err)
+		}
+		text = stripHeading(text, section)
+		article.WriteString("\n## " + section + "\n\n" + text + "\n")
+		previous = text
+	}
+	return strings.TrimSpace(article.String()), nil
+}
+
+// parseOutline reads a title line and the section items from a plan
+func parseOutline(plan string) (string, []string) {
+	var title string
+	var sections []string
+	for _, line := range strings.Split(plan, "\n") {
+		if m := outlineItem.FindStringSubmatch(line); m != nil {
+			if len(sections) < maxSections {
+				sections = append(sections, cleanHeading(m[1]))
+			}
+			continue
+		}
+		if line = cleanHeading(line); title == "" && len(sections) == 0 && line != "" {
+			title = strings.TrimPrefix(line, "Title: ")
+		}
+	}
+	return title, sections
+}
+
+// cleanHeading strips markdown heading marks, emphasis and quotes
+func cleanHeading(s string) string {
+	s = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(s), "#"))
+	return strings.Trim(s, "*_\"' ")
+}
+
+// stripHeading removes a heading the model repeated at the top of a section
+func stripHeading(text, section string) string {
+	text = strings.TrimSpace(text)
+	first, rest, _ := strings.Cut(text, "\n")
+	if strings.HasPrefix(first, "#") || strings.EqualFold(cleanHeading(first), section) {
+		return strings.TrimSpace(rest)
+	}
+	return text
+}
+
+// tail is the end of s, at most n bytes, starting at a word
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[len(s)-n:]
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		s = s[i+1:]
+	}
+	return "..." + s
+}
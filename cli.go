@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usageText = `Usage: content-automator <command> [flags]
+
+Commands:
+  serve                          run the HTTP server and worker (default)
+  worker                         run the worker only, without HTTP
+  generate -topic X [-type T]    generate one article to stdout (-words, -tone, ...)
+  models list                    list the models in the model directories
+  models default [name]          set the default model (no name: first found)
+  jobs list [-status S]          list jobs
+  jobs show <id>                 print one job as JSON
+  jobs delete <id>               delete a job
+  jobs retry <id>                requeue a completed, failed or needs_review job
+  jobs approve <id>              accept the output of a needs_review job
+  import [file]                  queue jobs from JSON lines (stdin if no file)
+  export [-status S]             write jobs as JSON lines to stdout
+  cache clear                    empty the generation cache
+  config print                   print the effective configuration
+
+Every command accepts the config flags (-config, -db, ...); run a command
+with -h to list them.
+`
+
+// runCommand dispatches to a subcommand. With no command, or only flags,
+// it serves, as the binary always has.
+func runCommand(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args)
+	}
+
+	cmd, rest := args[0], args[1:]
+	switch cmd {
+	case "serve":
+		return runServe(rest)
+	case "worker":
+		return runWorker(rest)
+	case "generate":
+		return runGenerate(rest)
+	case "models":
+		return runModels(rest)
+	case "jobs":
+		return runJobs(rest)
+	case "import":
+		return runImport(rest)
+	case "export":
+		return runExport(rest)
+	case "config":
+		return runConfig(rest)
+	case "cache":
+		return runCache(rest)
+	case "help":
+		fmt.Print(usageText)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usageText)
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("usage: config print [flags]")
+	}
+	loaded, err := parseCommandFlags(flag.NewFlagSet("config print", flag.ContinueOnError), args[1:])
+	if err != nil {
+		return err
+	}
+	return printConfig(os.Stdout, loaded)
+}
+
+func runCache(args []string) error {
+	if len(args) == 0 || args[0] != "clear" {
+		return fmt.Errorf("usage: cache clear [flags]")
+	}
+	loaded, err := parseCommandFlags(flag.NewFlagSet("cache clear", flag.ContinueOnError), args[1:])
+	if err != nil {
+		return err
+	}
+	if err := openStore(loaded); err != nil {
+		return err
+	}
+	defer closeStore()
+	n, err := clearCache(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d cached generations\n", n)
+	return nil
+}
+
+// runWorker is serve in worker mode
+func runWorker(args []string) error {
+	loaded, err := parseCommandFlags(flag.NewFlagSet("worker", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	loaded.Mode = ModeWorker
+	return serve(loaded)
+}
+
+func runGenerate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	topic := fs.String("topic", "", "topic to write about")
+	jobType := fs.String("type", "blog", "content type")
+	workspaceID := fs.Int("workspace", defaultWorkspaceID, "workspace whose model and templates to use")
+	model := fs.String("model", "", "model to use instead of the workspace's or the default")
+	params := addParamFlags(fs)
+	loaded, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(*topic) == "" {
+		return fmt.Errorf("-topic is required")
+	}
+	p := params()
+	if err := validateParams(*jobType, p); err != nil {
+		return err
+	}
+	if err := openStore(loaded); err != nil {
+		return err
+	}
+	defer closeStore()
+
+	ws, err := getWorkspace(*workspaceID)
+	if err != nil {
+		return err
+	}
+	generator := NewWorkspaceGenerator(ws)
+	if *model != "" {
+		m, err := lookupModel(*model)
+		if err != nil {
+			return err
+		}
+		generator.modelPath = m.Path
+	}
+	ctx := context.Background()
+	prompt := renderPrompt(ctx, ws.ID, *jobType, *topic, p)
+	if generator.backend == BackendLlamaServer {
+		budget, err := generator.planBudget(ctx, *jobType, prompt, p)
+		if err != nil {
+			return fmt.Errorf("does not fit the model: %v", err)
+		}
+		p = budget.apply(p)
+	}
+	content := generator.GenerateContent(ctx, *topic, prompt, p)
+	if content == "" {
+		return fmt.Errorf("content generation failed")
+	}
+	fmt.Println(content)
+	return nil
+}
+
+func runModels(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: models list|default [name]")
+	}
+	sub, rest := args[0], args[1:]
+	if sub != "list" && sub != "default" {
+		return fmt.Errorf("unknown models command %q", sub)
+	}
+
+	fs := flag.NewFlagSet("models "+sub, flag.ContinueOnError)
+	cf := addConfigFlags(fs)
+	positional, err := parseInterspersed(fs, rest)
+	if err != nil {
+		return err
+	}
+	loaded, err := cf.load()
+	if err != nil {
+		return err
+	}
+	if err := openStore(loaded); err != nil {
+		return err
+	}
+	defer closeStore()
+	ctx := context.Background()
+
+	if sub == "default" {
+		if len(positional) > 1 {
+			return fmt.Errorf("usage: models default [name]")
+		}
+		name := ""
+		if len(positional) == 1 {
+			name = positional[0]
+		}
+		if err := setDefaultModel(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	models, err := listModels(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEFAULT\tNAME\tSIZE\tARCH\tPARAMS\tQUANT\tCONTEXT")
+	for _, m := range models {
+		def := ""
+		if m.Default {
+			def = "*"
+		}
+		if m.Error != "" {
+			fmt.Fprintf(tw, "\t%s\t%.1f GB\trejected: %s\n", m.Name, float64(m.SizeBytes)/(1<<30), m.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1f GB\t%s\t%s\t%s\t%d\n", def, m.Name, float64(m.SizeBytes)/(1<<30),
+			m.Architecture, formatParameterCount(m.ParameterCount), m.Quantization, m.ContextLength)
+	}
+	return tw.Flush()
+}
+
+// addParamFlags adds a flag for each generation parameter. The returned
+// function, called after parsing, collects the ones given.
+func addParamFlags(fs *flag.FlagSet) func() GenerationParams {
+	var p GenerationParams
+	var keywords string
+	temperature := fs.Float64("temperature", 0, "sampling temperature, 0 to 2")
+	seed := fs.Int64("seed", 0, "sampling seed")
+	chunked := fs.Bool("chunked", false, "write in parts, outline first (default: only when too long for the context)")
+	fs.IntVar(&p.WordCount, "words", 0, "target word count")
+	fs.StringVar(&p.Tone, "tone", "", "tone, e.g. casual or formal")
+	fs.StringVar(&p.Audience, "audience", "", "intended audience")
+	fs.StringVar(&p.Language, "language", "", "language tag, e.g. en or de")
+	fs.StringVar(&keywords, "keywords", "", "comma-separated keywords to include")
+	fs.IntVar(&p.MaxTokens, "max-tokens", 0, "most tokens to generate")
+	return func() GenerationParams {
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "temperature":
+				p.Temperature = temperature
+			case "seed":
+				p.Seed = seed
+			case "chunked":
+				p.Chunked = chunked
+			}
+		})
+		for _, k := range strings.Split(keywords, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				p.Keywords = append(p.Keywords, k)
+			}
+		}
+		return p
+	}
+}
+
+func runJobs(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: jobs list|show|delete|retry|approve")
+	}
+	sub, rest := args[0], args[1:]
+	switch sub {
+	case "list", "show", "delete", "retry", "approve":
+	default:
+		return fmt.Errorf("unknown jobs command %q", sub)
+	}
+
+	fs := flag.NewFlagSet("jobs "+sub, flag.ContinueOnError)
+	workspaceID := fs.Int("workspace", defaultWorkspaceID, "workspace to operate on")
+	status := fs.String("status", "", "only jobs with this status (list)")
+	cf := addConfigFlags(fs)
+	positional, err := parseInterspersed(fs, rest)
+	if err != nil {
+		return err
+	}
+	loaded, err := cf.load()
+	if err != nil {
+		return err
+	}
+	if err := openStore(loaded); err != nil {
+		return err
+	}
+	defer closeStore()
+	ctx := context.Background()
+
+	if sub == "list" {
+		jobs, err := getJobs(ctx, JobFilter{WorkspaceID: *workspaceID, Status: *status})
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATUS\tPRIORITY\tTYPE\tCREATED\tTOPIC")
+		for _, job := range jobs {
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\t%s\n", job.ID, job.Status, job.Priority, job.Type, job.CreatedAt.Format("2006-01-02 15:04"), job.Topic)
+		}
+		return tw.Flush()
+	}
+
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: jobs %s <id>", sub)
+	}
+	id, err := strconv.Atoi(positional[0])
+	if err != nil {
+		return fmt.Errorf("invalid job ID %q", positional[0])
+	}
+
+	switch sub {
+	case "show":
+		job, err := getJobByID(ctx, *workspaceID, id)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(job)
+	case "delete":
+		if err := deleteJob(ctx, *workspaceID, id); err != nil {
+			return err
+		}
+		fmt.Printf("Job %d deleted\n", id)
+	case "retry":
+		if err := retryJob(ctx, *workspaceID, id); err != nil {
+			return err
+		}
+		fmt.Printf("Job %d queued for retry\n", id)
+	case "approve":
+		if err := approveJob(ctx, *workspaceID, id); err != nil {
+			return err
+		}
+		fmt.Printf("Job %d approved\n", id)
+	}
+	return nil
+}
+
+// runImport queues one job per JSON line, each shaped like a POST /api/jobs
+// body. Blank lines are skipped; a bad line stops the import.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	workspaceID := fs.Int("workspace", defaultWorkspaceID, "workspace to import into")
+	batch := fs.String("batch", "cli-import", "batch name for fair scheduling")
+	cf := addConfigFlags(fs)
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return fmt.Errorf("usage: import [file]")
+	}
+	loaded, err := cf.load()
+	if err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if len(positional) == 1 && positional[0] != "-" {
+		f, err := os.Open(positional[0])
+		if err != nil {
+			return fmt.Errorf("failed to open import file: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if err := openStore(loaded); err != nil {
+		return err
+	}
+	defer closeStore()
+	ctx := context.Background()
+	ws, err := getWorkspace(*workspaceID)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	imported, skipped, line := 0, 0, 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var req CreateJobRequest
+		if err := json.Unmarshal([]byte(text), &req); err != nil {
+			return fmt.Errorf("line %d: invalid JSON: %v", line, err)
+		}
+		if err := validateTranslation(req); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if req.Type == JobTypeTranslate {
+			source, err := translationSource(ctx, *workspaceID, *req.SourceJobID)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			if strings.TrimSpace(req.Topic) == "" {
+				req.Topic = source.Topic
+			}
+		}
+		if strings.TrimSpace(req.Topic) == "" {
+			return fmt.Errorf("line %d: topic is required", line)
+		}
+		if req.Priority < MinPriority || req.Priority > MaxPriority {
+			return fmt.Errorf("line %d: priority must be between %d and %d", line, MinPriority, MaxPriority)
+		}
+		if err := validateParams(req.Type, req.Params); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if req.Model != "" {
+			if _, err := lookupModel(req.Model); err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		if err := checkJobFits(ctx, ws, req); err != nil {
+			return fmt.Errorf("line %d: does not fit the model: %v", line, err)
+		}
+		if req.Batch == "" {
+			req.Batch = *batch
+		}
+
+		if req.Dedupe {
+			existing, err := findDedupeJob(ctx, JobFilter{WorkspaceID: *workspaceID}, dedupeHash(req))
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			if existing != nil {
+				slog.Info("skipped duplicate job", "line", line, "job_id", existing.ID)
+				skipped++
+				continue
+			}
+		}
+
+		client := fmt.Sprintf("ws:%d/batch:%s", *workspaceID, req.Batch)
+		if _, err := createJob(ctx, req, client, JobOwner{WorkspaceID: *workspaceID}, nil); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read import: %v", err)
+	}
+
+	slog.Info("imported jobs", "jobs", imported, "duplicates_skipped", skipped)
+	return nil
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	workspaceID := fs.Int("workspace", defaultWorkspaceID, "workspace to export")
+	status := fs.String("status", "", "only jobs with this status")
+	loaded, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := openStore(loaded); err != nil {
+		return err
+	}
+	defer closeStore()
+	ctx := context.Background()
+
+	jobs, err := getJobs(ctx, JobFilter{WorkspaceID: *workspaceID, Status: *status})
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	for _, job := range jobs {
+		if err := enc.Encode(job); err != nil {
+			return fmt.Errorf("failed to write job %d: %v", job.ID, err)
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the effective configuration: defaults, overridden by the config
+// file, then by ACG_* environment variables, then by command-line flags.
+type Config struct {
+	// Mode selects what serve runs: the API, the worker, or both
+	Mode      string          `yaml:"mode"`
+	Server    ServerConfig    `yaml:"server"`
+	Storage   StorageConfig   `yaml:"storage"`
+	Worker    WorkerConfig    `yaml:"worker"`
+	Generator GeneratorConfig `yaml:"generator"`
+	Quality   QualityConfig   `yaml:"quality"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Log       LogConfig       `yaml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+}
+
+type ServerConfig struct {
+	Addr               string   `yaml:"addr"`
+	CORSAllowedOrigins []string `yaml:"cors_allowed_origins"`
+	// MetricsAddr serves /metrics on a separate listener. When empty it is
+	// served on Addr, and worker-only processes expose no metrics.
+	MetricsAddr string `yaml:"metrics_addr"`
+}
+
+type StorageConfig struct {
+	DBPath string `yaml:"db_path"`
+}
+
+type WorkerConfig struct {
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// WakeCheckInterval is how often an idle worker checks for a wake-up
+	// from /api/process
+	WakeCheckInterval time.Duration `yaml:"wake_check_interval"`
+	// LeaseTimeout is how long a claim may go unrenewed before the job is
+	// assumed to have lost its worker and is requeued. Workers renew claims
+	// while jobs run, so it need not cover a whole generation.
+	LeaseTimeout time.Duration `yaml:"lease_timeout"`
+	// ID names this worker in claimed_by; hostname:pid when empty
+	ID string `yaml:"id"`
+}
+
+type GeneratorConfig struct {
+	// ModelDirs are searched in order for the first .gguf/.ggml file
+	ModelDirs      []string `yaml:"model_dirs"`
+	PromptTemplate string   `yaml:"prompt_template"`
+	// BackendURL is the llama.cpp server used by workspaces that select the
+	// llama-server backend without a URL of their own
+	BackendURL string        `yaml:"backend_url"`
+	Timeout    time.Duration `yaml:"timeout"`
+	MaxTokens  int           `yaml:"max_tokens"`
+	// ContextLength is the context window the llama-servers run with (their
+	// -c). When 0 it is asked of the server, then read from the model file.
+	ContextLength int `yaml:"context_length"`
+	// CacheTTL is how long deterministic generations are reused; 0 turns
+	// the cache off. CacheMaxEntries and CacheMaxBytes bound its size, the
+	// least recently used outputs going first.
+	CacheTTL        time.Duration `yaml:"cache_ttl"`
+	CacheMaxEntries int           `yaml:"cache_max_entries"`
+	CacheMaxBytes   int           `yaml:"cache_max_bytes"`
+	// Fallbacks are llama-servers tried in order when a workspace's own
+	// fails, before the local backend
+	Fallbacks []FallbackConfig `yaml:"fallbacks"`
+	// BreakerThreshold consecutive failures open a llama-server's circuit,
+	// skipping it for BreakerCooldown before one job probes it again
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+	// Pipelines are the steps llama-server jobs are generated in, by
+	// content type. A type listed here replaces its built-in pipeline; an
+	// empty list makes it generate in one go.
+	Pipelines map[string][]PipelineStep `yaml:"pipelines"`
+}
+
+type FallbackConfig struct {
+	URL string `yaml:"url"`
+	// Timeout replaces generator.timeout for this server when set
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type QualityConfig struct {
+	// MaxRetries is how many more times a job whose output fails the
+	// quality checks is generated before it is flagged needs_review
+	MaxRetries int `yaml:"max_retries"`
+	// MinWordRatio is the share of the target word count output must reach
+	MinWordRatio float64 `yaml:"min_word_ratio"`
+	// BannedPhrases fail output containing any of them, ignoring case
+	BannedPhrases []string `yaml:"banned_phrases"`
+	// DuplicateThreshold fails output at least this similar to an earlier
+	// job in the workspace; 0 turns the check off
+	DuplicateThreshold float64 `yaml:"duplicate_threshold"`
+}
+
+type AuthConfig struct {
+	SessionLifetime     time.Duration `yaml:"session_lifetime"`
+	RateLimitRPS        float64       `yaml:"rate_limit_rps"`
+	RateLimitBurst      int           `yaml:"rate_limit_burst"`
+	LoginRateLimitRPS   float64       `yaml:"login_rate_limit_rps"`
+	LoginRateLimitBurst int           `yaml:"login_rate_limit_burst"`
+	// BootstrapAdminPassword sets the first admin's password instead of a
+	// random one. It is a secret and is redacted by "config print".
+	BootstrapAdminPassword string `yaml:"bootstrap_admin_password"`
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is json or text
+	Format string `yaml:"format"`
+}
+
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP collector URL, e.g. http://localhost:4318.
+	// Tracing is off when it is empty.
+	Endpoint    string  `yaml:"endpoint"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// Run modes
+const (
+	ModeCombined = "combined"
+	ModeAPI      = "api"
+	ModeWorker   = "worker"
+)
+
+// cfg is the configuration in use. It holds the defaults until main loads
+// the real one.
+var cfg = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Mode: ModeCombined,
+		Server: ServerConfig{
+			Addr: ":8080",
+		},
+		Storage: StorageConfig{
+			DBPath: "../db/content.db",
+		},
+		Worker: WorkerConfig{
+			PollInterval:      2 * time.Second,
+			WakeCheckInterval: 500 * time.Millisecond,
+			LeaseTimeout:      15 * time.Minute,
+		},
+		Generator: GeneratorConfig{
+			ModelDirs: []string{
+				"../python-worker/models",
+				"python-worker/models",
+				"./python-worker/models",
+				"models",
+			},
+			PromptTemplate:   "blog_prompt_templates.txt",
+			Timeout:          10 * time.Minute,
+			MaxTokens:        800,
+			CacheTTL:         24 * time.Hour,
+			CacheMaxEntries:  1000,
+			CacheMaxBytes:    50 << 20,
+			BreakerThreshold: 3,
+			BreakerCooldown:  time.Minute,
+			Pipelines:        builtinPipelines(),
+		},
+		Quality: QualityConfig{
+			MaxRetries:         1,
+			MinWordRatio:       0.7,
+			DuplicateThreshold: 0.8,
+			BannedPhrases: []string{
+				"as an ai language model",
+				"as an ai assistant",
+				"i cannot fulfill",
+				"lorem ipsum",
+				"[insert",
+				"[write the full article here]",
+			},
+		},
+		Auth: AuthConfig{
+			SessionLifetime:     24 * time.Hour,
+			RateLimitRPS:        5,
+			RateLimitBurst:      20,
+			LoginRateLimitRPS:   0.2,
+			LoginRateLimitBurst: 5,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			ServiceName: "ai-content-generator",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// configFlags are the flags every command accepts to override the config
+type configFlags struct {
+	fs         *flag.FlagSet
+	configPath *string
+	mode       *string
+	addr       *string
+	dbPath     *string
+	poll       *time.Duration
+	modelDirs  *string
+	backendURL *string
+	logLevel   *string
+}
+
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	return &configFlags{
+		fs:         fs,
+		configPath: fs.String("config", os.Getenv("ACG_CONFIG"), "path to a YAML config file"),
+		mode:       fs.String("mode", "", "run mode: combined, api or worker"),
+		addr:       fs.String("addr", "", "HTTP listen address"),
+		dbPath:     fs.String("db", "", "SQLite database path"),
+		poll:       fs.Duration("poll-interval", 0, "worker poll interval"),
+		modelDirs:  fs.String("model-dirs", "", "comma-separated model directories"),
+		backendURL: fs.String("backend-url", "", "default llama.cpp server URL"),
+		logLevel:   fs.String("log-level", "", "log level: debug, info, warn or error"),
+	}
+}
+
+// load builds the configuration once the flag set has been parsed
+func (f *configFlags) load() (*Config, error) {
+	c := defaultConfig()
+
+	if *f.configPath != "" {
+		data, err := os.ReadFile(*f.configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", *f.configPath, err)
+		}
+	}
+
+	if err := applyEnv(c); err != nil {
+		return nil, err
+	}
+
+	// Only flags given on the command line override the file and env
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "mode":
+			c.Mode = *f.mode
+		case "addr":
+			c.Server.Addr = *f.addr
+		case "db":
+			c.Storage.DBPath = *f.dbPath
+		case "poll-interval":
+			c.Worker.PollInterval = *f.poll
+		case "model-dirs":
+			c.Generator.ModelDirs = splitList(*f.modelDirs)
+		case "backend-url":
+			c.Generator.BackendURL = *f.backendURL
+		case "log-level":
+			c.Log.Level = *f.logLevel
+		}
+	})
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return c, nil
+}
+
+// parseCommandFlags parses a command's flags, which must already hold its
+// own flags, together with the config flags. Positional arguments are
+// rejected; commands that take them parse the flag set themselves.
+func parseCommandFlags(fs *flag.FlagSet, args []string) (*Config, error) {
+	cf := addConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return cf.load()
+}
+
+// parseInterspersed parses fs, allowing flags after positional arguments
+// ("jobs show 7 -db x.db"), and returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// applyEnv overrides c with any ACG_* variables that are set.
+func applyEnv(c *Config) error {
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = splitList(v)
+		}
+	}
+	var errs []string
+	duration := func(name string, dst *time.Duration) {
+		if v, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				return
+			}
+			*dst = d
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	float := func(name string, dst *float64) {
+		if v, ok := os.LookupEnv(name); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				return
+			}
+			*dst = f
+		}
+	}
+
+	str("ACG_MODE", &c.Mode)
+	str("ACG_SERVER_ADDR", &c.Server.Addr)
+	list("ACG_CORS_ALLOWED_ORIGINS", &c.Server.CORSAllowedOrigins)
+	str("ACG_METRICS_ADDR", &c.Server.MetricsAddr)
+	str("ACG_DB_PATH", &c.Storage.DBPath)
+	duration("ACG_WORKER_POLL_INTERVAL", &c.Worker.PollInterval)
+	duration("ACG_WORKER_WAKE_CHECK_INTERVAL", &c.Worker.WakeCheckInterval)
+	duration("ACG_WORKER_LEASE_TIMEOUT", &c.Worker.LeaseTimeout)
+	str("ACG_WORKER_ID", &c.Worker.ID)
+	list("ACG_MODEL_DIRS", &c.Generator.ModelDirs)
+	str("ACG_PROMPT_TEMPLATE", &c.Generator.PromptTemplate)
+	str("ACG_BACKEND_URL", &c.Generator.BackendURL)
+	duration("ACG_GENERATOR_TIMEOUT", &c.Generator.Timeout)
+	integer("ACG_MAX_TOKENS", &c.Generator.MaxTokens)
+	integer("ACG_CONTEXT_LENGTH", &c.Generator.ContextLength)
+	duration("ACG_CACHE_TTL", &c.Generator.CacheTTL)
+	integer("ACG_CACHE_MAX_ENTRIES", &c.Generator.CacheMaxEntries)
+	integer("ACG_CACHE_MAX_BYTES", &c.Generator.CacheMaxBytes)
+	if v, ok := os.LookupEnv("ACG_BACKEND_FALLBACKS"); ok {
+		c.Generator.Fallbacks = nil
+		for _, url := range splitList(v) {
+			c.Generator.Fallbacks = append(c.Generator.Fallbacks, FallbackConfig{URL: url})
+		}
+	}
+	integer("ACG_BREAKER_THRESHOLD", &c.Generator.BreakerThreshold)
+	duration("ACG_BREAKER_COOLDOWN", &c.Generator.BreakerCooldown)
+	integer("ACG_QUALITY_MAX_RETRIES", &c.Quality.MaxRetries)
+	float("ACG_QUALITY_MIN_WORD_RATIO", &c.Quality.MinWordRatio)
+	list("ACG_QUALITY_BANNED_PHRASES", &c.Quality.BannedPhrases)
+	float("ACG_QUALITY_DUPLICATE_THRESHOLD", &c.Quality.DuplicateThreshold)
+	duration("ACG_SESSION_LIFETIME", &c.Auth.SessionLifetime)
+	float("ACG_RATE_LIMIT_RPS", &c.Auth.RateLimitRPS)
+	integer("ACG_RATE_LIMIT_BURST", &c.Auth.RateLimitBurst)
+	float("ACG_LOGIN_RATE_LIMIT_RPS", &c.Auth.LoginRateLimitRPS)
+	integer("ACG_LOGIN_RATE_LIMIT_BURST", &c.Auth.LoginRateLimitBurst)
+	str("ACG_BOOTSTRAP_ADMIN_PASSWORD", &c.Auth.BootstrapAdminPassword)
+	str("ACG_LOG_LEVEL", &c.Log.Level)
+	str("ACG_LOG_FORMAT", &c.Log.Format)
+	str("ACG_OTLP_ENDPOINT", &c.Tracing.Endpoint)
+	str("ACG_TRACING_SERVICE_NAME", &c.Tracing.ServiceName)
+	float("ACG_TRACING_SAMPLE_RATIO", &c.Tracing.SampleRatio)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, msg string) {
+		if !ok {
+			problems = append(problems, msg)
+		}
+	}
+
+	check(c.Mode == ModeCombined || c.Mode == ModeAPI || c.Mode == ModeWorker, "mode must be combined, api or worker")
+	check(c.Server.Addr != "", "server.addr is required")
+	check(c.Storage.DBPath != "", "storage.db_path is required")
+	check(c.Worker.PollInterval > 0, "worker.poll_interval must be positive")
+	check(c.Worker.WakeCheckInterval > 0, "worker.wake_check_interval must be positive")
+	check(c.Worker.LeaseTimeout >= 3*time.Second, "worker.lease_timeout must be at least 3s")
+	check(c.Generator.Timeout > 0, "generator.timeout must be positive")
+	check(c.Generator.MaxTokens > 0, "generator.max_tokens must be positive")
+	check(c.Generator.ContextLength >= 0, "generator.context_length must not be negative")
+	check(c.Generator.CacheTTL >= 0, "generator.cache_ttl must not be negative")
+	check(c.Generator.CacheMaxEntries > 0, "generator.cache_max_entries must be positive")
+	check(c.Generator.CacheMaxBytes > 0, "generator.cache_max_bytes must be positive")
+	for i, f := range c.Generator.Fallbacks {
+		check(strings.HasPrefix(f.URL, "http://") || strings.HasPrefix(f.URL, "https://"),
+			fmt.Sprintf("generator.fallbacks[%d].url must be an http(s) URL", i))
+		check(f.Timeout >= 0, fmt.Sprintf("generator.fallbacks[%d].timeout must not be negative", i))
+	}
+	check(c.Generator.BreakerThreshold > 0, "generator.breaker_threshold must be positive")
+	check(c.Generator.BreakerCooldown > 0, "generator.breaker_cooldown must be positive")
+	for jobType, steps := range c.Generator.Pipelines {
+		if err := validatePipeline(steps); err != nil {
+			check(false, fmt.Sprintf("generator.pipelines.%s: %v", jobType, err))
+		}
+	}
+	check(c.Quality.MaxRetries >= 0, "quality.max_retries must not be negative")
+	check(c.Quality.MinWordRatio >= 0 && c.Quality.MinWordRatio <= 1, "quality.min_word_ratio must be between 0 and 1")
+	check(c.Quality.DuplicateThreshold >= 0 && c.Quality.DuplicateThreshold <= 1, "quality.duplicate_threshold must be between 0 and 1")
+	check(c.Auth.SessionLifetime > 0, "auth.session_lifetime must be positive")
+	check(c.Auth.RateLimitRPS > 0 && c.Auth.RateLimitBurst > 0, "auth.rate_limit_rps and auth.rate_limit_burst must be positive")
+	check(c.Auth.LoginRateLimitRPS > 0 && c.Auth.LoginRateLimitBurst > 0, "auth.login_rate_limit_rps and auth.login_rate_limit_burst must be positive")
+	check(c.Auth.BootstrapAdminPassword == "" || len(c.Auth.BootstrapAdminPassword) >= minPasswordLength,
+		fmt.Sprintf("auth.bootstrap_admin_password must be at least %d characters", minPasswordLength))
+	if _, err := newLogHandler(io.Discard, c.Log); err != nil {
+		check(false, "log: "+err.Error())
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	if c.Tracing.Endpoint != "" {
+		check(strings.HasPrefix(c.Tracing.Endpoint, "http://") || strings.HasPrefix(c.Tracing.Endpoint, "https://"),
+			"tracing.endpoint must be an http(s) URL")
+		check(c.Tracing.ServiceName != "", "tracing.service_name is required")
+	}
+	if c.Generator.BackendURL != "" {
+		check(strings.HasPrefix(c.Generator.BackendURL, "http://") || strings.HasPrefix(c.Generator.BackendURL, "https://"),
+			"generator.backend_url must be an http(s) URL")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+const redacted = "[REDACTED]"
+
+// Redacted returns a copy of c that is safe to print
+func (c *Config) Redacted() *Config {
+	copy := *c
+	if copy.Auth.BootstrapAdminPassword != "" {
+		copy.Auth.BootstrapAdminPassword = redacted
+	}
+	return &copy
+}
+
+func printConfig(w io.Writer, c *Config) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	return enc.Close()
+}
+
+// dbDir is the directory the database file lives in
+func (c *Config) dbDir() string {
+	return filepath.Dir(c.Storage.DBPath)
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -13,7 +16,7 @@ var db *sql.DB
 
 func initDB() error {
 	var err error
-	db, err = sql.Open("sqlite", "../db/content.db")
+	db, err = sql.Open("sqlite", sqliteDSN(cfg.Storage.DBPath))
 	if err != nil {
 		return fmt.Errorf("failed to open database: %v", err)
 	}
@@ -25,6 +28,16 @@ func initDB() error {
 	return createTables()
 }
 
+// sqliteDSN sets every connection up to share the database with other
+// processes: WAL lets readers and a writer run together, and the busy
+// timeout makes writers wait for each other instead of failing.
+func sqliteDSN(path string) string {
+	if strings.Contains(path, "?") {
+		return path
+	}
+	return path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
+
 func createTables() error {
 	query := `
 	CREATE TABLE IF NOT EXISTS jobs (
@@ -46,20 +59,362 @@ func createTables() error {
 		return fmt.Errorf("failed to create tables: %v", err)
 	}
 
-	log.Println("Database tables created successfully")
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to apply schema: %v", err)
+		}
+	}
+
+	// Columns added after the original schema are applied in place so
+	// existing databases keep working
+	for _, m := range columnMigrations {
+		if err := addColumnIfMissing(m.table, m.column, m.definition); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range indexStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	if err := backfillAnalysis(); err != nil {
+		return err
+	}
+	if err := backfillUsage(); err != nil {
+		return err
+	}
+
+	slog.Debug("database tables created")
 	return nil
 }
 
-func createJob(topic, jobType string) (*Job, error) {
-	query := `INSERT INTO jobs (topic, type, status, created_at, updated_at) VALUES (?, ?, 'pending', ?, ?)`
+var columnMigrations = []struct {
+	table, column, definition string
+}{
+	{"jobs", "priority", "INTEGER NOT NULL DEFAULT 0"},
+	{"jobs", "client_id", "TEXT NOT NULL DEFAULT ''"},
+	{"jobs", "api_key_id", "INTEGER"},
+	{"jobs", "user_id", "INTEGER"},
+	{"jobs", "workspace_id", "INTEGER NOT NULL DEFAULT 1"},
+	{"api_keys", "workspace_id", "INTEGER NOT NULL DEFAULT 1"},
+	{"users", "workspace_id", "INTEGER NOT NULL DEFAULT 1"},
+	{"jobs", "tokens_used", "INTEGER NOT NULL DEFAULT 0"},
+	{"workspaces", "daily_token_limit", "INTEGER NOT NULL DEFAULT 0"},
+	{"workspaces", "monthly_token_limit", "INTEGER NOT NULL DEFAULT 0"},
+	{"api_keys", "daily_job_limit", "INTEGER NOT NULL DEFAULT 0"},
+	{"api_keys", "monthly_job_limit", "INTEGER NOT NULL DEFAULT 0"},
+	{"api_keys", "daily_token_limit", "INTEGER NOT NULL DEFAULT 0"},
+	{"api_keys", "monthly_token_limit", "INTEGER NOT NULL DEFAULT 0"},
+	{"jobs", "claimed_by", "TEXT"},
+	{"jobs", "claimed_at", "DATETIME"},
+	{"jobs", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"jobs", "trace_parent", "TEXT NOT NULL DEFAULT ''"},
+	{"jobs", "model", "TEXT NOT NULL DEFAULT ''"},
+	{"jobs", "params", "TEXT NOT NULL DEFAULT '{}'"},
+	{"jobs", "source_job_id", "INTEGER"},
+	{"jobs", "output_language", "TEXT NOT NULL DEFAULT ''"},
+	{"jobs", "seo", "TEXT NOT NULL DEFAULT ''"},
+	{"jobs", "quality", "TEXT NOT NULL DEFAULT ''"},
+	{"jobs", "reading_ease", "REAL"},
+	{"jobs", "grade_level", "REAL"},
+	{"jobs", "avg_sentence_length", "REAL"},
+	{"jobs", "passive_ratio", "REAL"},
+	{"jobs", "lexical_diversity", "REAL"},
+	{"jobs", "fingerprint", "BLOB"},
+	{"jobs", "duplicate_of", "INTEGER"},
+	{"jobs", "similarity", "REAL"},
+	{"jobs", "dedupe_hash", "TEXT NOT NULL DEFAULT ''"},
+	{"jobs", "no_cache", "INTEGER NOT NULL DEFAULT 0"},
+	{"jobs", "backend", "TEXT NOT NULL DEFAULT ''"},
+	{"jobs", "backend_url", "TEXT NOT NULL DEFAULT ''"},
+	{"jobs", "token_budget", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// defaultWorkspaceID owns every row created before workspaces existed.
+// Its admins administer the whole instance.
+const defaultWorkspaceID = 1
+
+// schemaStatements create the tables that came after jobs
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS workspaces (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		slug TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		model_path TEXT NOT NULL DEFAULT '',
+		backend TEXT NOT NULL DEFAULT 'local',
+		backend_url TEXT NOT NULL DEFAULT '',
+		daily_job_limit INTEGER NOT NULL DEFAULT 0,
+		monthly_job_limit INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`INSERT OR IGNORE INTO workspaces (id, slug, name) VALUES (1, 'default', 'Default')`,
+	`CREATE TABLE IF NOT EXISTS prompt_templates (
+		workspace_id INTEGER NOT NULL REFERENCES workspaces(id),
+		type TEXT NOT NULL,
+		body TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (workspace_id, type)
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME,
+		revoked_at DATETIME
+	)`,
+	`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'writer',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		csrf_token TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS workers (
+		id TEXT PRIMARY KEY,
+		state TEXT NOT NULL,
+		job_id INTEGER,
+		started_at DATETIME NOT NULL,
+		last_seen_at DATETIME NOT NULL
+	)`,
+	// settings holds instance settings, shared by every workspace, so it
+	// has no workspace_id. Per-workspace choices are columns of workspaces;
+	// only instance admins may change a setting.
+	`CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		workspace_id INTEGER NOT NULL,
+		owner TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status_code INTEGER,
+		response TEXT,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (workspace_id, owner, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS generation_cache (
+		key TEXT PRIMARY KEY,
+		output TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		last_used_at DATETIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS usage_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		workspace_id INTEGER NOT NULL,
+		api_key_id INTEGER,
+		job_id INTEGER NOT NULL,
+		jobs INTEGER NOT NULL DEFAULT 0,
+		tokens INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS job_steps (
+		job_id INTEGER NOT NULL,
+		step INTEGER NOT NULL,
+		item INTEGER NOT NULL DEFAULT 0,
+		role TEXT NOT NULL,
+		status TEXT NOT NULL,
+		prompt TEXT NOT NULL DEFAULT '',
+		output TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		backend_url TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (job_id, step, item)
+	)`,
+	`CREATE TABLE IF NOT EXISTS worker_signals (
+		name TEXT PRIMARY KEY,
+		seq INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+}
+
+// indexStatements run once every migrated column exists
+var indexStatements = []string{
+	`CREATE INDEX IF NOT EXISTS idx_pending_schedule ON jobs(status, priority, client_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_jobs_user ON jobs(user_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_jobs_workspace ON jobs(workspace_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_jobs_api_key ON jobs(api_key_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_jobs_claims ON jobs(status, claimed_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_jobs_dedupe ON jobs(workspace_id, dedupe_hash)`,
+	`CREATE INDEX IF NOT EXISTS idx_generation_cache_used ON generation_cache(last_used_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_usage_workspace ON usage_events(workspace_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_usage_api_key ON usage_events(api_key_id, created_at)`,
+}
+
+func addColumnIfMissing(table, column, definition string) error {
+	exists, err := columnExists(table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %v", table, column, err)
+	}
+	slog.Info("added column", "table", table, "column", column)
+	return nil
+}
+
+func columnExists(table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect table %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, fmt.Errorf("failed to scan table info for %s: %v", table, err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("failed to read table info for %s: %v", table, err)
+	}
+	return false, nil
+}
+
+// pendingMigrations lists the migrated columns missing from the database,
+// as table.column
+func pendingMigrations() ([]string, error) {
+	var missing []string
+	for _, m := range columnMigrations {
+		exists, err := columnExists(m.table, m.column)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, m.table+"."+m.column)
+		}
+	}
+	return missing, nil
+}
+
+// jobColumns is the column list scanJob expects, in order.
+const jobColumns = `id, workspace_id, topic, COALESCE(type, 'blog'), status, output, priority, client_id, api_key_id, user_id, tokens_used, COALESCE(claimed_by, ''), attempts, trace_parent, model, params, source_job_id, output_language, seo, quality, reading_ease, grade_level, avg_sentence_length, passive_ratio, lexical_diversity, duplicate_of, similarity, no_cache, backend, backend_url, token_budget, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row rowScanner) (*Job, error) {
+	var job Job
+	var apiKeyID, userID, sourceJobID, duplicateOf sql.NullInt64
+	var params, seo, quality, budget string
+	var ease, grade, sentenceLength, passive, diversity, similarity sql.NullFloat64
+	err := row.Scan(&job.ID, &job.WorkspaceID, &job.Topic, &job.Type, &job.Status, &job.Output, &job.Priority, &job.ClientID, &apiKeyID, &userID, &job.TokensUsed, &job.ClaimedBy, &job.Attempts, &job.TraceParent, &job.Model, &params, &sourceJobID, &job.OutputLanguage, &seo, &quality, &ease, &grade, &sentenceLength, &passive, &diversity, &duplicateOf, &similarity, &job.NoCache, &job.Backend, &job.BackendURL, &budget, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(params), &job.Params); err != nil {
+		return nil, fmt.Errorf("invalid params on job %d: %v", job.ID, err)
+	}
+	if seo != "" {
+		if err := json.Unmarshal([]byte(seo), &job.SEO); err != nil {
+			return nil, fmt.Errorf("invalid seo on job %d: %v", job.ID, err)
+		}
+	}
+	if quality != "" {
+		if err := json.Unmarshal([]byte(quality), &job.Quality); err != nil {
+			return nil, fmt.Errorf("invalid quality report on job %d: %v", job.ID, err)
+		}
+	}
+	if budget != "" {
+		if err := json.Unmarshal([]byte(budget), &job.Budget); err != nil {
+			return nil, fmt.Errorf("invalid token budget on job %d: %v", job.ID, err)
+		}
+	}
+	if ease.Valid {
+		job.Readability = &Readability{
+			ReadingEase:       ease.Float64,
+			GradeLevel:        grade.Float64,
+			AvgSentenceLength: sentenceLength.Float64,
+			PassiveRatio:      passive.Float64,
+			LexicalDiversity:  diversity.Float64,
+		}
+	}
+	job.APIKeyID = nullIntPtr(apiKeyID)
+	job.UserID = nullIntPtr(userID)
+	job.SourceJobID = nullIntPtr(sourceJobID)
+	job.DuplicateOf = nullIntPtr(duplicateOf)
+	if similarity.Valid {
+		job.Similarity = &similarity.Float64
+	}
+	return &job, nil
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+// JobOwner records which workspace a job belongs to and who queued it: an
+// API key, a dashboard user, or neither.
+type JobOwner struct {
+	WorkspaceID int
+	APIKeyID    *int
+	UserID      *int
+}
+
+// createJob queues a job and meters it. check, when set, runs in the same
+// transaction after the job is counted, so concurrent requests cannot both
+// pass a quota; an error from it undoes the job.
+func createJob(ctx context.Context, req CreateJobRequest, clientID string, owner JobOwner, check func(q rowQuerier) error) (*Job, error) {
+	query := `INSERT INTO jobs (workspace_id, topic, type, status, priority, client_id, api_key_id, user_id, trace_parent, model, params, source_job_id, dedupe_hash, no_cache, created_at, updated_at) VALUES (?, ?, ?, 'pending', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	now := time.Now()
 	
+	jobType := req.Type
 	if jobType == "" {
 		jobType = "blog"
 	}
 	
-	result, err := db.Exec(query, topic, jobType, now, now)
+	params, err := json.Marshal(req.Params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode params: %v", err)
+	}
+
+	// The worker links its spans to the trace that created the job
+	parent := traceParent(ctx)
+
+	ctx, span := startDBSpan(ctx, "createJob", query)
+	defer span.End()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
+		recordDBError(span, err)
+		return nil, fmt.Errorf("failed to create job: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, owner.WorkspaceID, req.Topic, jobType, req.Priority, clientID, owner.APIKeyID, owner.UserID, parent, req.Model, string(params), req.SourceJobID, dedupeHash(req), req.NoCache, now, now)
+	if err != nil {
+		recordDBError(span, err)
 		return nil, fmt.Errorf("failed to create job: %v", err)
 	}
 
@@ -67,26 +422,80 @@ func createJob(topic, jobType string) (*Job, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get job ID: %v", err)
 	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO usage_events (workspace_id, api_key_id, job_id, jobs, created_at) VALUES (?, ?, ?, 1, ?)`,
+		owner.WorkspaceID, owner.APIKeyID, id, now)
+	if err != nil {
+		recordDBError(span, err)
+		return nil, fmt.Errorf("failed to record usage: %v", err)
+	}
+	if check != nil {
+		if err := check(tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		recordDBError(span, err)
+		return nil, fmt.Errorf("failed to create job: %v", err)
+	}
 
 	return &Job{
-		ID:        int(id),
-		Topic:     topic,
-		Type:      jobType,
-		Status:    "pending",
-		Output:    "",
-		CreatedAt: now,
-		UpdatedAt: now,
+		ID:          int(id),
+		WorkspaceID: owner.WorkspaceID,
+		Topic:       req.Topic,
+		Type:        jobType,
+		Status:      "pending",
+		Output:      "",
+		Priority:    req.Priority,
+		ClientID:    clientID,
+		APIKeyID:    owner.APIKeyID,
+		UserID:      owner.UserID,
+		TraceParent: parent,
+		Model:       req.Model,
+		Params:      req.Params,
+		SourceJobID: req.SourceJobID,
+		NoCache:     req.NoCache,
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}, nil
 }
 
-func getJobs() ([]Job, error) {
+func getJobs(ctx context.Context, filter JobFilter) ([]Job, error) {
 	if db == nil {
 		return nil, fmt.Errorf("database not initialized")
 	}
 	
-	query := `SELECT id, topic, COALESCE(type, 'blog'), status, output, created_at, updated_at FROM jobs ORDER BY created_at DESC`
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE workspace_id = ?`
+	args := []interface{}{filter.WorkspaceID}
+	if filter.UserID != nil {
+		query += ` AND user_id = ?`
+		args = append(args, *filter.UserID)
+	}
+	if filter.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, filter.Status)
+	}
+	if filter.SourceJobID != nil {
+		query += ` AND source_job_id = ?`
+		args = append(args, *filter.SourceJobID)
+	}
+	// Metric names come from readabilityMetrics, never from the caller
+	for _, metric := range readabilityMetrics {
+		r, ok := filter.Readability[metric]
+		if !ok {
+			continue
+		}
+		if r.Min != nil {
+			query += ` AND ` + metric + ` >= ?`
+			args = append(args, *r.Min)
+		}
+		if r.Max != nil {
+			query += ` AND ` + metric + ` <= ?`
+			args = append(args, *r.Max)
+		}
+	}
+	query += ` ORDER BY created_at DESC`
 	
-	rows, err := db.Query(query)
+	rows, err := dbQuery(ctx, "getJobs", query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query jobs: %v", err)
 	}
@@ -94,22 +503,41 @@ func getJobs() ([]Job, error) {
 
 	var jobs []Job
 	for rows.Next() {
-		var job Job
-		err := rows.Scan(&job.ID, &job.Topic, &job.Type, &job.Status, &job.Output, &job.CreatedAt, &job.UpdatedAt)
+		job, err := scanJob(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan job: %v", err)
 		}
-		jobs = append(jobs, job)
+		jobs = append(jobs, *job)
 	}
 
 	return jobs, nil
 }
 
-func getJobByID(id int) (*Job, error) {
-	query := `SELECT id, topic, COALESCE(type, 'blog'), status, output, created_at, updated_at FROM jobs WHERE id = ?`
+// findDedupeJob returns the latest job filter matches with the given dedupe
+// hash that has not failed, or nil if there is none
+func findDedupeJob(ctx context.Context, filter JobFilter, hash string) (*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE workspace_id = ? AND dedupe_hash = ? AND status != 'failed'`
+	args := []interface{}{filter.WorkspaceID, hash}
+	if filter.UserID != nil {
+		query += ` AND user_id = ?`
+		args = append(args, *filter.UserID)
+	}
+	query += ` ORDER BY created_at DESC LIMIT 1`
+
+	job, err := scanJob(dbQueryRow(ctx, "findDedupeJob", query, args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find duplicate job: %v", err)
+	}
+	return job, nil
+}
+
+func getJobByID(ctx context.Context, workspaceID, id int) (*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = ? AND workspace_id = ?`
 	
-	var job Job
-	err := db.QueryRow(query, id).Scan(&job.ID, &job.Topic, &job.Type, &job.Status, &job.Output, &job.CreatedAt, &job.UpdatedAt)
+	job, err := scanJob(dbQueryRow(ctx, "getJobByID", query, id, workspaceID))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, fmt.Errorf("job not found")
@@ -117,13 +545,13 @@ func getJobByID(id int) (*Job, error) {
 		return nil, fmt.Errorf("failed to get job: %v", err)
 	}
 
-	return &job, nil
+	return job, nil
 }
 
-func deleteJob(id int) error {
-	query := `DELETE FROM jobs WHERE id = ?`
+func deleteJob(ctx context.Context, workspaceID, id int) error {
+	query := `DELETE FROM jobs WHERE id = ? AND workspace_id = ?`
 	
-	result, err := db.Exec(query, id)
+	result, err := dbExec(ctx, "deleteJob", query, id, workspaceID)
 	if err != nil {
 		return fmt.Errorf("failed to delete job: %v", err)
 	}
@@ -137,13 +565,13 @@ func deleteJob(id int) error {
 		return fmt.Errorf("job not found")
 	}
 
-	return nil
+	return deleteJobSteps(ctx, id)
 }
 
-func updateJobStatus(jobID int, status, output string) error {
-	query := `UPDATE jobs SET status = ?, output = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+func updateJobStatus(ctx context.Context, workspaceID, jobID int, status, output string) error {
+	query := `UPDATE jobs SET status = ?, output = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND workspace_id = ?`
 	
-	result, err := db.Exec(query, status, output, jobID)
+	result, err := dbExec(ctx, "updateJobStatus", query, status, output, jobID, workspaceID)
 	if err != nil {
 		return fmt.Errorf("failed to update job: %v", err)
 	}
@@ -159,3 +587,332 @@ func updateJobStatus(jobID int, status, output string) error {
 
 	return nil
 }
+
+// recordTokenUsage meters the tokens a generation produced. Usage is only
+// ever added, so retrying or deleting a job gives nothing back.
+func recordTokenUsage(ctx context.Context, job *Job, tokens int) error {
+	_, err := dbExec(ctx, "recordTokenUsage", `INSERT INTO usage_events (workspace_id, api_key_id, job_id, tokens, created_at) VALUES (?, ?, ?, ?, ?)`,
+		job.WorkspaceID, job.APIKeyID, job.ID, tokens, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record usage: %v", err)
+	}
+	return nil
+}
+
+// backfillUsage meters the jobs of a database from before usage_events
+// existed
+func backfillUsage() error {
+	_, err := db.Exec(`INSERT INTO usage_events (workspace_id, api_key_id, job_id, jobs, tokens, created_at)
+		SELECT workspace_id, api_key_id, id, 1, tokens_used, created_at FROM jobs
+		WHERE NOT EXISTS (SELECT 1 FROM usage_events)`)
+	if err != nil {
+		return fmt.Errorf("failed to backfill usage: %v", err)
+	}
+	return nil
+}
+
+func updateJobTokens(ctx context.Context, workspaceID, jobID, tokens int) error {
+	_, err := dbExec(ctx, "updateJobTokens", `UPDATE jobs SET tokens_used = ? WHERE id = ? AND workspace_id = ?`, tokens, jobID, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to record tokens used: %v", err)
+	}
+	return nil
+}
+
+func updateJobLanguage(ctx context.Context, workspaceID, jobID int, language string) error {
+	_, err := dbExec(ctx, "updateJobLanguage", `UPDATE jobs SET output_language = ? WHERE id = ? AND workspace_id = ?`, language, jobID, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to record output language: %v", err)
+	}
+	return nil
+}
+
+// updateJobBackend records which backend produced a job's output
+func updateJobBackend(ctx context.Context, workspaceID, jobID int, backend, url string) error {
+	_, err := dbExec(ctx, "updateJobBackend", `UPDATE jobs SET backend = ?, backend_url = ? WHERE id = ? AND workspace_id = ?`, backend, url, jobID, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to record backend: %v", err)
+	}
+	return nil
+}
+
+func updateJobBudget(ctx context.Context, workspaceID, jobID int, budget *TokenBudget) error {
+	data, err := json.Marshal(budget)
+	if err != nil {
+		return fmt.Errorf("failed to encode token budget: %v", err)
+	}
+	_, err = dbExec(ctx, "updateJobBudget", `UPDATE jobs SET token_budget = ? WHERE id = ? AND workspace_id = ?`, string(data), jobID, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to record token budget: %v", err)
+	}
+	return nil
+}
+
+// jobSteps lists the stored pipeline steps of a job, in order
+func jobSteps(ctx context.Context, jobID int) ([]JobStep, error) {
+	rows, err := dbQuery(ctx, "jobSteps", `SELECT step, item, role, status, prompt, output, error, backend_url, attempts, updated_at
+		FROM job_steps WHERE job_id = ? ORDER BY step, item`, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list job steps: %v", err)
+	}
+	defer rows.Close()
+
+	var steps []JobStep
+	for rows.Next() {
+		var s JobStep
+		if err := rows.Scan(&s.Step, &s.Item, &s.Role, &s.Status, &s.Prompt, &s.Output, &s.Error, &s.BackendURL, &s.Attempts, &s.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan job step: %v", err)
+		}
+		steps = append(steps, s)
+	}
+	return steps, rows.Err()
+}
+
+// saveJobStep stores a pipeline step's state, replacing the one before
+func saveJobStep(ctx context.Context, jobID int, s JobStep) error {
+	_, err := dbExec(ctx, "saveJobStep", `INSERT INTO job_steps (job_id, step, item, role, status, prompt, output, error, backend_url, attempts, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(job_id, step, item) DO UPDATE SET role = excluded.role, status = excluded.status, prompt = excluded.prompt,
+			output = excluded.output, error = excluded.error, backend_url = excluded.backend_url, attempts = excluded.attempts, updated_at = excluded.updated_at`,
+		jobID, s.Step, s.Item, s.Role, s.Status, s.Prompt, s.Output, s.Error, s.BackendURL, s.Attempts, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to save job step: %v", err)
+	}
+	return nil
+}
+
+// deleteJobSteps drops a job's pipeline steps, so it next runs from the start
+func deleteJobSteps(ctx context.Context, jobID int) error {
+	if _, err := dbExec(ctx, "deleteJobSteps", `DELETE FROM job_steps WHERE job_id = ?`, jobID); err != nil {
+		return fmt.Errorf("failed to delete job steps: %v", err)
+	}
+	return nil
+}
+
+func updateJobSEO(ctx context.Context, workspaceID, jobID int, report *SEOReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode seo: %v", err)
+	}
+	_, err = dbExec(ctx, "updateJobSEO", `UPDATE jobs SET seo = ? WHERE id = ? AND workspace_id = ?`, string(data), jobID, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to record seo: %v", err)
+	}
+	return nil
+}
+
+func updateJobReadability(ctx context.Context, workspaceID, jobID int, r *Readability) error {
+	_, err := dbExec(ctx, "updateJobReadability", `UPDATE jobs SET reading_ease = ?, grade_level = ?, avg_sentence_length = ?, passive_ratio = ?, lexical_diversity = ? WHERE id = ? AND workspace_id = ?`,
+		r.ReadingEase, r.GradeLevel, r.AvgSentenceLength, r.PassiveRatio, r.LexicalDiversity, jobID, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to record readability: %v", err)
+	}
+	return nil
+}
+
+// updateJobFingerprint records a job's fingerprint and the archived job it
+// is closest to, with duplicateOf set when that one is a near-duplicate
+func updateJobFingerprint(ctx context.Context, workspaceID, jobID int, fp []byte, closest *SimilarJob, duplicateOf *int) error {
+	var similarity *float64
+	if closest != nil {
+		similarity = &closest.Similarity
+	}
+	_, err := dbExec(ctx, "updateJobFingerprint", `UPDATE jobs SET fingerprint = ?, similarity = ?, duplicate_of = ? WHERE id = ? AND workspace_id = ?`,
+		fp, similarity, duplicateOf, jobID, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to record fingerprint: %v", err)
+	}
+	return nil
+}
+
+// archivedFingerprint is a fingerprinted job similar ones are looked for in
+type archivedFingerprint struct {
+	ID          int
+	Topic       string
+	Status      string
+	CreatedAt   time.Time
+	Fingerprint []byte
+}
+
+// jobFingerprints loads the finished, fingerprinted jobs filter matches,
+// other than the job with excludeID
+func jobFingerprints(ctx context.Context, filter JobFilter, excludeID int) ([]archivedFingerprint, error) {
+	query := `SELECT id, topic, status, created_at, fingerprint FROM jobs WHERE workspace_id = ? AND id != ? AND status IN ('completed', ?) AND fingerprint IS NOT NULL`
+	args := []interface{}{filter.WorkspaceID, excludeID, StatusNeedsReview}
+	if filter.UserID != nil {
+		query += ` AND user_id = ?`
+		args = append(args, *filter.UserID)
+	}
+	rows, err := dbQuery(ctx, "jobFingerprints", query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fingerprints: %v", err)
+	}
+	defer rows.Close()
+
+	var archive []archivedFingerprint
+	for rows.Next() {
+		var a archivedFingerprint
+		if err := rows.Scan(&a.ID, &a.Topic, &a.Status, &a.CreatedAt, &a.Fingerprint); err != nil {
+			return nil, fmt.Errorf("failed to scan fingerprint: %v", err)
+		}
+		archive = append(archive, a)
+	}
+	return archive, rows.Err()
+}
+
+func getJobFingerprint(ctx context.Context, workspaceID, id int) ([]byte, error) {
+	var fp []byte
+	err := dbQueryRow(ctx, "getJobFingerprint", `SELECT fingerprint FROM jobs WHERE id = ? AND workspace_id = ?`, id, workspaceID).Scan(&fp)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("job not found")
+		}
+		return nil, fmt.Errorf("failed to get fingerprint: %v", err)
+	}
+	return fp, nil
+}
+
+func updateJobQuality(ctx context.Context, workspaceID, jobID int, report *QualityReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode quality report: %v", err)
+	}
+	_, err = dbExec(ctx, "updateJobQuality", `UPDATE jobs SET quality = ? WHERE id = ? AND workspace_id = ?`, string(data), jobID, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to record quality report: %v", err)
+	}
+	return nil
+}
+
+// backfillAnalysis analyzes finished jobs that have output but no
+// readability figures or fingerprint, such as those completed before they
+// were recorded
+func backfillAnalysis() error {
+	rows, err := db.Query(`SELECT id, workspace_id, output FROM jobs WHERE status IN ('completed', ?) AND output != '' AND (reading_ease IS NULL OR fingerprint IS NULL)`, StatusNeedsReview)
+	if err != nil {
+		return fmt.Errorf("failed to find jobs to analyze: %v", err)
+	}
+	type pending struct {
+		id, workspaceID int
+		output          string
+	}
+	var jobs []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.workspaceID, &p.output); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan job: %v", err)
+		}
+		jobs = append(jobs, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to find jobs to analyze: %v", err)
+	}
+
+	ctx := context.Background()
+	for _, p := range jobs {
+		r := analyzeText(articleBody(p.output)).readability()
+		if err := updateJobReadability(ctx, p.workspaceID, p.id, r); err != nil {
+			return err
+		}
+		if _, err := dbExec(ctx, "backfillFingerprint", `UPDATE jobs SET fingerprint = ? WHERE id = ?`, fingerprint(p.output), p.id); err != nil {
+			return fmt.Errorf("failed to record fingerprint: %v", err)
+		}
+	}
+	if len(jobs) > 0 {
+		slog.Info("analyzed earlier jobs", "jobs", len(jobs))
+	}
+	return nil
+}
+
+// retryJob puts a finished job back in the queue with its output cleared.
+// A job whose pipeline stopped at a failed step keeps its steps, resuming
+// at that one; others start over.
+func retryJob(ctx context.Context, workspaceID, id int) error {
+	_, err := dbExec(ctx, "retryJob", `DELETE FROM job_steps WHERE job_id IN (SELECT id FROM jobs WHERE id = ? AND workspace_id = ? AND status IN ('completed', 'failed', 'needs_review'))
+		AND NOT EXISTS (SELECT 1 FROM job_steps WHERE job_id = ? AND status = ?)`, id, workspaceID, id, StepFailed)
+	if err != nil {
+		return fmt.Errorf("failed to retry job: %v", err)
+	}
+
+	query := `UPDATE jobs SET status = 'pending', output = '', output_language = '', backend = '', backend_url = '', token_budget = '', seo = '', quality = '', reading_ease = NULL, grade_level = NULL, avg_sentence_length = NULL, passive_ratio = NULL, lexical_diversity = NULL, fingerprint = NULL, duplicate_of = NULL, similarity = NULL, tokens_used = 0, claimed_by = NULL, claimed_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND workspace_id = ? AND status IN ('completed', 'failed', 'needs_review')`
+	
+	result, err := dbExec(ctx, "retryJob", query, id, workspaceID)
+	if err != nil {
+		return fmt.Errorf("failed to retry job: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("job not found or not finished")
+	}
+
+	return nil
+}
+
+// approveJob accepts the output of a job flagged needs_review as it is.
+func approveJob(ctx context.Context, workspaceID, id int) error {
+	result, err := dbExec(ctx, "approveJob", `UPDATE jobs SET status = 'completed', updated_at = CURRENT_TIMESTAMP WHERE id = ? AND workspace_id = ? AND status = ?`,
+		id, workspaceID, StatusNeedsReview)
+	if err != nil {
+		return fmt.Errorf("failed to approve job: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("job not found or not awaiting review")
+	}
+	return nil
+}
+
+// jobCountsByStatus counts jobs in every workspace. Statuses with no jobs
+// are included with a count of zero.
+func jobCountsByStatus(ctx context.Context) (map[string]int, error) {
+	rows, err := dbQuery(ctx, "jobCountsByStatus", `SELECT status, COUNT(*) FROM jobs GROUP BY status`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count jobs: %v", err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{"pending": 0, "processing": 0, "completed": 0, "failed": 0, StatusNeedsReview: 0}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, fmt.Errorf("failed to scan job count: %v", err)
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// getSetting returns an instance setting, or "" when it was never set.
+// Settings apply to every workspace; a workspace overrides them with its
+// own columns, like model_path for the default model.
+func getSetting(ctx context.Context, key string) (string, error) {
+	var value string
+	err := dbQueryRow(ctx, "getSetting", `SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to get setting %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// setSetting changes an instance setting. Callers reached over HTTP must
+// be behind requireInstanceAdmin, since the change affects every tenant.
+func setSetting(ctx context.Context, key, value string) error {
+	_, err := dbExec(ctx, "setSetting", `INSERT INTO settings (key, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to save setting %s: %v", key, err)
+	}
+	return nil
+}
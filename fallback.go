@@ -0,0 +1,464 @@
+package main
+
+import "strings"
+
+// Built-in articles for the local backend, by language. {{topic}} and
+// {{model}} are filled in; languages without their own templates get
+// English.
+
+type fallbackTemplates struct {
+	// enhanced is used when a local model is available, basic otherwise
+	enhanced, basic string
+}
+
+var localizedFallbacks = map[string]fallbackTemplates{
+	"en": {
+		enhanced: `## OUTLINE
+- Introduction to {{topic}}
+- Core concepts and fundamentals
+- Practical applications and use cases
+- Benefits and advantages
+- Implementation strategies
+- Future outlook and trends
+- Conclusion and key takeaways
+
+## ARTICLE
+
+# Understanding {{topic}}: A Comprehensive Guide
+
+{{topic}} represents a significant area of interest in today's rapidly evolving landscape. This comprehensive guide explores the essential aspects, practical applications, and future implications of {{topic}}.
+
+## Core Concepts and Fundamentals
+
+At its foundation, {{topic}} encompasses several key principles that form the backbone of understanding. These fundamental concepts provide the necessary framework for deeper exploration and practical application.
+
+The primary elements include:
+- Theoretical foundations and underlying principles
+- Historical context and evolution
+- Current state and recent developments
+- Key terminology and definitions
+
+## Practical Applications and Use Cases
+
+{{topic}} finds application across numerous domains and industries. Real-world implementations demonstrate its versatility and effectiveness in solving complex challenges.
+
+Common applications include:
+- Industry-specific solutions and implementations
+- Cross-functional integration opportunities
+- Scalable deployment strategies
+- Performance optimization techniques
+
+## Benefits and Advantages
+
+The adoption of {{topic}} brings numerous advantages:
+
+**Efficiency Improvements**: Streamlined processes and reduced complexity lead to significant efficiency gains.
+
+**Cost Effectiveness**: Strategic implementation often results in substantial cost savings and resource optimization.
+
+**Scalability**: Solutions built around {{topic}} principles typically offer excellent scalability characteristics.
+
+**Innovation Potential**: Opens new avenues for creative problem-solving and innovative approaches.
+
+## Implementation Strategies
+
+Successful implementation requires careful planning and strategic approach:
+
+1. **Assessment Phase**: Evaluate current state and identify opportunities
+2. **Planning Phase**: Develop comprehensive implementation roadmap
+3. **Execution Phase**: Deploy solutions with proper monitoring
+4. **Optimization Phase**: Continuous improvement and refinement
+
+## Future Outlook and Trends
+
+The future of {{topic}} looks promising with several emerging trends:
+- Technological advancements driving new possibilities
+- Increased adoption across various sectors
+- Integration with complementary technologies
+- Evolution of best practices and methodologies
+
+## Conclusion and Key Takeaways
+
+{{topic}} represents a valuable domain with significant potential for impact and growth. Understanding its core principles, applications, and implementation strategies is crucial for leveraging its full potential.
+
+Key takeaways include:
+- Comprehensive understanding enables better decision-making
+- Practical application requires strategic planning
+- Continuous learning and adaptation are essential
+- Future opportunities are abundant for early adopters
+
+*Generated using enhanced content generation with local model: {{model}}*`,
+		basic: `## OUTLINE
+- Introduction to {{topic}}
+- Key aspects and importance
+- Practical applications
+- Benefits and considerations
+- Conclusion and next steps
+
+## ARTICLE
+
+# Understanding {{topic}}
+
+{{topic}} is an important subject that deserves our attention and understanding. In today's rapidly evolving world, having knowledge about {{topic}} can provide significant advantages and insights.
+
+## Key Aspects
+
+When exploring {{topic}}, several key aspects emerge that are worth considering. These elements form the foundation of our understanding and help us appreciate the complexity and nuance involved.
+
+## Practical Applications
+
+The practical applications of {{topic}} are numerous and varied. From everyday situations to professional environments, the principles and concepts related to {{topic}} can be applied in meaningful ways.
+
+## Benefits and Considerations
+
+Understanding {{topic}} brings several benefits, including improved decision-making, better problem-solving capabilities, and enhanced perspective on related matters. However, it's also important to consider potential challenges and limitations.
+
+## Conclusion
+
+In conclusion, {{topic}} represents a valuable area of knowledge that can enrich our understanding and provide practical benefits. By continuing to explore and learn about {{topic}}, we can develop a more comprehensive and nuanced perspective.
+
+*Generated using fallback content generation*`,
+	},
+	"es": {
+		enhanced: `## ESQUEMA
+- Introducción a {{topic}}
+- Conceptos clave y fundamentos
+- Aplicaciones prácticas y casos de uso
+- Beneficios y ventajas
+- Estrategias de implementación
+- Perspectivas y tendencias futuras
+- Conclusión y puntos clave
+
+## ARTÍCULO
+
+# Comprender {{topic}}: una guía completa
+
+{{topic}} es un área de gran interés en el panorama actual, que evoluciona con rapidez. Esta guía recorre los aspectos esenciales, las aplicaciones prácticas y las implicaciones futuras de {{topic}}.
+
+## Conceptos clave y fundamentos
+
+En su base, {{topic}} reúne varios principios que forman el núcleo de su comprensión. Estos conceptos proporcionan el marco necesario para una exploración más profunda y para su aplicación práctica.
+
+Los elementos principales son:
+- Fundamentos teóricos y principios subyacentes
+- Contexto histórico y evolución
+- Situación actual y novedades recientes
+- Terminología y definiciones clave
+
+## Aplicaciones prácticas y casos de uso
+
+{{topic}} se aplica en numerosos sectores y dominios. Las implementaciones reales demuestran su versatilidad y su eficacia para resolver problemas complejos.
+
+Entre las aplicaciones más comunes están:
+- Soluciones específicas para cada sector
+- Oportunidades de integración entre equipos
+- Estrategias de despliegue escalables
+- Técnicas de optimización del rendimiento
+
+## Beneficios y ventajas
+
+La adopción de {{topic}} aporta numerosas ventajas:
+
+**Mayor eficiencia**: los procesos más simples y la menor complejidad se traducen en mejoras notables.
+
+**Ahorro de costes**: una implementación bien planificada suele reducir costes y optimizar los recursos.
+
+**Escalabilidad**: las soluciones basadas en los principios de {{topic}} suelen escalar muy bien.
+
+**Potencial de innovación**: abre nuevas vías para resolver problemas de forma creativa.
+
+## Estrategias de implementación
+
+Una implementación con éxito requiere planificación y un enfoque estratégico:
+
+1. **Evaluación**: analizar la situación actual e identificar oportunidades
+2. **Planificación**: elaborar una hoja de ruta completa
+3. **Ejecución**: desplegar las soluciones con un seguimiento adecuado
+4. **Optimización**: mejorar y ajustar de forma continua
+
+## Perspectivas y tendencias futuras
+
+El futuro de {{topic}} es prometedor, con varias tendencias emergentes:
+- Avances tecnológicos que abren nuevas posibilidades
+- Mayor adopción en distintos sectores
+- Integración con tecnologías complementarias
+- Evolución de las buenas prácticas y metodologías
+
+## Conclusión y puntos clave
+
+{{topic}} es un campo valioso con un gran potencial de impacto y crecimiento. Comprender sus principios, aplicaciones y estrategias de implementación es fundamental para aprovecharlo al máximo.
+
+Puntos clave:
+- Una comprensión completa permite tomar mejores decisiones
+- La aplicación práctica requiere planificación estratégica
+- El aprendizaje y la adaptación continuos son esenciales
+- Las oportunidades futuras son abundantes para quienes se adelanten
+
+*Generado con generación de contenido mejorada y el modelo local: {{model}}*`,
+		basic: `## ESQUEMA
+- Introducción a {{topic}}
+- Aspectos clave e importancia
+- Aplicaciones prácticas
+- Beneficios y consideraciones
+- Conclusión y próximos pasos
+
+## ARTÍCULO
+
+# Comprender {{topic}}
+
+{{topic}} es un tema importante que merece nuestra atención. En un mundo que cambia con rapidez, conocer {{topic}} puede aportar ventajas y perspectivas valiosas.
+
+## Aspectos clave
+
+Al explorar {{topic}} surgen varios aspectos que vale la pena considerar. Estos elementos son la base de nuestra comprensión y nos ayudan a apreciar su complejidad y sus matices.
+
+## Aplicaciones prácticas
+
+Las aplicaciones prácticas de {{topic}} son numerosas y variadas. Desde situaciones cotidianas hasta entornos profesionales, los principios relacionados con {{topic}} se pueden aplicar de forma útil.
+
+## Beneficios y consideraciones
+
+Comprender {{topic}} aporta beneficios como mejores decisiones, más capacidad para resolver problemas y una perspectiva más amplia. Sin embargo, también es importante tener en cuenta sus posibles retos y limitaciones.
+
+## Conclusión
+
+En conclusión, {{topic}} es un área de conocimiento valiosa que enriquece nuestra comprensión y ofrece beneficios prácticos. Si seguimos explorando y aprendiendo sobre {{topic}}, podremos desarrollar una perspectiva más completa y matizada.
+
+*Generado con la generación de contenido de respaldo*`,
+	},
+	"fr": {
+		enhanced: `## PLAN
+- Introduction à {{topic}}
+- Concepts clés et fondamentaux
+- Applications pratiques et cas d'usage
+- Avantages et bénéfices
+- Stratégies de mise en œuvre
+- Perspectives et tendances
+- Conclusion et points à retenir
+
+## ARTICLE
+
+# Comprendre {{topic}} : un guide complet
+
+{{topic}} est un domaine d'intérêt majeur dans un paysage qui évolue rapidement. Ce guide présente les aspects essentiels, les applications pratiques et les implications futures de {{topic}}.
+
+## Concepts clés et fondamentaux
+
+À la base, {{topic}} repose sur plusieurs principes qui forment le cœur de sa compréhension. Ces concepts fournissent le cadre nécessaire pour aller plus loin et pour passer à la pratique.
+
+Les éléments principaux sont :
+- Les fondements théoriques et les principes sous-jacents
+- Le contexte historique et son évolution
+- La situation actuelle et les développements récents
+- La terminologie et les définitions clés
+
+## Applications pratiques et cas d'usage
+
+{{topic}} trouve des applications dans de nombreux secteurs. Les mises en œuvre concrètes montrent sa polyvalence et son efficacité face à des problèmes complexes.
+
+Parmi les applications courantes :
+- Des solutions propres à chaque secteur
+- Des possibilités d'intégration entre les équipes
+- Des stratégies de déploiement évolutives
+- Des techniques d'optimisation des performances
+
+## Avantages et bénéfices
+
+L'adoption de {{topic}} apporte de nombreux avantages :
+
+**Efficacité** : des processus simplifiés et une complexité réduite permettent des gains importants.
+
+**Maîtrise des coûts** : une mise en œuvre réfléchie réduit souvent les coûts et optimise les ressources.
+
+**Évolutivité** : les solutions fondées sur les principes de {{topic}} passent généralement bien à l'échelle.
+
+**Innovation** : de nouvelles pistes s'ouvrent pour résoudre les problèmes de façon créative.
+
+## Stratégies de mise en œuvre
+
+Une mise en œuvre réussie demande une planification soignée et une approche stratégique :
+
+1. **Évaluation** : analyser la situation actuelle et repérer les opportunités
+2. **Planification** : établir une feuille de route complète
+3. **Exécution** : déployer les solutions avec un suivi adapté
+4. **Optimisation** : améliorer et ajuster en continu
+
+## Perspectives et tendances
+
+L'avenir de {{topic}} est prometteur, avec plusieurs tendances émergentes :
+- Des avancées technologiques qui ouvrent de nouvelles possibilités
+- Une adoption croissante dans de nombreux secteurs
+- L'intégration avec des technologies complémentaires
+- L'évolution des bonnes pratiques et des méthodes
+
+## Conclusion et points à retenir
+
+{{topic}} est un domaine précieux, avec un fort potentiel d'impact et de croissance. Comprendre ses principes, ses applications et ses stratégies de mise en œuvre est essentiel pour en tirer le meilleur parti.
+
+Points à retenir :
+- Une compréhension complète permet de meilleures décisions
+- La mise en pratique demande une planification stratégique
+- L'apprentissage et l'adaptation continus sont indispensables
+- Les opportunités sont nombreuses pour ceux qui s'y mettent tôt
+
+*Généré par la génération de contenu améliorée avec le modèle local : {{model}}*`,
+		basic: `## PLAN
+- Introduction à {{topic}}
+- Aspects clés et importance
+- Applications pratiques
+- Avantages et points d'attention
+- Conclusion et prochaines étapes
+
+## ARTICLE
+
+# Comprendre {{topic}}
+
+{{topic}} est un sujet important qui mérite notre attention. Dans un monde qui évolue rapidement, connaître {{topic}} peut apporter des avantages et des éclairages précieux.
+
+## Aspects clés
+
+Lorsque l'on explore {{topic}}, plusieurs aspects méritent d'être pris en compte. Ces éléments sont la base de notre compréhension et nous aident à en saisir la complexité et les nuances.
+
+## Applications pratiques
+
+Les applications pratiques de {{topic}} sont nombreuses et variées. Dans la vie quotidienne comme dans le cadre professionnel, les principes liés à {{topic}} peuvent être appliqués de manière utile.
+
+## Avantages et points d'attention
+
+Comprendre {{topic}} apporte plusieurs avantages : de meilleures décisions, une plus grande capacité à résoudre les problèmes et une vision plus large. Il est toutefois important de tenir compte des difficultés et des limites possibles.
+
+## Conclusion
+
+En conclusion, {{topic}} est un domaine de connaissance précieux qui enrichit notre compréhension et offre des bénéfices concrets. En continuant à explorer et à apprendre sur {{topic}}, nous pouvons développer une vision plus complète et plus nuancée.
+
+*Généré par la génération de contenu de secours*`,
+	},
+	"de": {
+		enhanced: `## GLIEDERUNG
+- Einführung in {{topic}}
+- Grundbegriffe und Grundlagen
+- Praktische Anwendungen und Einsatzfälle
+- Vorteile und Nutzen
+- Strategien für die Umsetzung
+- Ausblick und Trends
+- Fazit und wichtigste Erkenntnisse
+
+## ARTIKEL
+
+# {{topic}} verstehen: ein umfassender Leitfaden
+
+{{topic}} ist ein Bereich von großem Interesse in einem sich schnell wandelnden Umfeld. Dieser Leitfaden beleuchtet die wesentlichen Aspekte, die praktischen Anwendungen und die künftige Bedeutung von {{topic}}.
+
+## Grundbegriffe und Grundlagen
+
+Im Kern umfasst {{topic}} mehrere Prinzipien, die das Fundament für das Verständnis bilden. Diese Grundlagen liefern den Rahmen für eine tiefere Beschäftigung und für die praktische Anwendung.
+
+Die wichtigsten Elemente sind:
+- Theoretische Grundlagen und zugrunde liegende Prinzipien
+- Historischer Kontext und Entwicklung
+- Aktueller Stand und neue Entwicklungen
+- Zentrale Begriffe und Definitionen
+
+## Praktische Anwendungen und Einsatzfälle
+
+{{topic}} wird in vielen Branchen und Bereichen eingesetzt. Reale Umsetzungen zeigen, wie vielseitig und wirksam es bei der Lösung komplexer Aufgaben ist.
+
+Typische Anwendungen sind:
+- Branchenspezifische Lösungen
+- Möglichkeiten zur Integration über Teams hinweg
+- Skalierbare Strategien für den Einsatz
+- Techniken zur Optimierung der Leistung
+
+## Vorteile und Nutzen
+
+Die Einführung von {{topic}} bringt zahlreiche Vorteile:
+
+**Effizienz**: Schlankere Prozesse und weniger Komplexität führen zu deutlichen Verbesserungen.
+
+**Kosten**: Eine durchdachte Umsetzung spart oft erhebliche Kosten und Ressourcen.
+
+**Skalierbarkeit**: Lösungen, die auf den Prinzipien von {{topic}} aufbauen, skalieren in der Regel sehr gut.
+
+**Innovation**: Es eröffnen sich neue Wege, Probleme kreativ zu lösen.
+
+## Strategien für die Umsetzung
+
+Eine erfolgreiche Umsetzung erfordert sorgfältige Planung und ein strategisches Vorgehen:
+
+1. **Analyse**: den aktuellen Stand bewerten und Chancen erkennen
+2. **Planung**: einen umfassenden Fahrplan erstellen
+3. **Umsetzung**: die Lösungen mit passender Überwachung einführen
+4. **Optimierung**: laufend verbessern und verfeinern
+
+## Ausblick und Trends
+
+Die Zukunft von {{topic}} ist vielversprechend, und mehrere Trends zeichnen sich ab:
+- Technische Fortschritte eröffnen neue Möglichkeiten
+- Die Verbreitung in verschiedenen Branchen nimmt zu
+- Die Integration mit ergänzenden Technologien wächst
+- Bewährte Verfahren und Methoden entwickeln sich weiter
+
+## Fazit und wichtigste Erkenntnisse
+
+{{topic}} ist ein wertvolles Gebiet mit großem Potenzial für Wirkung und Wachstum. Wer seine Prinzipien, Anwendungen und Strategien versteht, kann dieses Potenzial voll ausschöpfen.
+
+Die wichtigsten Erkenntnisse:
+- Ein umfassendes Verständnis ermöglicht bessere Entscheidungen
+- Die praktische Anwendung erfordert strategische Planung
+- Kontinuierliches Lernen und Anpassen sind unerlässlich
+- Für frühe Anwender gibt es viele Chancen
+
+*Erstellt mit der erweiterten Inhaltserstellung und dem lokalen Modell: {{model}}*`,
+		basic: `## GLIEDERUNG
+- Einführung in {{topic}}
+- Wichtige Aspekte und Bedeutung
+- Praktische Anwendungen
+- Vorteile und Überlegungen
+- Fazit und nächste Schritte
+
+## ARTIKEL
+
+# {{topic}} verstehen
+
+{{topic}} ist ein wichtiges Thema, das unsere Aufmerksamkeit verdient. In einer sich schnell verändernden Welt kann das Wissen über {{topic}} wertvolle Vorteile und Einsichten bieten.
+
+## Wichtige Aspekte
+
+Wer sich mit {{topic}} beschäftigt, stößt auf mehrere Aspekte, die eine genauere Betrachtung lohnen. Sie bilden die Grundlage für unser Verständnis und helfen, die Komplexität und die Feinheiten zu erkennen.
+
+## Praktische Anwendungen
+
+Die praktischen Anwendungen von {{topic}} sind zahlreich und vielfältig. Vom Alltag bis zum beruflichen Umfeld lassen sich die Prinzipien von {{topic}} sinnvoll anwenden.
+
+## Vorteile und Überlegungen
+
+Das Verständnis von {{topic}} bringt mehrere Vorteile mit sich, etwa bessere Entscheidungen, stärkere Problemlösung und einen breiteren Blick auf verwandte Fragen. Dennoch ist es wichtig, auch mögliche Herausforderungen und Grenzen zu bedenken.
+
+## Fazit
+
+Zusammenfassend ist {{topic}} ein wertvolles Wissensgebiet, das unser Verständnis bereichert und einen praktischen Nutzen bietet. Wenn wir weiter über {{topic}} lernen, können wir eine umfassendere und differenziertere Sicht entwickeln.
+
+*Erstellt mit der Ersatz-Inhaltserstellung*`,
+	},
+}
+
+// localizedArticle renders the built-in article for topic in language,
+// falling back to English for languages without templates.
+func localizedArticle(language, topic, model string, enhanced bool) string {
+	templates, ok := localizedFallbacks[baseLanguage(language)]
+	if !ok {
+		templates = localizedFallbacks["en"]
+	}
+	body := templates.basic
+	if enhanced {
+		body = templates.enhanced
+	}
+	return strings.NewReplacer("{{topic}}", topic, "{{model}}", model).Replace(body)
+}
+
+// hasLocalizedArticle reports whether the built-in articles exist in
+// language
+func hasLocalizedArticle(language string) bool {
+	_, ok := localizedFallbacks[baseLanguage(language)]
+	return ok
+}
@@ -18,7 +18,8 @@ class ContentGenerator:
             try:
                 self.llm = Llama(
                     model_path=self.model_path,
-                    n_ctx=2048,
+                    # Same setting as the Go worker; 0 uses the model's own
+                    n_ctx=int(os.environ.get("ACG_CONTEXT_LENGTH", "2048")),
                     n_threads=4,
                     verbose=False
                 )
@@ -62,9 +63,15 @@ class ContentGenerator:
         
         if self.llm:
             try:
+                # Leave the output whatever room the prompt does not take
+                prompt_tokens = len(self.llm.tokenize(prompt.encode("utf-8")))
+                room = self.llm.n_ctx() - prompt_tokens
+                if room < 128:
+                    logging.error(f"Prompt is {prompt_tokens} tokens, too long for the {self.llm.n_ctx()}-token context")
+                    return self._fallback_generation(topic)
                 response = self.llm(
                     prompt,
-                    max_tokens=800,
+                    max_tokens=min(800, room),
                     temperature=0.7,
                     top_p=0.9,
                     stop=["</s>", "[INST]", "[/INST]"]
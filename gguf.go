@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+)
+
+// GGUF is llama.cpp's model format: a header of key/value metadata and
+// tensor descriptions, followed by the tensor data. parseGGUF reads the
+// header only, checking every length against the file size so a corrupt
+// or truncated file fails with an error instead of a huge allocation.
+
+// GGUFInfo is what a model's GGUF header says about it
+type GGUFInfo struct {
+	Version        uint32        `json:"gguf_version"`
+	Architecture   string        `json:"architecture"`
+	Name           string        `json:"name,omitempty"`
+	ParameterCount uint64        `json:"parameter_count"`
+	Quantization   string        `json:"quantization,omitempty"`
+	ContextLength  int           `json:"context_length,omitempty"`
+	ChatTemplate   string        `json:"chat_template,omitempty"`
+	Tokenizer      GGUFTokenizer `json:"tokenizer"`
+	TensorCount    int           `json:"tensor_count"`
+}
+
+type GGUFTokenizer struct {
+	Model      string `json:"model,omitempty"`
+	Pre        string `json:"pre,omitempty"`
+	VocabSize  int    `json:"vocab_size,omitempty"`
+	BOSTokenID *int   `json:"bos_token_id,omitempty"`
+	EOSTokenID *int   `json:"eos_token_id,omitempty"`
+}
+
+// GGUF metadata value types
+const (
+	ggufTypeUint8 uint32 = iota
+	ggufTypeInt8
+	ggufTypeUint16
+	ggufTypeInt16
+	ggufTypeUint32
+	ggufTypeInt32
+	ggufTypeFloat32
+	ggufTypeBool
+	ggufTypeString
+	ggufTypeArray
+	ggufTypeUint64
+	ggufTypeInt64
+	ggufTypeFloat64
+)
+
+var ggufScalarSizes = map[uint32]uint64{
+	ggufTypeUint8: 1, ggufTypeInt8: 1, ggufTypeUint16: 2, ggufTypeInt16: 2,
+	ggufTypeUint32: 4, ggufTypeInt32: 4, ggufTypeFloat32: 4, ggufTypeBool: 1,
+	ggufTypeUint64: 8, ggufTypeInt64: 8, ggufTypeFloat64: 8,
+}
+
+// ggufArray stands in for array values, which can hold a whole vocabulary.
+// Only the length is kept.
+type ggufArray struct {
+	ElemType uint32
+	Len      uint64
+}
+
+// ggmlType describes a tensor encoding: each block of blockSize values
+// takes typeSize bytes
+type ggmlType struct {
+	name      string
+	blockSize uint64
+	typeSize  uint64
+}
+
+var ggmlTypes = map[uint32]ggmlType{
+	0: {"F32", 1, 4}, 1: {"F16", 1, 2}, 2: {"Q4_0", 32, 18}, 3: {"Q4_1", 32, 20},
+	6: {"Q5_0", 32, 22}, 7: {"Q5_1", 32, 24}, 8: {"Q8_0", 32, 34}, 9: {"Q8_1", 32, 36},
+	10: {"Q2_K", 256, 84}, 11: {"Q3_K", 256, 110}, 12: {"Q4_K", 256, 144}, 13: {"Q5_K", 256, 176},
+	14: {"Q6_K", 256, 210}, 15: {"Q8_K", 256, 292}, 16: {"IQ2_XXS", 256, 66}, 17: {"IQ2_XS", 256, 74},
+	18: {"IQ3_XXS", 256, 98}, 19: {"IQ1_S", 256, 50}, 20: {"IQ4_NL", 32, 18}, 21: {"IQ3_S", 256, 110},
+	22: {"IQ2_S", 256, 82}, 23: {"IQ4_XS", 256, 136}, 24: {"I8", 1, 1}, 25: {"I16", 1, 2},
+	26: {"I32", 1, 4}, 27: {"I64", 1, 8}, 28: {"F64", 1, 8}, 29: {"IQ1_M", 256, 56},
+	30: {"BF16", 1, 2}, 34: {"TQ1_0", 256, 54}, 35: {"TQ2_0", 256, 66},
+}
+
+// ggufFileTypes names the values of general.file_type, llama.cpp's
+// llama_ftype
+var ggufFileTypes = map[uint64]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 7: "Q8_0", 8: "Q5_0", 9: "Q5_1",
+	10: "Q2_K", 11: "Q3_K_S", 12: "Q3_K_M", 13: "Q3_K_L", 14: "Q4_K_S", 15: "Q4_K_M",
+	16: "Q5_K_S", 17: "Q5_K_M", 18: "Q6_K", 19: "IQ2_XXS", 20: "IQ2_XS", 21: "Q2_K_S",
+	22: "IQ3_XS", 23: "IQ3_XXS", 24: "IQ1_S", 25: "IQ4_NL", 26: "IQ3_S", 27: "IQ3_M",
+	28: "IQ2_S", 29: "IQ2_M", 30: "IQ4_XS", 31: "IQ1_M", 32: "BF16", 36: "TQ1_0", 37: "TQ2_0",
+}
+
+const (
+	ggufDefaultAlignment = 32
+	// ggmlMaxDims is the most dimensions a tensor can have
+	ggmlMaxDims = 4
+)
+
+type ggufReader struct {
+	r    *bufio.Reader
+	pos  uint64
+	size uint64
+	buf  [8]byte
+}
+
+func (g *ggufReader) remaining() uint64 {
+	return g.size - g.pos
+}
+
+func (g *ggufReader) bytes(n int) ([]byte, error) {
+	if _, err := io.ReadFull(g.r, g.buf[:n]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("file ends unexpectedly at byte %d; it is truncated", g.size)
+		}
+		return nil, err
+	}
+	g.pos += uint64(n)
+	return g.buf[:n], nil
+}
+
+func (g *ggufReader) u32() (uint32, error) {
+	b, err := g.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (g *ggufReader) u64() (uint64, error) {
+	b, err := g.bytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+func (g *ggufReader) skip(n uint64) error {
+	if n > g.remaining() {
+		return fmt.Errorf("%d bytes of data run past the end of the file at byte %d", n, g.pos)
+	}
+	if _, err := g.r.Discard(int(n)); err != nil {
+		return err
+	}
+	g.pos += n
+	return nil
+}
+
+func (g *ggufReader) stringLen() (uint64, error) {
+	n, err := g.u64()
+	if err != nil {
+		return 0, err
+	}
+	if n > g.remaining() {
+		return 0, fmt.Errorf("string of %d bytes at byte %d runs past the end of the file", n, g.pos)
+	}
+	return n, nil
+}
+
+func (g *ggufReader) str() (string, error) {
+	n, err := g.stringLen()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(g.r, buf); err != nil {
+		return "", err
+	}
+	g.pos += n
+	return string(buf), nil
+}
+
+func (g *ggufReader) skipString() error {
+	n, err := g.stringLen()
+	if err != nil {
+		return err
+	}
+	return g.skip(n)
+}
+
+func (g *ggufReader) value(typ uint32) (interface{}, error) {
+	switch typ {
+	case ggufTypeString:
+		return g.str()
+	case ggufTypeArray:
+		return g.array()
+	}
+
+	size, ok := ggufScalarSizes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown metadata value type %d", typ)
+	}
+	b, err := g.bytes(int(size))
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case ggufTypeUint8:
+		return b[0], nil
+	case ggufTypeInt8:
+		return int8(b[0]), nil
+	case ggufTypeUint16:
+		return binary.LittleEndian.Uint16(b), nil
+	case ggufTypeInt16:
+		return int16(binary.LittleEndian.Uint16(b)), nil
+	case ggufTypeUint32:
+		return binary.LittleEndian.Uint32(b), nil
+	case ggufTypeInt32:
+		return int32(binary.LittleEndian.Uint32(b)), nil
+	case ggufTypeFloat32:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), nil
+	case ggufTypeBool:
+		return b[0] != 0, nil
+	case ggufTypeUint64:
+		return binary.LittleEndian.Uint64(b), nil
+	case ggufTypeInt64:
+		return int64(binary.LittleEndian.Uint64(b)), nil
+	default:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	}
+}
+
+// array skips over an array's elements, keeping only its length
+func (g *ggufReader) array() (ggufArray, error) {
+	var arr ggufArray
+	var err error
+	if arr.ElemType, err = g.u32(); err != nil {
+		return arr, err
+	}
+	if arr.Len, err = g.u64(); err != nil {
+		return arr, err
+	}
+
+	switch arr.ElemType {
+	case ggufTypeString:
+		// Every string takes at least its 8 byte length
+		if arr.Len > g.remaining()/8 {
+			return arr, fmt.Errorf("array of %d strings runs past the end of the file", arr.Len)
+		}
+		for i := uint64(0); i < arr.Len; i++ {
+			if err := g.skipString(); err != nil {
+				return arr, err
+			}
+		}
+	case ggufTypeArray:
+		// Every nested array takes at least its type and length
+		if arr.Len > g.remaining()/12 {
+			return arr, fmt.Errorf("array of %d arrays runs past the end of the file", arr.Len)
+		}
+		for i := uint64(0); i < arr.Len; i++ {
+			if _, err := g.array(); err != nil {
+				return arr, err
+			}
+		}
+	default:
+		size, ok := ggufScalarSizes[arr.ElemType]
+		if !ok {
+			return arr, fmt.Errorf("unknown array element type %d", arr.ElemType)
+		}
+		if arr.Len > g.remaining()/size {
+			return arr, fmt.Errorf("array of %d values runs past the end of the file", arr.Len)
+		}
+		if err := g.skip(arr.Len * size); err != nil {
+			return arr, err
+		}
+	}
+	return arr, nil
+}
+
+// parseGGUF reads a GGUF v2 or v3 file's header and checks that the tensor
+// data it describes fits in the file
+func parseGGUF(path string) (*GGUFInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// magic, version, tensor count and metadata count
+	if fi.Size() < 24 {
+		return nil, fmt.Errorf("file is too small to be a GGUF model (%d bytes)", fi.Size())
+	}
+	g := &ggufReader{r: bufio.NewReaderSize(f, 1<<16), size: uint64(fi.Size())}
+
+	magic, err := g.bytes(4)
+	if err != nil {
+		return nil, err
+	}
+	switch string(magic) {
+	case "GGUF":
+	case "lmgg", "fmgg", "tjgg":
+		return nil, fmt.Errorf("legacy GGML format is not supported; convert the model to GGUF")
+	default:
+		return nil, fmt.Errorf("not a GGUF file (magic %q)", magic)
+	}
+
+	version, err := g.u32()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case version == 1:
+		return nil, fmt.Errorf("GGUF version 1 is no longer supported; convert the model again")
+	case bits.ReverseBytes32(version) == 2 || bits.ReverseBytes32(version) == 3:
+		return nil, fmt.Errorf("big-endian GGUF files are not supported")
+	case version != 2 && version != 3:
+		return nil, fmt.Errorf("unsupported GGUF version %d", version)
+	}
+
+	tensorCount, err := g.u64()
+	if err != nil {
+		return nil, err
+	}
+	kvCount, err := g.u64()
+	if err != nil {
+		return nil, err
+	}
+	// A metadata entry takes at least 13 bytes and a tensor description 24
+	if kvCount > g.remaining()/13 {
+		return nil, fmt.Errorf("header claims %d metadata entries, more than the file can hold", kvCount)
+	}
+	if tensorCount > g.remaining()/24 {
+		return nil, fmt.Errorf("header claims %d tensors, more than the file can hold", tensorCount)
+	}
+
+	metadata := make(map[string]interface{}, kvCount)
+	for i := uint64(0); i < kvCount; i++ {
+		key, err := g.str()
+		if err != nil {
+			return nil, fmt.Errorf("metadata entry %d: %v", i, err)
+		}
+		if _, dup := metadata[key]; dup {
+			return nil, fmt.Errorf("duplicate metadata key %s", key)
+		}
+		typ, err := g.u32()
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s: %v", key, err)
+		}
+		value, err := g.value(typ)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s: %v", key, err)
+		}
+		metadata[key] = value
+	}
+
+	alignment := uint64(ggufDefaultAlignment)
+	if a, ok := ggufUint(metadata, "general.alignment"); ok {
+		if a == 0 || a&(a-1) != 0 {
+			return nil, fmt.Errorf("general.alignment %d is not a power of two", a)
+		}
+		alignment = a
+	}
+
+	info := &GGUFInfo{Version: version, TensorCount: int(tensorCount)}
+	if tensorCount == 0 {
+		return nil, fmt.Errorf("file contains no tensors; it may be a vocabulary-only file")
+	}
+
+	// Parameters by tensor type, to name the quantization when the file
+	// does not
+	paramsByType := make(map[uint32]uint64)
+	var dataEnd uint64
+	for i := uint64(0); i < tensorCount; i++ {
+		name, err := g.str()
+		if err != nil {
+			return nil, fmt.Errorf("tensor %d: %v", i, err)
+		}
+		nDims, err := g.u32()
+		if err != nil {
+			return nil, fmt.Errorf("tensor %s: %v", name, err)
+		}
+		if nDims == 0 || nDims > ggmlMaxDims {
+			return nil, fmt.Errorf("tensor %s has %d dimensions", name, nDims)
+		}
+		elements := uint64(1)
+		for d := uint32(0); d < nDims; d++ {
+			dim, err := g.u64()
+			if err != nil {
+				return nil, fmt.Errorf("tensor %s: %v", name, err)
+			}
+			hi, lo := bits.Mul64(elements, dim)
+			if hi != 0 {
+				return nil, fmt.Errorf("tensor %s is impossibly large", name)
+			}
+			elements = lo
+		}
+		typ, err := g.u32()
+		if err != nil {
+			return nil, fmt.Errorf("tensor %s: %v", name, err)
+		}
+		offset, err := g.u64()
+		if err != nil {
+			return nil, fmt.Errorf("tensor %s: %v", name, err)
+		}
+		if offset%alignment != 0 {
+			return nil, fmt.Errorf("tensor %s data is not aligned to %d bytes", name, alignment)
+		}
+
+		t, known := ggmlTypes[typ]
+		if !known {
+			return nil, fmt.Errorf("tensor %s has unsupported type %d", name, typ)
+		}
+		info.ParameterCount += elements
+		paramsByType[typ] += elements
+		if elements%t.blockSize != 0 {
+			return nil, fmt.Errorf("tensor %s: %d values do not fill whole %s blocks", name, elements, t.name)
+		}
+		if end := offset + elements/t.blockSize*t.typeSize; end > dataEnd {
+			dataEnd = end
+		}
+	}
+
+	dataStart := (g.pos + alignment - 1) / alignment * alignment
+	if dataStart+dataEnd > g.size {
+		return nil, fmt.Errorf("tensor data needs %d bytes but the file has %d; it is truncated", dataStart+dataEnd, g.size)
+	}
+
+	info.Architecture = ggufString(metadata, "general.architecture")
+	if info.Architecture == "" {
+		return nil, fmt.Errorf("missing general.architecture")
+	}
+	info.Name = ggufString(metadata, "general.name")
+	if n, ok := ggufUint(metadata, info.Architecture+".context_length"); ok {
+		info.ContextLength = int(n)
+	}
+	info.ChatTemplate = ggufString(metadata, "tokenizer.chat_template")
+
+	if fileType, ok := ggufUint(metadata, "general.file_type"); ok {
+		info.Quantization = ggufFileTypes[fileType]
+		if info.Quantization == "" {
+			info.Quantization = fmt.Sprintf("file type %d", fileType)
+		}
+	} else {
+		info.Quantization = dominantTensorType(paramsByType)
+	}
+
+	info.Tokenizer = GGUFTokenizer{
+		Model: ggufString(metadata, "tokenizer.ggml.model"),
+		Pre:   ggufString(metadata, "tokenizer.ggml.pre"),
+	}
+	if tokens, ok := metadata["tokenizer.ggml.tokens"].(ggufArray); ok {
+		info.Tokenizer.VocabSize = int(tokens.Len)
+	}
+	if id, ok := ggufUint(metadata, "tokenizer.ggml.bos_token_id"); ok {
+		v := int(id)
+		info.Tokenizer.BOSTokenID = &v
+	}
+	if id, ok := ggufUint(metadata, "tokenizer.ggml.eos_token_id"); ok {
+		v := int(id)
+		info.Tokenizer.EOSTokenID = &v
+	}
+	return info, nil
+}
+
+// dominantTensorType names the type holding the most parameters
+func dominantTensorType(paramsByType map[uint32]uint64) string {
+	var best uint32
+	var most uint64
+	for typ, n := range paramsByType {
+		if n > most || (n == most && typ < best) {
+			best, most = typ, n
+		}
+	}
+	return ggmlTypes[best].name
+}
+
+// ggufUint returns an integer metadata value whatever its stored width
+func ggufUint(metadata map[string]interface{}, key string) (uint64, bool) {
+	switch v := metadata[key].(type) {
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case int8:
+		return uint64(v), v >= 0
+	case int16:
+		return uint64(v), v >= 0
+	case int32:
+		return uint64(v), v >= 0
+	case int64:
+		return uint64(v), v >= 0
+	}
+	return 0, false
+}
+
+func ggufString(metadata map[string]interface{}, key string) string {
+	s, _ := metadata[key].(string)
+	return s
+}
+
+// formatParameterCount renders a parameter count the way model names do,
+// like 7.2B or 135M
+func formatParameterCount(n uint64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.0fM", float64(n)/1e6)
+	case n >= 1e3:
+		return fmt.Sprintf("%.0fK", float64(n)/1e3)
+	}
+	return fmt.Sprintf("%d", n)
+}
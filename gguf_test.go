@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ggufFile builds GGUF files for tests
+type ggufFile struct {
+	bytes.Buffer
+}
+
+func (f *ggufFile) u32(v uint32) *ggufFile {
+	binary.Write(f, binary.LittleEndian, v)
+	return f
+}
+
+func (f *ggufFile) u64(v uint64) *ggufFile {
+	binary.Write(f, binary.LittleEndian, v)
+	return f
+}
+
+func (f *ggufFile) str(s string) *ggufFile {
+	f.u64(uint64(len(s)))
+	f.WriteString(s)
+	return f
+}
+
+func (f *ggufFile) kvString(key, value string) *ggufFile {
+	return f.str(key).u32(ggufTypeString).str(value)
+}
+
+func (f *ggufFile) kvUint32(key string, value uint32) *ggufFile {
+	return f.str(key).u32(ggufTypeUint32).u32(value)
+}
+
+func (f *ggufFile) tensor(name string, dims []uint64, typ uint32, offset uint64) *ggufFile {
+	f.str(name).u32(uint32(len(dims)))
+	for _, d := range dims {
+		f.u64(d)
+	}
+	return f.u32(typ).u64(offset)
+}
+
+// data pads to the default alignment and appends n bytes of tensor data
+func (f *ggufFile) data(n int) *ggufFile {
+	for f.Len()%ggufDefaultAlignment != 0 {
+		f.WriteByte(0)
+	}
+	f.Write(make([]byte, n))
+	return f
+}
+
+func ggufHeader(version uint32, tensors, kvs uint64) *ggufFile {
+	f := &ggufFile{}
+	f.WriteString("GGUF")
+	return f.u32(version).u64(tensors).u64(kvs)
+}
+
+// validGGUF is a one-tensor llama model of 32 F32 values
+func validGGUF() *ggufFile {
+	return ggufHeader(3, 1, 3).
+		kvString("general.architecture", "llama").
+		kvUint32("llama.context_length", 4096).
+		kvUint32("general.file_type", 15).
+		tensor("w", []uint64{32}, 0, 0).
+		data(32 * 4)
+}
+
+func writeGGUF(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseGGUF(t *testing.T) {
+	info, err := parseGGUF(writeGGUF(t, validGGUF().Bytes()))
+	if err != nil {
+		t.Fatalf("parseGGUF: %v", err)
+	}
+	if info.Version != 3 || info.Architecture != "llama" || info.ContextLength != 4096 {
+		t.Errorf("got version %d, architecture %q, context %d", info.Version, info.Architecture, info.ContextLength)
+	}
+	if info.Quantization != "Q4_K_M" || info.ParameterCount != 32 || info.TensorCount != 1 {
+		t.Errorf("got quantization %q, %d parameters, %d tensors", info.Quantization, info.ParameterCount, info.TensorCount)
+	}
+}
+
+func TestParseGGUFRejects(t *testing.T) {
+	valid := validGGUF().Bytes()
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"too small", []byte("GGUF\x03\x00"), "too small"},
+		{"bad magic", append([]byte("ABCD"), valid[4:]...), "not a GGUF file"},
+		{"legacy ggml", append([]byte("lmgg"), valid[4:]...), "legacy GGML"},
+		{"version 1", ggufHeader(1, 1, 0).data(64).Bytes(), "version 1 is no longer supported"},
+		{"unsupported version", ggufHeader(4, 1, 0).data(64).Bytes(), "unsupported GGUF version 4"},
+		{"big endian", ggufHeader(3<<24, 1, 0).data(64).Bytes(), "big-endian"},
+		{"truncated header", ggufHeader(3, 1, 1).kvString("general.architecture", "llama").str("w").u32(1).u64(32).Bytes(), "ends unexpectedly"},
+		{"truncated data", valid[:len(valid)-1], "truncated"},
+		{"too many entries", ggufHeader(3, 1, 1<<40).data(64).Bytes(), "metadata entries"},
+		{"too many tensors", ggufHeader(3, 1<<40, 0).data(64).Bytes(), "tensors"},
+		{"string past end", ggufHeader(3, 1, 1).u64(1 << 40).data(64).Bytes(), "runs past the end"},
+		{"no tensors", ggufHeader(3, 0, 1).kvString("general.architecture", "llama").data(64).Bytes(), "no tensors"},
+		{"too many dimensions", ggufHeader(3, 1, 0).tensor("w", []uint64{1, 1, 1, 1, 1}, 0, 0).data(64).Bytes(), "5 dimensions"},
+		{"overflowing dimensions", ggufHeader(3, 1, 0).tensor("w", []uint64{1 << 32, 1 << 32}, 0, 0).data(64).Bytes(), "impossibly large"},
+		{"unknown tensor type", ggufHeader(3, 1, 0).tensor("w", []uint64{32}, 99, 0).data(64).Bytes(), "unsupported type 99"},
+		{"misaligned offset", ggufHeader(3, 1, 0).tensor("w", []uint64{32}, 0, 3).data(256).Bytes(), "not aligned"},
+		{"partial block", ggufHeader(3, 1, 0).tensor("w", []uint64{31}, 2, 0).data(64).Bytes(), "whole Q4_0 blocks"},
+		{"no architecture", ggufHeader(3, 1, 0).tensor("w", []uint64{32}, 0, 0).data(128).Bytes(), "missing general.architecture"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGGUF(writeGGUF(t, tt.data))
+			if err == nil {
+				t.Fatalf("parseGGUF succeeded, want error containing %q", tt.want)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatParameterCount(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		want string
+	}{
+		{999, "999"},
+		{135e6, "135M"},
+		{7_241_732_096, "7.2B"},
+	}
+	for _, tt := range tests {
+		if got := formatParameterCount(tt.n); got != tt.want {
+			t.Errorf("formatParameterCount(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
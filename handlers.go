@@ -2,10 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"html"
+	"math"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -19,41 +20,161 @@ func createJobHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateTranslation(req); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Type == JobTypeTranslate {
+		source, ok := accessibleJob(w, r, *req.SourceJobID)
+		if !ok {
+			return
+		}
+		if source.Status != "completed" {
+			writeErrorResponse(w, "Source job is not completed", http.StatusBadRequest)
+			return
+		}
+		// A translation is about what its source is about
+		if strings.TrimSpace(req.Topic) == "" {
+			req.Topic = source.Topic
+		}
+	}
+
 	if strings.TrimSpace(req.Topic) == "" {
 		writeErrorResponse(w, "Topic is required", http.StatusBadRequest)
 		return
 	}
 
-	job, err := createJob(req.Topic, req.Type)
+	if req.Priority < MinPriority || req.Priority > MaxPriority {
+		writeErrorResponse(w, fmt.Sprintf("Priority must be between %d and %d", MinPriority, MaxPriority), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateParams(req.Type, req.Params); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Model != "" {
+		if _, err := lookupModel(req.Model); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				writeErrorResponse(w, "Unknown model: "+req.Model, http.StatusBadRequest)
+				return
+			}
+			writeErrorResponse(w, "Model cannot be used: "+req.Model, http.StatusBadRequest)
+			return
+		}
+	}
+
+	principal := principalFromContext(r.Context())
+	// Higher priorities jump the queue past every client, so only admins
+	// may set them; everyone else takes turns at the default level
+	if req.Priority > DefaultPriority && !principal.HasScope(ScopeAdmin) {
+		writeErrorResponse(w, fmt.Sprintf("Only admins may set a priority above %d", DefaultPriority), http.StatusForbidden)
+		return
+	}
+
+	ws, err := getWorkspace(principal.WorkspaceID)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error getting workspace", "error", err)
+		writeErrorResponse(w, "Failed to create job", http.StatusInternalServerError)
+		return
+	}
+	if err := checkJobFits(r.Context(), ws, req); err != nil {
+		writeErrorResponse(w, "Job does not fit the model: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Dedupe {
+		existing, err := findDedupeJob(r.Context(), principal.JobFilter(), dedupeHash(req))
+		if err != nil {
+			loggerFrom(r.Context()).Error("error finding duplicate job", "error", err)
+			writeErrorResponse(w, "Failed to create job", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			loggerFrom(r.Context()).Info("returning existing job", "job_id", existing.ID)
+			w.Header().Set("X-Deduplicated", "true")
+			writeSuccessResponse(w, existing)
+			return
+		}
+	}
+
+	if !enforceQuota(w, principal) {
+		return
+	}
+
+	job, err := createJob(r.Context(), req, schedulingClient(r, req), principal.Owner(), quotaCheck(principal))
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		w.Header().Set("X-Quota-Remaining", "0")
+		writeQuotaExceeded(w, quotaErr.Quota)
+		return
+	}
 	if err != nil {
-		log.Printf("Error creating job: %v", err)
+		loggerFrom(r.Context()).Error("error creating job", "error", err)
 		writeErrorResponse(w, "Failed to create job", http.StatusInternalServerError)
 		return
 	}
+	jobsCreated.WithLabelValues(job.Type).Inc()
+	loggerFrom(r.Context()).Info("job created", "job_id", job.ID, "type", job.Type, "priority", job.Priority)
 
 	writeSuccessResponse(w, job)
 }
 
 func getJobsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GET /api/jobs called")
-	
 	if db == nil {
-		log.Printf("Database not initialized")
+		loggerFrom(r.Context()).Error("database not initialized")
 		writeErrorResponse(w, "Database not available", http.StatusInternalServerError)
 		return
 	}
 	
-	jobs, err := getJobs()
+	filter := principalFromContext(r.Context()).JobFilter()
+	ranges, err := readabilityFilter(r)
+	if err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Readability = ranges
+
+	jobs, err := getJobs(r.Context(), filter)
 	if err != nil {
-		log.Printf("Error getting jobs: %v", err)
+		loggerFrom(r.Context()).Error("error getting jobs", "error", err)
 		writeErrorResponse(w, "Failed to get jobs", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Returning %d jobs", len(jobs))
+	loggerFrom(r.Context()).Debug("returning jobs", "jobs", len(jobs))
 	writeSuccessResponse(w, jobs)
 }
 
+// readabilityFilter reads min_<metric> and max_<metric> query parameters,
+// e.g. ?min_reading_ease=60&max_grade_level=9
+func readabilityFilter(r *http.Request) (map[string]ScoreRange, error) {
+	ranges := make(map[string]ScoreRange)
+	query := r.URL.Query()
+	for _, metric := range readabilityMetrics {
+		var sr ScoreRange
+		for _, bound := range []struct {
+			param string
+			dst   **float64
+		}{{"min_" + metric, &sr.Min}, {"max_" + metric, &sr.Max}} {
+			v := query.Get(bound.param)
+			if v == "" {
+				continue
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil, fmt.Errorf("invalid %s: %s", bound.param, v)
+			}
+			*bound.dst = &f
+		}
+		if sr.Min != nil || sr.Max != nil {
+			ranges[metric] = sr
+		}
+	}
+	return ranges, nil
+}
+
 func getJobHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -64,20 +185,40 @@ func getJobHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	job, err := getJobByID(id)
-	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			writeErrorResponse(w, "Job not found", http.StatusNotFound)
-			return
-		}
-		log.Printf("Error getting job: %v", err)
-		writeErrorResponse(w, "Failed to get job", http.StatusInternalServerError)
+	job, ok := accessibleJob(w, r, id)
+	if !ok {
 		return
 	}
 
 	writeSuccessResponse(w, job)
 }
 
+// listTranslationsHandler lists the translate jobs made from a job
+func listTranslationsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := accessibleJob(w, r, id); !ok {
+		return
+	}
+
+	filter := principalFromContext(r.Context()).JobFilter()
+	filter.SourceJobID = &id
+	jobs, err := getJobs(r.Context(), filter)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error getting translations", "error", err)
+		writeErrorResponse(w, "Failed to get translations", http.StatusInternalServerError)
+		return
+	}
+	if jobs == nil {
+		jobs = []Job{}
+	}
+	writeSuccessResponse(w, jobs)
+}
+
 func deleteJobHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -88,13 +229,17 @@ func deleteJobHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = deleteJob(id)
+	if _, ok := accessibleJob(w, r, id); !ok {
+		return
+	}
+
+	err = deleteJob(r.Context(), principalFromContext(r.Context()).WorkspaceID, id)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
 			writeErrorResponse(w, "Job not found", http.StatusNotFound)
 			return
 		}
-		log.Printf("Error deleting job: %v", err)
+		loggerFrom(r.Context()).Error("error deleting job", "error", err)
 		writeErrorResponse(w, "Failed to delete job", http.StatusInternalServerError)
 		return
 	}
@@ -102,33 +247,639 @@ func deleteJobHandler(w http.ResponseWriter, r *http.Request) {
 	writeSuccessResponse(w, map[string]string{"message": "Job deleted successfully"})
 }
 
+// similarJobsHandler lists the earlier jobs whose output is closest to a
+// job's, most similar first
+func similarJobsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSimilarLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxSimilarLimit {
+			writeErrorResponse(w, fmt.Sprintf("limit must be between 1 and %d", maxSimilarLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	job, ok := accessibleJob(w, r, id)
+	if !ok {
+		return
+	}
+	fp, err := getJobFingerprint(r.Context(), job.WorkspaceID, id)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error getting fingerprint", "error", err)
+		writeErrorResponse(w, "Failed to find similar jobs", http.StatusInternalServerError)
+		return
+	}
+	if fp == nil {
+		writeErrorResponse(w, "Job has no output to compare", http.StatusBadRequest)
+		return
+	}
+
+	archive, err := jobFingerprints(r.Context(), principalFromContext(r.Context()).JobFilter(), id)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error getting fingerprints", "error", err)
+		writeErrorResponse(w, "Failed to find similar jobs", http.StatusInternalServerError)
+		return
+	}
+	writeSuccessResponse(w, rankSimilar(fp, archive, limit))
+}
+
+// approveJobHandler accepts the output of a job the quality checks flagged
+func approveJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	job, ok := accessibleJob(w, r, id)
+	if !ok {
+		return
+	}
+	if job.Status != StatusNeedsReview {
+		writeErrorResponse(w, "Job is not awaiting review", http.StatusBadRequest)
+		return
+	}
+
+	if err := approveJob(r.Context(), job.WorkspaceID, id); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeErrorResponse(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		loggerFrom(r.Context()).Error("error approving job", "error", err)
+		writeErrorResponse(w, "Failed to approve job", http.StatusInternalServerError)
+		return
+	}
+
+	writeSuccessResponse(w, map[string]string{"message": "Job approved"})
+}
+
+// jobStepsHandler lists the pipeline steps of a job, with their prompts and
+// outputs
+func jobStepsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	job, ok := accessibleJob(w, r, id)
+	if !ok {
+		return
+	}
+	steps, err := jobSteps(r.Context(), job.ID)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error listing job steps", "error", err)
+		writeErrorResponse(w, "Failed to list job steps", http.StatusInternalServerError)
+		return
+	}
+	if steps == nil {
+		steps = []JobStep{}
+	}
+
+	writeSuccessResponse(w, steps)
+}
+
+// accessibleJob loads a job the caller is allowed to see, writing the error
+// response itself otherwise. Jobs owned by someone else look like missing ones.
+func accessibleJob(w http.ResponseWriter, r *http.Request, id int) (*Job, bool) {
+	job, err := getJobByID(r.Context(), principalFromContext(r.Context()).WorkspaceID, id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeErrorResponse(w, "Job not found", http.StatusNotFound)
+			return nil, false
+		}
+		loggerFrom(r.Context()).Error("error getting job", "error", err)
+		writeErrorResponse(w, "Failed to get job", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if !principalFromContext(r.Context()).CanAccessJob(job) {
+		writeErrorResponse(w, "Job not found", http.StatusNotFound)
+		return nil, false
+	}
+	return job, true
+}
+
+// schedulingClient identifies who a job is queued for, so the scheduler can
+// share the worker fairly between batches and API clients. Clients are
+// namespaced by workspace so tenants never share a turn.
+func schedulingClient(r *http.Request, req CreateJobRequest) string {
+	p := principalFromContext(r.Context())
+	prefix := fmt.Sprintf("ws:%d/", p.WorkspaceID)
+	if batch := strings.TrimSpace(req.Batch); batch != "" {
+		return prefix + "batch:" + batch
+	}
+	if p.UserID != 0 {
+		return prefix + fmt.Sprintf("user:%d", p.UserID)
+	}
+	if p.KeyID != 0 {
+		return prefix + fmt.Sprintf("key:%d", p.KeyID)
+	}
+	return prefix + "ip:" + clientIP(r)
+}
+
+// targetWorkspace resolves the workspace an admin request acts on. Only
+// instance admins may act on a workspace other than their own.
+func targetWorkspace(w http.ResponseWriter, r *http.Request, requested int) (int, bool) {
+	p := principalFromContext(r.Context())
+	if requested == 0 || requested == p.WorkspaceID {
+		return p.WorkspaceID, true
+	}
+	if !p.IsInstanceAdmin() {
+		writeErrorResponse(w, "Cannot manage another workspace", http.StatusForbidden)
+		return 0, false
+	}
+	if _, err := getWorkspace(requested); err != nil {
+		writeErrorResponse(w, "Workspace not found", http.StatusNotFound)
+		return 0, false
+	}
+	return requested, true
+}
+
 func processJobsHandler(w http.ResponseWriter, r *http.Request) {
-	// Trigger immediate processing of all pending jobs
-	go worker.ProcessAllPending()
-	
+	// Workers may run in other processes, so wake them through the job store
+	// rather than processing here
+	if err := signalWorkers(r.Context()); err != nil {
+		loggerFrom(r.Context()).Error("error signalling workers", "error", err)
+		writeErrorResponse(w, "Failed to trigger processing", http.StatusInternalServerError)
+		return
+	}
+
 	writeSuccessResponse(w, map[string]string{
 		"message": "Processing triggered for all pending jobs",
 	})
 }
 
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := principalQuotaUsage(db, principalFromContext(r.Context()))
+	if err != nil {
+		loggerFrom(r.Context()).Error("error getting usage", "error", err)
+		writeErrorResponse(w, "Failed to get usage", http.StatusInternalServerError)
+		return
+	}
+
+	writeSuccessResponse(w, usage)
+}
+
 func modelStatusHandler(w http.ResponseWriter, r *http.Request) {
-	modelPath := findModel()
-	var message string
-	
-	if modelPath != "" {
-		message = fmt.Sprintf("✅ Local model active: %s", filepath.Base(modelPath))
+	model, err := defaultModel(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("error getting default model", "error", err)
+		writeErrorResponse(w, "Failed to get model status", http.StatusInternalServerError)
+		return
+	}
+
+	status := ModelStatus{Model: model}
+	if model != nil {
+		status.Message = fmt.Sprintf("✅ Local model active: %s", model.Name)
+		status.GGUF = model.GGUF
 	} else {
-		message = "⚠️ No local model found - using enhanced fallback generation"
+		status.Message = "⚠️ No local model found - using enhanced fallback generation"
 	}
-	
-	writeSuccessResponse(w, map[string]string{"message": message})
+
+	writeSuccessResponse(w, status)
+}
+
+// listModelsHandler lists every model in the model directories, marking
+// the instance default
+func listModelsHandler(w http.ResponseWriter, r *http.Request) {
+	models, err := listModels(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("error listing models", "error", err)
+		writeErrorResponse(w, "Failed to list models", http.StatusInternalServerError)
+		return
+	}
+	if models == nil {
+		models = []ModelInfo{}
+	}
+	writeSuccessResponse(w, models)
+}
+
+// setDefaultModelHandler switches the model every workspace without one of
+// its own uses. Workers pick it up with their next job.
+func setDefaultModelHandler(w http.ResponseWriter, r *http.Request) {
+	var req SetDefaultModelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := setDefaultModel(r.Context(), req.Name); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeErrorResponse(w, "Model not found", http.StatusNotFound)
+			return
+		}
+		if strings.Contains(err.Error(), "unusable") {
+			writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		loggerFrom(r.Context()).Error("error setting default model", "error", err)
+		writeErrorResponse(w, "Failed to set default model", http.StatusInternalServerError)
+		return
+	}
+
+	model, err := defaultModel(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("error getting default model", "error", err)
+		writeErrorResponse(w, "Failed to get default model", http.StatusInternalServerError)
+		return
+	}
+	if model == nil {
+		writeErrorResponse(w, "No models available", http.StatusNotFound)
+		return
+	}
+	loggerFrom(r.Context()).Info("default model changed", "model", model.Name)
+	writeSuccessResponse(w, model)
+}
+
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := listAPIKeys(principalFromContext(r.Context()).WorkspaceID)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error listing API keys", "error", err)
+		writeErrorResponse(w, "Failed to list API keys", http.StatusInternalServerError)
+		return
+	}
+
+	writeSuccessResponse(w, keys)
 }
 
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		writeErrorResponse(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeErrorResponse(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			writeErrorResponse(w, "Invalid scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+	if err := validateQuotaLimits(req.QuotaLimits); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	workspaceID, ok := targetWorkspace(w, r, req.WorkspaceID)
+	if !ok {
+		return
+	}
+
+	key, err := createAPIKey(workspaceID, req.Name, req.Scopes, req.QuotaLimits)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error creating API key", "error", err)
+		writeErrorResponse(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	loggerFrom(r.Context()).Info("API key created", "key_id", key.ID, "name", key.Name)
+	writeSuccessResponse(w, key)
+}
+
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := revokeAPIKey(principalFromContext(r.Context()).WorkspaceID, id); err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeErrorResponse(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		loggerFrom(r.Context()).Error("error revoking API key", "error", err)
+		writeErrorResponse(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+
+	loggerFrom(r.Context()).Info("API key revoked", "key_id", id)
+	writeSuccessResponse(w, map[string]string{"message": "API key revoked"})
+}
+
+func listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := listUsers(principalFromContext(r.Context()).WorkspaceID)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error listing users", "error", err)
+		writeErrorResponse(w, "Failed to list users", http.StatusInternalServerError)
+		return
+	}
+
+	writeSuccessResponse(w, users)
+}
+
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" {
+		writeErrorResponse(w, "Username is required", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleWriter
+	}
+	if !validRoles[req.Role] {
+		writeErrorResponse(w, "Invalid role: "+req.Role, http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		writeErrorResponse(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	workspaceID, ok := targetWorkspace(w, r, req.WorkspaceID)
+	if !ok {
+		return
+	}
+
+	user, err := createUser(workspaceID, req.Username, req.Password, req.Role)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			writeErrorResponse(w, "Username already exists", http.StatusConflict)
+			return
+		}
+		loggerFrom(r.Context()).Error("error creating user", "error", err)
+		writeErrorResponse(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
+	loggerFrom(r.Context()).Info("user created", "username", user.Username, "role", user.Role)
+	writeSuccessResponse(w, user)
+}
+
+func listWorkspacesHandler(w http.ResponseWriter, r *http.Request) {
+	workspaces, err := listWorkspaces()
+	if err != nil {
+		loggerFrom(r.Context()).Error("error listing workspaces", "error", err)
+		writeErrorResponse(w, "Failed to list workspaces", http.StatusInternalServerError)
+		return
+	}
+
+	writeSuccessResponse(w, workspaces)
+}
+
+func createWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	var req WorkspaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Backend == "" {
+		req.Backend = BackendLocal
+	}
+	if err := validateWorkspaceRequest(req); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := createWorkspace(req)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			writeErrorResponse(w, "Workspace slug already exists", http.StatusConflict)
+			return
+		}
+		loggerFrom(r.Context()).Error("error creating workspace", "error", err)
+		writeErrorResponse(w, "Failed to create workspace", http.StatusInternalServerError)
+		return
+	}
+
+	// Hand back a first admin key so the new workspace can be managed
+	key, err := createAPIKey(ws.ID, ws.Slug+"-admin", []string{ScopeAdmin}, QuotaLimits{})
+	if err != nil {
+		loggerFrom(r.Context()).Error("error creating admin key for workspace", "workspace_id", ws.ID, "error", err)
+		writeErrorResponse(w, "Workspace created but admin key failed", http.StatusInternalServerError)
+		return
+	}
+
+	loggerFrom(r.Context()).Info("workspace created", "workspace", ws.Slug)
+	writeSuccessResponse(w, CreateWorkspaceResponse{Workspace: *ws, AdminKey: *key})
+}
+
+func updateWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeErrorResponse(w, "Invalid workspace ID", http.StatusBadRequest)
+		return
+	}
+
+	var req WorkspaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Backend == "" {
+		req.Backend = BackendLocal
+	}
+	if err := validateWorkspaceRequest(req); err != nil {
+		writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := updateWorkspace(id, req)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			writeErrorResponse(w, "Workspace not found", http.StatusNotFound)
+			return
+		}
+		loggerFrom(r.Context()).Error("error updating workspace", "error", err)
+		writeErrorResponse(w, "Failed to update workspace", http.StatusInternalServerError)
+		return
+	}
+
+	loggerFrom(r.Context()).Info("workspace updated", "workspace", ws.Slug)
+	writeSuccessResponse(w, ws)
+}
+
+func listTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := listPromptTemplates(principalFromContext(r.Context()).WorkspaceID)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error listing templates", "error", err)
+		writeErrorResponse(w, "Failed to list templates", http.StatusInternalServerError)
+		return
+	}
+
+	writeSuccessResponse(w, templates)
+}
+
+func saveTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	jobType := mux.Vars(r)["type"]
+
+	var req PromptTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(req.Body, "{{topic}}") {
+		writeErrorResponse(w, "Template must contain {{topic}}", http.StatusBadRequest)
+		return
+	}
+
+	template, err := savePromptTemplate(principalFromContext(r.Context()).WorkspaceID, jobType, req.Body)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error saving template", "error", err)
+		writeErrorResponse(w, "Failed to save template", http.StatusInternalServerError)
+		return
+	}
+
+	writeSuccessResponse(w, template)
+}
+
+const loginCSRFCookieName = "acg_login_csrf"
+
+func loginPageHandler(w http.ResponseWriter, r *http.Request) {
+	// The login form uses a double-submit token so another site cannot log
+	// a visitor into an account of its choosing
+	token, err := randomToken(16)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCSRFCookieName,
+		Value:    token,
+		Path:     "/login",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	message := ""
+	if r.URL.Query().Get("error") != "" {
+		message = `<p class="error">Invalid username or password</p>`
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(strings.NewReplacer("{{CSRF_TOKEN}}", token, "{{MESSAGE}}", message).Replace(loginPageHTML)))
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if ok, _, _ := loginRateLimiter.Allow(clientIP(r)); !ok {
+		http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	cookie, err := r.Cookie(loginCSRFCookieName)
+	if err != nil || cookie.Value == "" || r.FormValue("csrf_token") != cookie.Value {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	user, err := authenticateUser(r.FormValue("username"), r.FormValue("password"))
+	if err != nil {
+		loggerFrom(r.Context()).Warn("failed login", "username", r.FormValue("username"), "error", err)
+		http.Redirect(w, r, "/login?error=1", http.StatusSeeOther)
+		return
+	}
+
+	session, token, err := createSession(user.ID)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error creating session", "error", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	loggerFrom(r.Context()).Info("user logged in", "username", user.Username)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		session, _, err := lookupSession(cookie.Value)
+		if err == nil && !validCSRFToken(r.FormValue("csrf_token"), session) {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if err := deleteSession(cookie.Value); err != nil {
+			loggerFrom(r.Context()).Error("error deleting session", "error", err)
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+const loginPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+    <title>Log in - AI Content Automator</title>
+    <style>
+        body { font-family: Arial, sans-serif; margin: 40px; }
+        .container { max-width: 360px; margin: 0 auto; }
+        input { display: block; padding: 10px; margin: 10px 0; width: 100%; box-sizing: border-box; border: 1px solid #ddd; border-radius: 4px; }
+        button { padding: 10px 20px; background: #007bff; color: white; border: none; border-radius: 4px; cursor: pointer; }
+        .error { color: #c00; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>🤖 AI Content Automator</h1>
+        {{MESSAGE}}
+        <form method="POST" action="/login">
+            <input type="hidden" name="csrf_token" value="{{CSRF_TOKEN}}" />
+            <input type="text" name="username" placeholder="Username" autofocus required />
+            <input type="password" name="password" placeholder="Password" required />
+            <button type="submit">Log in</button>
+        </form>
+    </div>
+</body>
+</html>`
+
 func dashboardHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Dashboard requested")
+	session, user, err := sessionFromRequest(r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 	
 	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(`<!DOCTYPE html>
+	w.Write([]byte(strings.NewReplacer(
+		"{{CSRF_TOKEN}}", session.CSRFToken,
+		"{{USERNAME}}", html.EscapeString(user.Username),
+		"{{ROLE}}", user.Role,
+		"{{PRIORITY_OPTIONS}}", priorityOptions(user.Role),
+	).Replace(dashboardHTML)))
+}
+
+// priorityOptions are the dashboard's choices above the default priority,
+// which only admins may set
+func priorityOptions(role string) string {
+	if role != RoleAdmin {
+		return ""
+	}
+	return `
+                <option value="5">High priority</option>
+                <option value="10">Urgent</option>`
+}
+
+const dashboardHTML = `<!DOCTYPE html>
 <html>
 <head>
     <title>AI Content Automator</title>
@@ -137,16 +888,27 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
         .container { max-width: 800px; margin: 0 auto; }
         button { padding: 10px 20px; margin: 10px; background: #007bff; color: white; border: none; border-radius: 4px; cursor: pointer; }
         input { padding: 10px; margin: 10px; width: 300px; border: 1px solid #ddd; border-radius: 4px; }
+        select { padding: 10px; margin: 10px; border: 1px solid #ddd; border-radius: 4px; }
         .job { background: #f8f9fa; padding: 15px; margin: 10px 0; border-radius: 4px; }
+        .seo { margin-top: 8px; font-size: 0.9em; color: #555; }
     </style>
 </head>
 <body>
     <div class="container">
         <h1>🤖 AI Content Automator</h1>
         
+        <form method="POST" action="/logout">
+            Logged in as <strong>{{USERNAME}}</strong> ({{ROLE}})
+            <input type="hidden" name="csrf_token" value="{{CSRF_TOKEN}}" />
+            <button type="submit">Log out</button>
+        </form>
+        
         <div>
             <h3>Create New Job</h3>
             <input type="text" id="topic" placeholder="Enter topic..." />
+            <select id="priority">
+                <option value="0">Normal priority</option>{{PRIORITY_OPTIONS}}
+            </select>
             <button onclick="createJob()">Create Job</button>
             <button onclick="processJobs()">Process All</button>
             <button onclick="loadJobs()">Refresh</button>
@@ -156,15 +918,24 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
     </div>
     
     <script>
+        const csrfToken = '{{CSRF_TOKEN}}';
+        
+        function api(path, options = {}) {
+            options.headers = Object.assign({}, options.headers, { 'X-CSRF-Token': csrfToken });
+            options.credentials = 'same-origin';
+            return fetch(path, options);
+        }
+        
         async function createJob() {
             const topic = document.getElementById('topic').value;
+            const priority = parseInt(document.getElementById('priority').value, 10);
             if (!topic) return alert('Enter a topic');
             
             try {
-                const response = await fetch('/api/jobs', {
+                const response = await api('/api/jobs', {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ topic, type: 'blog' })
+                    body: JSON.stringify({ topic, type: 'blog', priority })
                 });
                 const data = await response.json();
                 if (data.success) {
@@ -180,23 +951,49 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
         
         async function processJobs() {
             try {
-                await fetch('/api/process', { method: 'POST' });
+                await api('/api/process', { method: 'POST' });
                 setTimeout(loadJobs, 2000);
             } catch (e) {
                 alert('Failed to process jobs');
             }
         }
         
+        // esc makes a value safe to place in HTML. Topics and outputs come
+        // from other users and the model, so every value is escaped.
+        function esc(value) {
+            return String(value).replace(/[&<>"']/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'}[c]));
+        }
+
+        function seoSummary(seo) {
+            if (!seo) return '';
+            const issues = [].concat(seo.checks.keyword_density.issues || [], seo.checks.heading_hierarchy.issues || [], seo.checks.readability.issues || [], seo.checks.length.issues || []);
+            return '<div class="seo"><strong>SEO ' + esc(seo.score) + '/100</strong> | ' + esc(seo.meta_title) + ' | /' + esc(seo.slug) +
+                '<br>Keywords: ' + esc(seo.keywords.join(', ')) + (issues.length ? '<br>Issues: ' + esc(issues.join('; ')) : '') + '</div>';
+        }
+
+        function readabilitySummary(r) {
+            if (!r) return '';
+            return '<div class="seo">Reading ease ' + esc(r.reading_ease) + ' | Grade ' + esc(r.grade_level) + ' | ' + esc(r.avg_sentence_length) + ' words/sentence | Passive ' + esc(Math.round(r.passive_ratio * 100)) + '% | Diversity ' + esc(r.lexical_diversity) + '</div>';
+        }
+
+        function qualitySummary(quality) {
+            if (!quality || quality.passed) return '';
+            const failed = quality.checks.filter(c => !c.passed).map(c => esc(c.name + (c.detail ? ': ' + c.detail : '')));
+            return '<div class="seo"><strong>Quality checks failed</strong> (retries: ' + esc(quality.retries) + ')<br>' + failed.join('<br>') + '</div>';
+        }
+
         async function loadJobs() {
             try {
-                const response = await fetch('/api/jobs');
+                const response = await api('/api/jobs');
                 const data = await response.json();
                 if (data.success) {
                     const jobsDiv = document.getElementById('jobs');
-                    jobsDiv.innerHTML = '<h3>Jobs (' + data.data.length + ')</h3>';
+                    jobsDiv.innerHTML = '<h3>Jobs (' + esc(data.data.length) + ')</h3>';
                     data.data.forEach(job => {
-                        jobsDiv.innerHTML += '<div class="job"><strong>#' + job.id + '</strong> - ' + job.topic + '<br><em>Status: ' + job.status + '</em><br>' + (job.output ? job.output.substring(0, 200) + '...' : 'No output yet') + '</div>';
+                        jobsDiv.innerHTML += '<div class="job"><strong>#' + esc(job.id) + '</strong> - ' + esc(job.topic) + '<br><em>Status: ' + esc(job.status) + ' | Priority: ' + esc(job.priority) + '</em><br>' + (job.output ? esc(job.output.substring(0, 200)) + '...' : 'No output yet') + readabilitySummary(job.readability) + seoSummary(job.seo) + qualitySummary(job.quality) + '</div>';
                     });
+                } else {
+                    document.getElementById('jobs').innerHTML = '<p>' + esc(data.error) + '</p>';
                 }
             } catch (e) {
                 document.getElementById('jobs').innerHTML = '<p>Error loading jobs</p>';
@@ -208,8 +1005,7 @@ func dashboardHandler(w http.ResponseWriter, r *http.Request) {
         loadJobs();
     </script>
 </body>
-</html>`))
-}
+</html>`
 
 func writeSuccessResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A client that sends an Idempotency-Key can safely retry a request: the
+// first response is stored, and any retry with the same key and body gets
+// that response back instead of creating another job.
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	maxIdempotencyKey = 255
+	// idempotencyTTL is how long a key and its response are kept
+	idempotencyTTL = 24 * time.Hour
+)
+
+// storedResponse is what an idempotency key holds. StatusCode is zero while
+// the first request is still running.
+type storedResponse struct {
+	RequestHash string
+	StatusCode  int
+	Body        []byte
+}
+
+// idempotencyOwner scopes keys to the caller, so two clients choosing the
+// same key never see each other's responses
+func idempotencyOwner(p *Principal) string {
+	if p.KeyID != 0 {
+		return fmt.Sprintf("key:%d", p.KeyID)
+	}
+	return fmt.Sprintf("user:%d", p.UserID)
+}
+
+// bodyRecorder keeps a copy of the response it passes on
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bodyRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// withIdempotency makes a handler honour the Idempotency-Key header.
+// Successful responses are stored and replayed with Idempotent-Replayed set;
+// failed ones are not, so the client can fix the request and retry with the
+// same key.
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeErrorResponse(w, fmt.Sprintf("%s must be at most %d characters", idempotencyHeader, maxIdempotencyKey), http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeErrorResponse(w, "Failed to read request", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		principal := principalFromContext(ctx)
+		owner := idempotencyOwner(principal)
+		hash := requestHash(r.Method, r.URL.Path, body)
+
+		stored, err := reserveIdempotencyKey(ctx, principal.WorkspaceID, owner, key, hash)
+		if err != nil {
+			loggerFrom(ctx).Error("error reserving idempotency key", "error", err)
+			writeErrorResponse(w, "Failed to process request", http.StatusInternalServerError)
+			return
+		}
+		if stored != nil {
+			switch {
+			case stored.RequestHash != hash:
+				writeErrorResponse(w, idempotencyHeader+" was already used for a different request", http.StatusUnprocessableEntity)
+			case stored.StatusCode == 0:
+				writeErrorResponse(w, "A request with this "+idempotencyHeader+" is still in progress", http.StatusConflict)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		saved := false
+		defer func() {
+			if !saved {
+				if err := releaseIdempotencyKey(context.Background(), principal.WorkspaceID, owner, key); err != nil {
+					loggerFrom(ctx).Error("error releasing idempotency key", "error", err)
+				}
+			}
+		}()
+		next(rec, r)
+		if rec.status < 200 || rec.status > 299 {
+			return
+		}
+		if err := completeIdempotencyKey(ctx, principal.WorkspaceID, owner, key, rec.status, rec.body.Bytes()); err != nil {
+			loggerFrom(ctx).Error("error storing idempotent response", "error", err)
+			return
+		}
+		saved = true
+	}
+}
+
+// requestHash identifies a request by method, path and body. JSON bodies
+// are compacted so whitespace does not matter.
+func requestHash(method, path string, body []byte) string {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, body); err == nil {
+		body = compact.Bytes()
+	}
+	sum := sha256.Sum256([]byte(method + " " + path + "\n" + string(body)))
+	return hex.EncodeToString(sum[:])
+}
+
+// reserveIdempotencyKey claims a key for a new request. If the key is
+// already taken it returns what the key holds instead.
+func reserveIdempotencyKey(ctx context.Context, workspaceID int, owner, key, hash string) (*storedResponse, error) {
+	now := time.Now()
+	if _, err := dbExec(ctx, "purgeIdempotencyKeys", `DELETE FROM idempotency_keys WHERE created_at < ?`, now.Add(-idempotencyTTL)); err != nil {
+		return nil, fmt.Errorf("failed to purge idempotency keys: %v", err)
+	}
+
+	result, err := dbExec(ctx, "reserveIdempotencyKey", `INSERT INTO idempotency_keys (workspace_id, owner, key, request_hash, created_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		workspaceID, owner, key, hash, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve idempotency key: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 1 {
+		return nil, nil
+	}
+
+	var stored storedResponse
+	var status sql.NullInt64
+	err = dbQueryRow(ctx, "getIdempotencyKey", `SELECT request_hash, status_code, COALESCE(response, '') FROM idempotency_keys WHERE workspace_id = ? AND owner = ? AND key = ?`,
+		workspaceID, owner, key).Scan(&stored.RequestHash, &status, &stored.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load idempotency key: %v", err)
+	}
+	stored.StatusCode = int(status.Int64)
+	return &stored, nil
+}
+
+func completeIdempotencyKey(ctx context.Context, workspaceID int, owner, key string, status int, body []byte) error {
+	_, err := dbExec(ctx, "completeIdempotencyKey", `UPDATE idempotency_keys SET status_code = ?, response = ? WHERE workspace_id = ? AND owner = ? AND key = ?`,
+		status, string(body), workspaceID, owner, key)
+	if err != nil {
+		return fmt.Errorf("failed to store idempotent response: %v", err)
+	}
+	return nil
+}
+
+func releaseIdempotencyKey(ctx context.Context, workspaceID int, owner, key string) error {
+	_, err := dbExec(ctx, "releaseIdempotencyKey", `DELETE FROM idempotency_keys WHERE workspace_id = ? AND owner = ? AND key = ? AND status_code IS NULL`,
+		workspaceID, owner, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %v", err)
+	}
+	return nil
+}
+
+// dedupeHash identifies what a job would generate: its type, topic, model,
+// source and parameters, with the topic's case and spacing and the order
+// of keywords ignored
+func dedupeHash(req CreateJobRequest) string {
+	jobType := req.Type
+	if jobType == "" {
+		jobType = "blog"
+	}
+	params := req.Params
+	params.Language = strings.ToLower(params.Language)
+	params.Keywords = make([]string, len(req.Params.Keywords))
+	for i, k := range req.Params.Keywords {
+		params.Keywords[i] = strings.ToLower(strings.TrimSpace(k))
+	}
+	sort.Strings(params.Keywords)
+
+	data, _ := json.Marshal(struct {
+		Type        string           `json:"type"`
+		Topic       string           `json:"topic"`
+		Model       string           `json:"model"`
+		SourceJobID *int             `json:"source_job_id"`
+		Params      GenerationParams `json:"params"`
+	}{jobType, strings.Join(strings.Fields(strings.ToLower(req.Topic)), " "), req.Model, req.SourceJobID, params})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// languageNames are the languages prompts name in full. Other tags are
+// passed to the model as they are.
+var languageNames = map[string]string{
+	"en": "English", "es": "Spanish", "fr": "French", "de": "German",
+	"pt": "Portuguese", "it": "Italian", "nl": "Dutch", "ru": "Russian",
+	"ja": "Japanese", "ko": "Korean", "zh": "Chinese", "ar": "Arabic",
+	"el": "Greek", "he": "Hebrew", "hi": "Hindi", "th": "Thai",
+	"pl": "Polish", "sv": "Swedish", "tr": "Turkish", "uk": "Ukrainian",
+}
+
+// baseLanguage reduces a tag like pt-BR to its language, pt
+func baseLanguage(tag string) string {
+	base, _, _ := strings.Cut(tag, "-")
+	return strings.ToLower(base)
+}
+
+// languageName describes a tag for a prompt, like "Portuguese (pt-BR)"
+func languageName(tag string) string {
+	if tag == "" {
+		return ""
+	}
+	if name, ok := languageNames[baseLanguage(tag)]; ok {
+		return name + " (" + tag + ")"
+	}
+	return tag
+}
+
+// Languages written in the Latin alphabet are told apart by their most
+// common words
+var stopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "for", "with", "as", "are", "this", "be", "on", "by", "can", "your"},
+	"es": {"el", "la", "de", "que", "y", "en", "los", "las", "es", "por", "con", "para", "una", "del", "se", "su", "como", "más"},
+	"fr": {"le", "la", "les", "de", "des", "et", "est", "en", "un", "une", "du", "que", "pour", "dans", "qui", "sur", "avec", "sont"},
+	"de": {"der", "die", "das", "und", "ist", "zu", "den", "von", "mit", "ein", "eine", "für", "auf", "nicht", "sich", "des", "im", "werden"},
+	"pt": {"o", "a", "de", "que", "e", "do", "da", "em", "um", "uma", "para", "com", "os", "as", "não", "no", "na", "dos"},
+	"it": {"il", "la", "di", "che", "e", "è", "un", "una", "per", "con", "del", "della", "sono", "nel", "gli", "le", "si", "non"},
+	"nl": {"de", "het", "een", "van", "en", "is", "dat", "op", "te", "zijn", "voor", "met", "niet", "die", "ook", "worden", "aan", "om"},
+}
+
+var stopwordSets = func() map[string]map[string]bool {
+	sets := make(map[string]map[string]bool, len(stopwords))
+	for lang, words := range stopwords {
+		sets[lang] = make(map[string]bool, len(words))
+		for _, w := range words {
+			sets[lang][w] = true
+		}
+	}
+	return sets
+}()
+
+// scriptLanguages are detected by their writing system
+var scriptLanguages = []struct {
+	lang   string
+	script *unicode.RangeTable
+}{
+	{"ja", unicode.Hiragana},
+	{"ja", unicode.Katakana},
+	{"ko", unicode.Hangul},
+	{"zh", unicode.Han},
+	{"ru", unicode.Cyrillic},
+	{"ar", unicode.Arabic},
+	{"el", unicode.Greek},
+	{"he", unicode.Hebrew},
+	{"hi", unicode.Devanagari},
+	{"th", unicode.Thai},
+}
+
+const (
+	// minDetectionWords is the least text detection will judge
+	minDetectionWords = 20
+	// minStopwordShare is how much of the text the winning language's
+	// stopwords must make up
+	minStopwordShare = 0.08
+)
+
+// detectLanguage names the language text is written in, or returns "" when
+// it cannot tell
+func detectLanguage(text string) string {
+	letters := 0
+	byScript := make(map[string]int)
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, s := range scriptLanguages {
+			if unicode.Is(s.script, r) {
+				byScript[s.lang]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	// Japanese mixes kana with kanji; any kana decides it
+	if byScript["ja"] > letters/20 {
+		return "ja"
+	}
+	for _, s := range scriptLanguages {
+		if byScript[s.lang] > letters/2 {
+			return s.lang
+		}
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	if len(words) < minDetectionWords {
+		return ""
+	}
+	best, bestCount := "", 0
+	for lang, set := range stopwordSets {
+		count := 0
+		for _, w := range words {
+			if set[w] {
+				count++
+			}
+		}
+		if count > bestCount || (count == bestCount && lang < best) {
+			best, bestCount = lang, count
+		}
+	}
+	if float64(bestCount)/float64(len(words)) < minStopwordShare {
+		return ""
+	}
+	return best
+}
+
+// detectableLanguage reports whether detectLanguage can recognise a
+// language, so output in it can be checked
+func detectableLanguage(tag string) bool {
+	base := baseLanguage(tag)
+	if _, ok := stopwords[base]; ok {
+		return true
+	}
+	for _, s := range scriptLanguages {
+		if s.lang == base {
+			return true
+		}
+	}
+	return false
+}
@@ -1,169 +1,225 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type LLMGenerator struct {
-	modelPath string
+	modelPath  string
+	backend    string
+	backendURL string
+	client     *http.Client
+	// usedBackend and usedURL name the backend that produced the last
+	// content, which differs from backend and backendURL when the
+	// llama-server failed and a fallback took over
+	usedBackend string
+	usedURL     string
 }
 
-func NewLLMGenerator() *LLMGenerator {
-	modelPath := findModel()
-	return &LLMGenerator{modelPath: modelPath}
+// llamaServer is one llama-server in a generator's chain
+type llamaServer struct {
+	URL     string
+	Timeout time.Duration
 }
 
-func findModel() string {
-	// Try multiple possible paths
-	possiblePaths := []string{
-		"../python-worker/models",
-		"python-worker/models", 
-		"./python-worker/models",
-		"models",
-	}
-	
-	for _, modelsDir := range possiblePaths {
-		if _, err := os.Stat(modelsDir); os.IsNotExist(err) {
-			continue
-		}
+// NewWorkspaceGenerator builds a generator from a workspace's model and
+// backend settings, falling back to the instance default model when none
+// is set.
+func NewWorkspaceGenerator(ws *Workspace) *LLMGenerator {
+	modelPath := ws.ModelPath
+	if modelPath == "" {
+		modelPath = findModel()
+	}
+	backendURL := ws.BackendURL
+	if backendURL == "" {
+		backendURL = cfg.Generator.BackendURL
+	}
+	return &LLMGenerator{
+		modelPath:  modelPath,
+		backend:    ws.Backend,
+		backendURL: strings.TrimRight(backendURL, "/"),
+		client:     &http.Client{},
+	}
+}
 
-		files, err := os.ReadDir(modelsDir)
-		if err != nil {
+// chain lists the llama-servers to try in order: the workspace's own, then
+// generator.fallbacks. The local backend comes after them all.
+func (g *LLMGenerator) chain() []llamaServer {
+	servers := []llamaServer{{URL: g.backendURL, Timeout: cfg.Generator.Timeout}}
+	for _, f := range cfg.Generator.Fallbacks {
+		url := strings.TrimRight(f.URL, "/")
+		if url == g.backendURL {
 			continue
 		}
-
-		for _, file := range files {
-			if !file.IsDir() {
-				name := strings.ToLower(file.Name())
-				if strings.HasSuffix(name, ".gguf") || strings.HasSuffix(name, ".ggml") {
-					return filepath.Join(modelsDir, file.Name())
-				}
-			}
+		timeout := f.Timeout
+		if timeout == 0 {
+			timeout = cfg.Generator.Timeout
 		}
+		servers = append(servers, llamaServer{URL: url, Timeout: timeout})
 	}
-	return ""
+	return servers
 }
 
-func (g *LLMGenerator) GenerateContent(topic string) string {
-	// Always generate content - enhanced version if model available, fallback otherwise
-	if g.modelPath != "" {
-		return g.enhancedGeneration(topic)
+const builtinPromptTemplate = `Write a blog article about: {{topic}}`
+
+// renderPrompt fills in the workspace's template for the job type, or the
+// configured generator.prompt_template file when the workspace has none,
+// with the job's topic and parameters.
+func renderPrompt(ctx context.Context, workspaceID int, jobType, topic string, params GenerationParams) string {
+	template, err := getPromptTemplate(workspaceID, jobType)
+	if err != nil {
+		loggerFrom(ctx).Error("failed to load workspace prompt template", "workspace_id", workspaceID, "error", err)
 	}
-	return g.fallbackGeneration(topic)
+	if template == "" {
+		template = defaultPromptTemplate(ctx)
+	}
+	return applyParams(template, topic, params)
 }
 
-func (g *LLMGenerator) enhancedGeneration(topic string) string {
-	return fmt.Sprintf(`## OUTLINE
-- Introduction to %s
-- Core concepts and fundamentals  
-- Practical applications and use cases
-- Benefits and advantages
-- Implementation strategies
-- Future outlook and trends
-- Conclusion and key takeaways
-
-## ARTICLE
-
-# Understanding %s: A Comprehensive Guide
-
-%s represents a significant area of interest in today's rapidly evolving landscape. This comprehensive guide explores the essential aspects, practical applications, and future implications of %s.
-
-## Core Concepts and Fundamentals
-
-At its foundation, %s encompasses several key principles that form the backbone of understanding. These fundamental concepts provide the necessary framework for deeper exploration and practical application.
-
-The primary elements include:
-- Theoretical foundations and underlying principles
-- Historical context and evolution
-- Current state and recent developments
-- Key terminology and definitions
-
-## Practical Applications and Use Cases
-
-%s finds application across numerous domains and industries. Real-world implementations demonstrate its versatility and effectiveness in solving complex challenges.
-
-Common applications include:
-- Industry-specific solutions and implementations
-- Cross-functional integration opportunities
-- Scalable deployment strategies
-- Performance optimization techniques
-
-## Benefits and Advantages
-
-The adoption of %s brings numerous advantages:
-
-**Efficiency Improvements**: Streamlined processes and reduced complexity lead to significant efficiency gains.
-
-**Cost Effectiveness**: Strategic implementation often results in substantial cost savings and resource optimization.
-
-**Scalability**: Solutions built around %s principles typically offer excellent scalability characteristics.
-
-**Innovation Potential**: Opens new avenues for creative problem-solving and innovative approaches.
-
-## Implementation Strategies
-
-Successful implementation requires careful planning and strategic approach:
-
-1. **Assessment Phase**: Evaluate current state and identify opportunities
-2. **Planning Phase**: Develop comprehensive implementation roadmap
-3. **Execution Phase**: Deploy solutions with proper monitoring
-4. **Optimization Phase**: Continuous improvement and refinement
-
-## Future Outlook and Trends
-
-The future of %s looks promising with several emerging trends:
-- Technological advancements driving new possibilities
-- Increased adoption across various sectors
-- Integration with complementary technologies
-- Evolution of best practices and methodologies
-
-## Conclusion and Key Takeaways
-
-%s represents a valuable domain with significant potential for impact and growth. Understanding its core principles, applications, and implementation strategies is crucial for leveraging its full potential.
-
-Key takeaways include:
-- Comprehensive understanding enables better decision-making
-- Practical application requires strategic planning
-- Continuous learning and adaptation are essential
-- Future opportunities are abundant for early adopters
-
-*Generated using enhanced content generation with local model: %s*`, 
-		topic, topic, topic, topic, topic, topic, topic, topic, topic, filepath.Base(g.modelPath))
+func defaultPromptTemplate(ctx context.Context) string {
+	data, err := os.ReadFile(cfg.Generator.PromptTemplate)
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to read prompt template, using built-in prompt", "path", cfg.Generator.PromptTemplate, "error", err)
+		return builtinPromptTemplate
+	}
+	return string(data)
 }
 
-func (g *LLMGenerator) fallbackGeneration(topic string) string {
-	return fmt.Sprintf(`## OUTLINE
-- Introduction to %s
-- Key aspects and importance
-- Practical applications
-- Benefits and considerations
-- Conclusion and next steps
-
-## ARTICLE
-
-# Understanding %s
-
-%s is an important subject that deserves our attention and understanding. In today's rapidly evolving world, having knowledge about %s can provide significant advantages and insights.
+func (g *LLMGenerator) GenerateContent(ctx context.Context, topic, prompt string, params GenerationParams) string {
+	if g.backend == BackendLlamaServer {
+		content, err := g.onChain(ctx, func(ctx context.Context, url string) (string, error) {
+			return g.complete(ctx, url, topic, prompt, params)
+		})
+		if err == nil {
+			return content
+		}
+		if ctx.Err() != nil {
+			// The job was abandoned; nothing is to be recorded
+			return ""
+		}
+		loggerFrom(ctx).Warn("no llama-server produced content, using local generation", "error", err)
+	}
+	return g.localGeneration(ctx, topic, params)
+}
 
-## Key Aspects
+// localGeneration writes the article with the local backend
+func (g *LLMGenerator) localGeneration(ctx context.Context, topic string, params GenerationParams) string {
+	model := modelLabel(g.modelPath)
+	g.usedBackend, g.usedURL = BackendLocal, ""
+	_, span := g.startSpan(ctx, BackendLocal)
+	start := time.Now()
+	defer func() {
+		generationDuration.WithLabelValues(BackendLocal, model).Observe(time.Since(start).Seconds())
+		span.End()
+	}()
 
-When exploring %s, several key aspects emerge that are worth considering. These elements form the foundation of our understanding and help us appreciate the complexity and nuance involved.
+	// Always generate content - enhanced version if model available, fallback otherwise
+	if params.Language != "" && !hasLocalizedArticle(params.Language) {
+		loggerFrom(ctx).Warn("no built-in article in this language, using English", "language", params.Language)
+	}
+	return localizedArticle(params.Language, topic, filepath.Base(g.modelPath), g.modelPath != "")
+}
 
-## Practical Applications
+// onChain runs call on the first llama-server in the chain that succeeds,
+// skipping those with an open circuit
+func (g *LLMGenerator) onChain(ctx context.Context, call func(ctx context.Context, url string) (string, error)) (string, error) {
+	model := modelLabel(g.modelPath)
+	lastErr := fmt.Errorf("every llama-server has an open circuit")
+	for _, server := range g.chain() {
+		breaker := backendBreaker(server.URL)
+		if !breaker.allow() {
+			loggerFrom(ctx).Debug("skipping llama-server with open circuit", "backend_url", server.URL)
+			continue
+		}
+		spanCtx, span := g.startSpan(ctx, BackendLlamaServer)
+		span.SetAttributes(attribute.String("generator.backend_url", server.URL))
+		callCtx, cancel := context.WithTimeout(spanCtx, server.Timeout)
+		start := time.Now()
+		content, err := call(callCtx, server.URL)
+		cancel()
+		generationDuration.WithLabelValues(BackendLlamaServer, model).Observe(time.Since(start).Seconds())
+		recordError(span, err)
+		span.End()
+		if ctx.Err() != nil {
+			// The job was cancelled; the backend is not to blame
+			breaker.release()
+			return "", ctx.Err()
+		}
+		breaker.record(ctx, err)
+		if err == nil {
+			g.usedBackend, g.usedURL = BackendLlamaServer, server.URL
+			return content, nil
+		}
+		loggerFrom(ctx).Warn("llama-server failed, trying the next backend", "backend_url", server.URL, "error", err)
+		reportError(ComponentGenerator, err)
+		lastErr = err
+	}
+	return "", lastErr
+}
 
-The practical applications of %s are numerous and varied. From everyday situations to professional environments, the principles and concepts related to %s can be applied in meaningful ways.
+func (g *LLMGenerator) startSpan(ctx context.Context, backend string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "generate "+backend, trace.WithAttributes(
+		attribute.String("generator.backend", backend),
+		attribute.String("generator.model", modelLabel(g.modelPath)),
+	))
+}
 
-## Benefits and Considerations
+// llamaServerGeneration calls the /completion endpoint of a llama.cpp server,
+// passing the trace on so the server's spans join it
+func (g *LLMGenerator) llamaServerGeneration(ctx context.Context, url, prompt string, params GenerationParams) (string, error) {
+	request := map[string]interface{}{
+		"prompt":    prompt,
+		"n_predict": params.tokenLimit(),
+		"stop":      []string{"</s>", "[INST]", "[/INST]"},
+	}
+	if params.Temperature != nil {
+		request["temperature"] = *params.Temperature
+	}
+	if params.Seed != nil {
+		request["seed"] = *params.Seed
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode request: %v", err)
+	}
 
-Understanding %s brings several benefits, including improved decision-making, better problem-solving capabilities, and enhanced perspective on related matters. However, it's also important to consider potential challenges and limitations.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url+"/completion", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
 
-## Conclusion
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
 
-In conclusion, %s represents a valuable area of knowledge that can enrich our understanding and provide practical benefits. By continuing to explore and learn about %s, we can develop a more comprehensive and nuanced perspective.
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
 
-*Generated using fallback content generation*`, 
-		topic, topic, topic, topic, topic, topic, topic, topic, topic)
+	var result struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode response: %v", err)
+	}
+	if strings.TrimSpace(result.Content) == "" {
+		return "", fmt.Errorf("empty completion")
+	}
+	return strings.TrimSpace(result.Content), nil
 }
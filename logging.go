@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const loggerContextKey contextKey = "logger"
+
+// initLogging makes slog the process-wide logger. Output from the standard
+// log package goes through it too.
+func initLogging(c LogConfig) error {
+	handler, err := newLogHandler(os.Stderr, c)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func newLogHandler(w io.Writer, c LogConfig) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", c.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(c.Format) {
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", c.Format)
+	}
+}
+
+// loggerFrom returns the logger carried by ctx, which holds the request or
+// job attributes, or the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+// withLogAttrs adds attributes to the logger carried by ctx
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	return withLogger(ctx, loggerFrom(ctx).With(args...))
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// A caller's request ID is kept only if it is short and plain, since it
+// ends up in every log line for the request
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware tags each request with an ID, taken from the
+// X-Request-ID header when the caller sent one, echoes it in the response,
+// and logs the request when it completes.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			if id, err = randomToken(8); err != nil {
+				id = "unknown"
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := withLogAttrs(r.Context(), "request_id", id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		loggerFrom(ctx).Debug("request handled", "method", r.Method, "path", r.URL.Path, "status", rec.status)
+	})
+}
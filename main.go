@@ -1,9 +1,16 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -11,68 +18,211 @@ import (
 var worker *ContentWorker
 
 func main() {
+	if err := runCommand(os.Args[1:]); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// openStore applies the loaded configuration and opens the database. Callers
+// must call closeStore when done.
+func openStore(loaded *Config) error {
+	cfg = loaded
+	if err := initLogging(cfg.Log); err != nil {
+		return err
+	}
+	initRateLimiters()
+
+	shutdown, err := initTracing(cfg.Tracing)
+	if err != nil {
+		return err
+	}
+	shutdownTracing = shutdown
+
 	// Create db directory if it doesn't exist
-	if err := os.MkdirAll("../db", 0755); err != nil {
-		log.Fatalf("Failed to create db directory: %v", err)
+	if err := os.MkdirAll(cfg.dbDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create db directory: %v", err)
 	}
 
 	// Initialize database
 	if err := initDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		return fmt.Errorf("failed to initialize database: %v", err)
 	}
-	defer db.Close()
+	return nil
+}
 
-	// Start content worker
-	worker = NewContentWorker()
-	worker.Start()
-	defer worker.Stop()
+// shutdownTracing flushes spans not yet exported
+var shutdownTracing = func(context.Context) error { return nil }
 
-	// Setup routes
-	r := mux.NewRouter()
-	
-	// API routes - direct paths
-	r.HandleFunc("/api/jobs", getJobsHandler).Methods("GET")
-	r.HandleFunc("/api/jobs", createJobHandler).Methods("POST")
-	r.HandleFunc("/api/job/{id}", getJobHandler).Methods("GET")
-	r.HandleFunc("/api/job/{id}", deleteJobHandler).Methods("DELETE")
-	r.HandleFunc("/api/process", processJobsHandler).Methods("POST")
-	r.HandleFunc("/api/model-status", modelStatusHandler).Methods("GET")
-	
-	// Dashboard route
-	r.HandleFunc("/", dashboardHandler).Methods("GET")
-	
-	// Add CORS middleware
-	r.Use(corsMiddleware)
+// closeStore undoes openStore
+func closeStore() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
+	db.Close()
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	loaded, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	return serve(loaded)
+}
+
+// serve runs the API, the worker or both, as loaded.Mode says. Processes
+// in different modes coordinate only through the database.
+func serve(loaded *Config) error {
+	if err := openStore(loaded); err != nil {
+		return err
+	}
+	defer closeStore()
 
-	log.Println("Server starting on :8080")
-	log.Println("Dashboard: http://localhost:8080")
-	log.Println("API: http://localhost:8080/api/jobs")
+	slog.Info("starting", "mode", cfg.Mode)
+	if cfg.Server.MetricsAddr != "" {
+		go serveMetrics(cfg.Server.MetricsAddr)
+	}
 	
 	// Check for model
-	if modelPath := findModel(); modelPath != "" {
-		log.Printf("Local model detected: %s", modelPath)
-	} else {
-		log.Println("No local model found - using enhanced fallback generation")
+	if cfg.Mode != ModeAPI {
+		logModels()
+	}
+
+	if cfg.Mode == ModeWorker {
+		worker = NewContentWorker()
+		worker.Start()
+		<-stopSignal()
+		worker.Stop()
+		return nil
+	}
+
+	if err := ensureBootstrapKey(); err != nil {
+		return fmt.Errorf("failed to bootstrap API keys: %v", err)
 	}
+	if err := ensureBootstrapAdmin(); err != nil {
+		return fmt.Errorf("failed to bootstrap admin user: %v", err)
+	}
+
+	// Start content worker
+	if cfg.Mode == ModeCombined {
+		worker = NewContentWorker()
+		worker.Start()
+		defer worker.Stop()
+	}
+
+	r := newRouter()
+
+	slog.Info("server starting", "addr", cfg.Server.Addr,
+		"dashboard", "http://"+displayAddr(cfg.Server.Addr),
+		"api", "http://"+displayAddr(cfg.Server.Addr)+"/api/jobs")
 	
 	// Log all routes for debugging
 	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 		pathTemplate, _ := route.GetPathTemplate()
 		methods, _ := route.GetMethods()
-		log.Printf("Route: %s %v", pathTemplate, methods)
+		slog.Debug("route", "path", pathTemplate, "methods", methods)
 		return nil
 	})
 	
-	if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	// Shut down cleanly on a signal so deferred cleanup, like flushing
+	// traces, gets to run
+	srv := &http.Server{Addr: cfg.Server.Addr, Handler: r}
+	go func() {
+		<-stopSignal()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("server failed to start: %v", err)
 	}
+	return nil
+}
+
+func stopSignal() <-chan os.Signal {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	return stop
+}
+
+func newRouter() *mux.Router {
+	// Setup routes
+	r := mux.NewRouter()
+	
+	// API routes - every one requires an API key with the listed scope
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(authMiddleware, rateLimitMiddleware)
+	api.HandleFunc("/jobs", requireScope(ScopeJobsRead, getJobsHandler)).Methods("GET")
+	api.HandleFunc("/jobs", requireScope(ScopeJobsWrite, withIdempotency(createJobHandler))).Methods("POST")
+	api.HandleFunc("/job/{id}", requireScope(ScopeJobsRead, getJobHandler)).Methods("GET")
+	api.HandleFunc("/job/{id}", requireScope(ScopeJobsWrite, deleteJobHandler)).Methods("DELETE")
+	api.HandleFunc("/job/{id}/translations", requireScope(ScopeJobsRead, listTranslationsHandler)).Methods("GET")
+	api.HandleFunc("/job/{id}/similar", requireScope(ScopeJobsRead, similarJobsHandler)).Methods("GET")
+	api.HandleFunc("/job/{id}/steps", requireScope(ScopeJobsRead, jobStepsHandler)).Methods("GET")
+	api.HandleFunc("/job/{id}/approve", requireScope(ScopeJobsWrite, approveJobHandler)).Methods("POST")
+	api.HandleFunc("/process", requireScope(ScopeJobsWrite, processJobsHandler)).Methods("POST")
+	api.HandleFunc("/model-status", requireScope(ScopeJobsRead, modelStatusHandler)).Methods("GET")
+	api.HandleFunc("/models", requireScope(ScopeJobsRead, listModelsHandler)).Methods("GET")
+	api.HandleFunc("/usage", requireScope(ScopeJobsRead, usageHandler)).Methods("GET")
+
+	// Admin routes
+	api.HandleFunc("/admin/keys", requireScope(ScopeAdmin, listAPIKeysHandler)).Methods("GET")
+	api.HandleFunc("/admin/keys", requireScope(ScopeAdmin, createAPIKeyHandler)).Methods("POST")
+	api.HandleFunc("/admin/keys/{id}", requireScope(ScopeAdmin, revokeAPIKeyHandler)).Methods("DELETE")
+	api.HandleFunc("/admin/users", requireScope(ScopeAdmin, listUsersHandler)).Methods("GET")
+	api.HandleFunc("/admin/users", requireScope(ScopeAdmin, createUserHandler)).Methods("POST")
+	api.HandleFunc("/admin/templates", requireScope(ScopeAdmin, listTemplatesHandler)).Methods("GET")
+	api.HandleFunc("/admin/templates/{type}", requireScope(ScopeAdmin, saveTemplateHandler)).Methods("PUT")
+
+	// Instance admin routes
+	api.HandleFunc("/status", requireInstanceAdmin(statusHandler)).Methods("GET")
+	api.HandleFunc("/models/default", requireInstanceAdmin(setDefaultModelHandler)).Methods("PUT")
+	api.HandleFunc("/admin/workspaces", requireInstanceAdmin(listWorkspacesHandler)).Methods("GET")
+	api.HandleFunc("/admin/workspaces", requireInstanceAdmin(createWorkspaceHandler)).Methods("POST")
+	api.HandleFunc("/admin/workspaces/{id}", requireInstanceAdmin(updateWorkspaceHandler)).Methods("PUT")
+	
+	// Probes
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET")
+
+	// Dashboard routes
+	r.HandleFunc("/", dashboardHandler).Methods("GET")
+	r.HandleFunc("/login", loginPageHandler).Methods("GET")
+	r.HandleFunc("/login", loginHandler).Methods("POST")
+	r.HandleFunc("/logout", logoutHandler).Methods("POST")
+	
+	// Metrics stay on the main router unless they have a listener of their own
+	if cfg.Server.MetricsAddr == "" {
+		r.Handle("/metrics", metricsHandler()).Methods("GET")
+	}
+
+	// Add request ID, tracing, CORS and metrics middleware
+	r.Use(requestIDMiddleware, tracingMiddleware, corsMiddleware, metricsMiddleware)
+
+	return r
+}
+
+// displayAddr turns a listen address like ":8080" into something browsable
+func displayAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "localhost" + addr
+	}
+	return addr
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
+	origins := allowedOrigins()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		if origin := r.Header.Get("Origin"); origin != "" && (origins[origin] || origins["*"]) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-CSRF-Token")
+		}
 		
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
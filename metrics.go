@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	jobsCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "acg_jobs_created_total",
+		Help: "Jobs created, by content type.",
+	}, []string{"type"})
+
+	jobsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "acg_jobs_finished_total",
+		Help: "Jobs finished by this process, by content type and final status (completed, failed or needs_review).",
+	}, []string{"type", "status"})
+
+	generationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "acg_generation_duration_seconds",
+		Help:    "Time spent generating content, by backend and model.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600},
+	}, []string{"backend", "model"})
+
+	tokensGenerated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "acg_tokens_generated_total",
+		Help: "Estimated tokens generated, by content type.",
+	}, []string{"type"})
+
+	qualityCheckFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "acg_quality_check_failures_total",
+		Help: "Generated outputs that failed a quality check, by check.",
+	}, []string{"check"})
+
+	generationCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "acg_generation_cache_requests_total",
+		Help: "Generations looked up in the cache, by result: hit, miss or bypass.",
+	}, []string{"result"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "acg_http_requests_total",
+		Help: "HTTP requests, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "acg_http_request_duration_seconds",
+		Help:    "HTTP request latency, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	backendCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "acg_backend_circuit_state",
+		Help: "Circuit breaker state of each llama-server in this process: 0 closed, 1 half open, 2 open.",
+	}, []string{"backend"})
+
+	workerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "acg_workers",
+		Help: "Workers in this process, by state (busy or idle).",
+	}, []string{"state"})
+)
+
+func init() {
+	prometheus.MustRegister(queueCollector{})
+}
+
+// queueCollector reports the queue depth from the job store at scrape time,
+// so every process sees the same numbers whichever one is scraped.
+type queueCollector struct{}
+
+var queueDepthDesc = prometheus.NewDesc("acg_jobs", "Jobs in the store, by status.", []string{"status"}, nil)
+
+func (queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (queueCollector) Collect(ch chan<- prometheus.Metric) {
+	if db == nil {
+		return
+	}
+	counts, err := jobCountsByStatus(context.Background())
+	if err != nil {
+		slog.Error("failed to count jobs for metrics", "error", err)
+		return
+	}
+	for status, n := range counts {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(n), status)
+	}
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder captures the status code a handler writes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// metricsMiddleware counts and times requests by route template, not raw
+// path, so /api/job/{id} stays one series.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// modelLabel keeps the model label short and bounded
+func modelLabel(modelPath string) string {
+	if modelPath == "" {
+		return "none"
+	}
+	return filepath.Base(modelPath)
+}
+
+// serveMetrics serves /metrics, and the /healthz and /readyz probes, on
+// their own listener, for worker-only processes and deployments that keep
+// them off the public address.
+func serveMetrics(addr string) {
+	m := http.NewServeMux()
+	m.Handle("/metrics", metricsHandler())
+	m.HandleFunc("/healthz", healthzHandler)
+	m.HandleFunc("/readyz", readyzHandler)
+	slog.Info("serving metrics", "url", "http://"+displayAddr(addr)+"/metrics")
+	if err := http.ListenAndServe(addr, m); err != nil {
+		slog.Error("metrics server failed", "error", err)
+	}
+}
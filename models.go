@@ -5,22 +5,245 @@ import (
 )
 
 type Job struct {
-	ID        int       `json:"id"`
-	Topic     string    `json:"topic"`
-	Type      string    `json:"type"`
-	Status    string    `json:"status"`
-	Output    string    `json:"output"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID          int    `json:"id"`
+	WorkspaceID int    `json:"workspace_id"`
+	Topic       string `json:"topic"`
+	Type        string `json:"type"`
+	Status      string `json:"status"`
+	Output      string `json:"output"`
+	Priority    int    `json:"priority"`
+	ClientID    string `json:"client_id"`
+	APIKeyID    *int   `json:"api_key_id,omitempty"`
+	UserID      *int   `json:"user_id,omitempty"`
+	TokensUsed  int    `json:"tokens_used"`
+	// ClaimedBy is the worker processing the job, or that last processed it
+	ClaimedBy string `json:"claimed_by,omitempty"`
+	// Attempts counts how many times a worker has claimed the job
+	Attempts int `json:"attempts"`
+	// TraceParent is the W3C traceparent of the request that created the job
+	TraceParent string `json:"trace_parent,omitempty"`
+	// Model is the model file the job asked for; empty means the
+	// workspace's model or the instance default
+	Model  string           `json:"model,omitempty"`
+	Params GenerationParams `json:"params"`
+	// SourceJobID is the job a translate job translates
+	SourceJobID *int `json:"source_job_id,omitempty"`
+	// OutputLanguage is the language detected in the output
+	OutputLanguage string `json:"output_language,omitempty"`
+	// SEO is the metadata and analysis of a completed job's output
+	SEO *SEOReport `json:"seo,omitempty"`
+	// Quality is the report of the checks run on the latest output
+	Quality     *QualityReport `json:"quality,omitempty"`
+	Readability *Readability   `json:"readability,omitempty"`
+	// Similarity is how close the output is to the most similar earlier
+	// job, and DuplicateOf that job when it passed quality.duplicate_threshold
+	Similarity  *float64 `json:"similarity,omitempty"`
+	DuplicateOf *int     `json:"duplicate_of,omitempty"`
+	// NoCache makes the job generate fresh output even when a cached
+	// generation matches
+	NoCache bool `json:"no_cache,omitempty"`
+	// Backend produced the output: local, llama-server (at BackendURL),
+	// or cache
+	Backend    string `json:"backend,omitempty"`
+	BackendURL string `json:"backend_url,omitempty"`
+	// Budget is how the last generation fit the model's context window
+	Budget    *TokenBudget `json:"budget,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
 }
 
+// JobTypeTranslate jobs translate the output of another completed job
+// into params.language
+const JobTypeTranslate = "translate"
+
 type CreateJobRequest struct {
-	Topic string `json:"topic"`
-	Type  string `json:"type"`
+	Topic    string `json:"topic"`
+	Type     string `json:"type"`
+	Priority int    `json:"priority"`
+	// Batch groups jobs for fair scheduling; defaults to the calling client
+	Batch string `json:"batch,omitempty"`
+	// Model names a model from GET /api/models to use instead of the
+	// workspace's or the instance default
+	Model  string           `json:"model,omitempty"`
+	Params GenerationParams `json:"params"`
+	// SourceJobID is required for translate jobs
+	SourceJobID *int `json:"source_job_id,omitempty"`
+	// Dedupe returns an existing job with the same topic, type, model and
+	// params, unless it failed, instead of queuing another
+	Dedupe bool `json:"dedupe,omitempty"`
+	// NoCache skips the generation cache for this job
+	NoCache bool `json:"no_cache,omitempty"`
+}
+
+// GenerationParams shape what a job generates. Every field is optional.
+type GenerationParams struct {
+	// WordCount is the target length; its range depends on the job type
+	WordCount int      `json:"word_count,omitempty"`
+	Tone      string   `json:"tone,omitempty"`
+	Audience  string   `json:"audience,omitempty"`
+	Language  string   `json:"language,omitempty"`
+	Keywords  []string `json:"keywords,omitempty"`
+	// Temperature and Seed are passed to the backend as they are
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+	// Chunked writes the article in parts, outline first; when unset, a
+	// llama-server job does so only if it does not fit the context window
+	Chunked *bool `json:"chunked,omitempty"`
 }
 
+// Job priorities: higher values are scheduled first
+const (
+	MinPriority     = 0
+	DefaultPriority = 0
+	MaxPriority     = 10
+)
+
 type APIResponse struct {
 	Success bool        `json:"success"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
 }
+
+type APIKey struct {
+	ID          int        `json:"id"`
+	WorkspaceID int        `json:"workspace_id"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Scopes      []string   `json:"scopes"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	QuotaLimits
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// WorkspaceID is only honoured for instance admins
+	WorkspaceID int `json:"workspace_id,omitempty"`
+	QuotaLimits
+}
+
+// CreateAPIKeyResponse is the only place the plaintext key is ever returned
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type User struct {
+	ID          int       `json:"id"`
+	WorkspaceID int       `json:"workspace_id"`
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	// WorkspaceID is only honoured for instance admins
+	WorkspaceID int `json:"workspace_id,omitempty"`
+}
+
+type Session struct {
+	UserID    int
+	CSRFToken string
+	ExpiresAt time.Time
+}
+
+// WorkerStatus is a worker as last reported in its heartbeat
+type WorkerStatus struct {
+	ID         string    `json:"id"`
+	State      string    `json:"state"`
+	JobID      *int      `json:"job_id,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// JobFilter narrows job listings to one workspace and, optionally, one user,
+// status or source job. A nil UserID means all users in the workspace.
+type JobFilter struct {
+	WorkspaceID int
+	UserID      *int
+	Status      string
+	SourceJobID *int
+	// Readability bounds metrics by their name in readabilityMetrics
+	Readability map[string]ScoreRange
+}
+
+// ScoreRange bounds a score; a nil end is open
+type ScoreRange struct {
+	Min, Max *float64
+}
+
+// ModelInfo describes a model file found in generator.model_dirs
+type ModelInfo struct {
+	Name           string    `json:"name"`
+	Path           string    `json:"-"`
+	Format         string    `json:"format"`
+	SizeBytes      int64     `json:"size_bytes"`
+	Architecture   string    `json:"architecture,omitempty"`
+	ParameterCount uint64    `json:"parameter_count,omitempty"`
+	Quantization   string    `json:"quantization,omitempty"`
+	ContextLength  int       `json:"context_length,omitempty"`
+	ModifiedAt     time.Time `json:"modified_at"`
+	Default        bool      `json:"default"`
+	// Error explains why the file was rejected; such models are listed
+	// but never used
+	Error string `json:"error,omitempty"`
+	// GGUF is the full header, served by /api/model-status
+	GGUF *GGUFInfo `json:"-"`
+}
+
+// ModelStatus describes the model new jobs use
+type ModelStatus struct {
+	Message string     `json:"message"`
+	Model   *ModelInfo `json:"model,omitempty"`
+	GGUF    *GGUFInfo  `json:"gguf,omitempty"`
+}
+
+// SetDefaultModelRequest switches the instance default model. An empty
+// name goes back to the first model found.
+type SetDefaultModelRequest struct {
+	Name string `json:"name"`
+}
+
+type Workspace struct {
+	ID         int    `json:"id"`
+	Slug       string `json:"slug"`
+	Name       string `json:"name"`
+	ModelPath  string `json:"model_path"`
+	Backend    string `json:"backend"`
+	BackendURL string `json:"backend_url"`
+	QuotaLimits
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WorkspaceRequest creates or updates a workspace
+type WorkspaceRequest struct {
+	Slug       string `json:"slug"`
+	Name       string `json:"name"`
+	ModelPath  string `json:"model_path"`
+	Backend    string `json:"backend"`
+	BackendURL string `json:"backend_url"`
+	QuotaLimits
+}
+
+// CreateWorkspaceResponse carries the new workspace's first admin key
+type CreateWorkspaceResponse struct {
+	Workspace Workspace            `json:"workspace"`
+	AdminKey  CreateAPIKeyResponse `json:"admin_key"`
+}
+
+type PromptTemplate struct {
+	WorkspaceID int       `json:"workspace_id"`
+	Type        string    `json:"type"`
+	Body        string    `json:"body"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type PromptTemplateRequest struct {
+	Body string `json:"body"`
+}
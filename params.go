@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// contentType bounds the word count a job of that type may ask for
+type contentType struct {
+	minWords, maxWords int
+}
+
+// contentTypes lists the types with their own limits. Other types are
+// accepted with otherContentType's.
+var contentTypes = map[string]contentType{
+	"blog":    {minWords: 300, maxWords: 3000},
+	"article": {minWords: 500, maxWords: 5000},
+	"social":  {minWords: 10, maxWords: 300},
+	"email":   {minWords: 50, maxWords: 1000},
+	"product": {minWords: 50, maxWords: 800},
+}
+
+var otherContentType = contentType{minWords: 10, maxWords: 5000}
+
+var validTones = map[string]bool{
+	"casual":       true,
+	"formal":       true,
+	"professional": true,
+	"friendly":     true,
+	"informative":  true,
+	"persuasive":   true,
+	"humorous":     true,
+}
+
+const (
+	maxKeywords      = 20
+	maxKeywordLength = 100
+	maxAudience      = 200
+	maxJobTokens     = 16384
+)
+
+// languagePattern accepts BCP 47 tags like en, pt-BR or zh-Hant
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+func validateParams(jobType string, p GenerationParams) error {
+	if jobType == "" {
+		jobType = "blog"
+	}
+	ct, ok := contentTypes[jobType]
+	if !ok {
+		ct = otherContentType
+	}
+
+	if p.WordCount != 0 && (p.WordCount < ct.minWords || p.WordCount > ct.maxWords) {
+		return fmt.Errorf("word_count for %s must be between %d and %d", jobType, ct.minWords, ct.maxWords)
+	}
+	if p.Tone != "" && !validTones[p.Tone] {
+		return fmt.Errorf("invalid tone: %s", p.Tone)
+	}
+	if len(p.Audience) > maxAudience {
+		return fmt.Errorf("audience must be at most %d characters", maxAudience)
+	}
+	if p.Language != "" && !languagePattern.MatchString(p.Language) {
+		return fmt.Errorf("language must be a language tag like en or pt-BR")
+	}
+	if len(p.Keywords) > maxKeywords {
+		return fmt.Errorf("at most %d keywords are allowed", maxKeywords)
+	}
+	for _, k := range p.Keywords {
+		if strings.TrimSpace(k) == "" || len(k) > maxKeywordLength {
+			return fmt.Errorf("keywords must be non-empty and at most %d characters", maxKeywordLength)
+		}
+	}
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if p.MaxTokens < 0 || p.MaxTokens > maxJobTokens {
+		return fmt.Errorf("max_tokens must be between 1 and %d, or 0 for the default", maxJobTokens)
+	}
+	if p.Seed != nil && *p.Seed < 0 {
+		return fmt.Errorf("seed cannot be negative")
+	}
+	if p.Chunked != nil && *p.Chunked && jobType == JobTypeTranslate {
+		return fmt.Errorf("translate jobs cannot be chunked")
+	}
+	return nil
+}
+
+// tokenLimit is how many tokens the backend may generate: max_tokens when
+// set, otherwise enough for the requested word count, and never less than
+// generator.max_tokens.
+func (p GenerationParams) tokenLimit() int {
+	if p.MaxTokens > 0 {
+		return p.MaxTokens
+	}
+	// English averages about four tokens for every three words
+	if tokens := p.WordCount*4/3 + 100; tokens > cfg.Generator.MaxTokens {
+		return tokens
+	}
+	return cfg.Generator.MaxTokens
+}
+
+// applyParams fills a prompt template's parameter placeholders. Parameters
+// the template has no placeholder for are added as requirements after it,
+// so templates written before parameters existed still honour them. vars
+// are more placeholder and value pairs, filled in the same pass.
+func applyParams(template, topic string, p GenerationParams, vars ...string) string {
+	values := []struct {
+		placeholder, label, value string
+	}{
+		{"{{word_count}}", "Length", wordCountText(p.WordCount)},
+		{"{{tone}}", "Tone", p.Tone},
+		{"{{audience}}", "Audience", p.Audience},
+		{"{{language}}", "Language", languageName(p.Language)},
+		{"{{keywords}}", "Include these keywords", strings.Join(p.Keywords, ", ")},
+	}
+
+	// One pass, so placeholders inside the topic or values stay as typed
+	pairs := append([]string{"{{topic}}", topic}, vars...)
+	var requirements []string
+	for _, v := range values {
+		if strings.Contains(template, v.placeholder) {
+			pairs = append(pairs, v.placeholder, v.value)
+		} else if v.value != "" {
+			requirements = append(requirements, "- "+v.label+": "+v.value)
+		}
+	}
+	prompt := strings.NewReplacer(pairs...).Replace(template)
+	if len(requirements) > 0 {
+		prompt = strings.TrimRight(prompt, "\n") + "\n\nRequirements:\n" + strings.Join(requirements, "\n") + "\n"
+	}
+	return prompt
+}
+
+func wordCountText(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return "about " + strconv.Itoa(n) + " words"
+}
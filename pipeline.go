@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A pipeline generates a content type in steps, each with its own prompt:
+// an outline, then every section, an introduction and conclusion, and a
+// final polish. Every step's prompt and output is stored in job_steps. When
+// a job runs again after a step failed, steps whose prompt is unchanged
+// reuse their stored output, so only the failed step and those after it
+// call the backend. Pipelines run on llama-server workspaces only; the
+// local backend writes its article in one go, and so does a workspace with
+// its own prompt template for the type.
+
+// Pipeline step roles
+const (
+	RoleOutline      = "outline"
+	RoleSection      = "section"
+	RoleIntroduction = "introduction"
+	RoleConclusion   = "conclusion"
+	RolePolish       = "polish"
+)
+
+var pipelineRoles = map[string]bool{
+	RoleOutline:      true,
+	RoleSection:      true,
+	RoleIntroduction: true,
+	RoleConclusion:   true,
+	RolePolish:       true,
+}
+
+// Step statuses
+const (
+	StepRunning   = "running"
+	StepCompleted = "completed"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+)
+
+// PipelineStep is one step of a content type's pipeline. Prompts can use
+// {{topic}}, {{title}}, {{outline}}, {{section}}, {{previous}} and
+// {{article}}, and the parameter placeholders of prompt templates.
+type PipelineStep struct {
+	Role   string `yaml:"role" json:"role"`
+	Prompt string `yaml:"prompt" json:"prompt"`
+}
+
+// JobStep is the stored result of a step. Section steps have one for each
+// section, numbered by Item.
+type JobStep struct {
+	Step       int       `json:"step"`
+	Item       int       `json:"item"`
+	Role       string    `json:"role"`
+	Status     string    `json:"status"`
+	Prompt     string    `json:"prompt"`
+	Output     string    `json:"output"`
+	Error      string    `json:"error,omitempty"`
+	BackendURL string    `json:"backend_url,omitempty"`
+	Attempts   int       `json:"attempts"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+const (
+	outlineStepPrompt = `You are a professional blog writer planning an article about {{topic}}.
+
+Reply with the article's title on the first line, then one line per main section starting with "- ". Plan 3 to 6 sections, without an introduction or conclusion. Do not write the article yet.`
+
+	introductionStepPrompt = `You are writing the article "{{title}}" about {{topic}}.
+
+Its sections are:
+{{outline}}
+Write the introduction, {{word_count}}: say why the topic matters and what the article covers. Use plain paragraphs without a heading.`
+
+	conclusionStepPrompt = `You are writing the article "{{title}}" about {{topic}}.
+
+Its sections are:
+{{outline}}
+{{previous}}
+Write the conclusion, {{word_count}}: sum up the key takeaways. Use plain paragraphs without a heading.`
+
+	polishStepPrompt = `Edit this article so it reads as one piece: smooth the transitions between sections, remove repetition and fix mistakes. Keep every heading, the markdown and the length. Reply with the edited article only.
+
+{{article}}`
+)
+
+// builtinPipelines are the pipelines of the built-in content types;
+// generator.pipelines replaces them by type
+func builtinPipelines() map[string][]PipelineStep {
+	article := []PipelineStep{
+		{Role: RoleOutline, Prompt: outlineStepPrompt},
+		{Role: RoleSection, Prompt: sectionPrompt},
+		{Role: RoleIntroduction, Prompt: introductionStepPrompt},
+		{Role: RoleConclusion, Prompt: conclusionStepPrompt},
+		{Role: RolePolish, Prompt: polishStepPrompt},
+	}
+	return map[string][]PipelineStep{
+		"blog":    article,
+		"article": article,
+	}
+}
+
+// validatePipeline checks that a pipeline starts with its outline, writes
+// sections, and polishes last if at all
+func validatePipeline(steps []PipelineStep) error {
+	if len(steps) == 0 {
+		return nil
+	}
+	if steps[0].Role != RoleOutline {
+		return fmt.Errorf("the first step must be the %s", RoleOutline)
+	}
+	seen := make(map[string]bool)
+	for i, s := range steps {
+		if !pipelineRoles[s.Role] {
+			return fmt.Errorf("step %d has unknown role %q", i+1, s.Role)
+		}
+		if seen[s.Role] {
+			return fmt.Errorf("more than one %s step", s.Role)
+		}
+		seen[s.Role] = true
+		if strings.TrimSpace(s.Prompt) == "" {
+			return fmt.Errorf("step %d (%s) has no prompt", i+1, s.Role)
+		}
+		if s.Role == RolePolish && i != len(steps)-1 {
+			return fmt.Errorf("the %s step must be last", RolePolish)
+		}
+	}
+	if !seen[RoleSection] {
+		return fmt.Errorf("a %s step is required", RoleSection)
+	}
+	return nil
+}
+
+// pipelineFor returns the pipeline a workspace's job runs, or nil when it
+// generates in one go. A workspace's own prompt template for the type wins
+// over the pipeline, so the prompt it set is the one sent.
+func pipelineFor(ctx context.Context, ws *Workspace, jobType string) []PipelineStep {
+	if ws.Backend != BackendLlamaServer {
+		return nil
+	}
+	steps := cfg.Generator.Pipelines[jobType]
+	if len(steps) == 0 {
+		return nil
+	}
+	template, err := getPromptTemplate(ws.ID, jobType)
+	if err != nil {
+		loggerFrom(ctx).Error("failed to load workspace prompt template", "workspace_id", ws.ID, "error", err)
+	}
+	if template != "" {
+		return nil
+	}
+	return steps
+}
+
+// outlinePrompt is the first prompt a pipeline sends, the only one known
+// before it runs. It stands for the job's prompt in the token budget, the
+// cache key and the quality checks; every later step checks its own fit.
+func outlinePrompt(steps []PipelineStep, topic string, params GenerationParams) string {
+	params.WordCount = 0
+	return applyParams(steps[0].Prompt, topic, params, "{{title}}", "", "{{outline}}", "", "{{section}}", "", "{{previous}}", "", "{{article}}", "")
+}
+
+// pipelineRun is one attempt at a job's pipeline
+type pipelineRun struct {
+	g      *LLMGenerator
+	job    *Job
+	params GenerationParams
+	budget *TokenBudget
+	// stored are the steps of earlier attempts, by step and item
+	stored map[[2]int]JobStep
+	reused int
+}
+
+// runPipeline generates a job's content step by step, reusing the steps
+// of earlier attempts whose prompts are unchanged. params.WordCount is the
+// length of the whole article.
+func (g *LLMGenerator) runPipeline(ctx context.Context, job *Job, steps []PipelineStep, params GenerationParams, budget *TokenBudget) (string, error) {
+	stored, err := jobSteps(ctx, job.ID)
+	if err != nil {
+		return "", err
+	}
+	run := &pipelineRun{g: g, job: job, params: params, budget: budget, stored: make(map[[2]int]JobStep)}
+	for _, s := range stored {
+		run.stored[[2]int{s.Step, s.Item}] = s
+	}
+
+	// The introduction and conclusion get a tenth of the length each, the
+	// sections share the rest
+	words := params.WordCount
+	edgeWords := max(words/10, 50)
+	for _, s := range steps {
+		if s.Role == RoleIntroduction || s.Role == RoleConclusion {
+			words -= edgeWords
+		}
+	}
+
+	var title, introduction, conclusion string
+	var sections, texts []string
+	var outline strings.Builder
+	for i, step := range steps {
+		vars := map[string]string{
+			"{{title}}":    title,
+			"{{outline}}":  outline.String(),
+			"{{section}}":  "",
+			"{{previous}}": "",
+			"{{article}}":  "",
+		}
+		switch step.Role {
+		case RoleOutline:
+			plan, err := run.step(ctx, i, 0, step, vars, 0, func(out string) error {
+				_, parsed := parseOutline(out)
+				if len(parsed) < minSections {
+					return fmt.Errorf("outline has %d sections, at least %d are needed", len(parsed), minSections)
+				}
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+			title, sections = parseOutline(plan)
+			if title == "" {
+				title = job.Topic
+			}
+			for _, s := range sections {
+				outline.WriteString("- " + s + "\n")
+			}
+
+		case RoleSection:
+			sectionWords := max(words/len(sections), 50)
+			previous := ""
+			for j, section := range sections {
+				vars["{{section}}"] = section
+				vars["{{previous}}"] = previousText(previous)
+				text, err := run.step(ctx, i, j, step, vars, sectionWords, nil)
+				if err != nil {
+					return "", err
+				}
+				text = stripHeading(text, section)
+				texts = append(texts, text)
+				previous = text
+			}
+
+		case RoleIntroduction:
+			text, err := run.step(ctx, i, 0, step, vars, edgeWords, nil)
+			if err != nil {
+				return "", err
+			}
+			introduction = stripHeading(text, "Introduction")
+
+		case RoleConclusion:
+			last := ""
+			if len(texts) > 0 {
+				last = texts[len(texts)-1]
+			}
+			vars["{{previous}}"] = previousText(last)
+			text, err := run.step(ctx, i, 0, step, vars, edgeWords, nil)
+			if err != nil {
+				return "", err
+			}
+			conclusion = stripHeading(text, "Conclusion")
+
+		case RolePolish:
+			article := assembleArticle(title, introduction, sections, texts, conclusion)
+			vars["{{article}}"] = article
+			polished, err := run.polish(ctx, i, step, vars, article)
+			if err != nil {
+				return "", err
+			}
+			// A polish that lost much of the article is not used
+			if draft := len(textWords(article)); polished != "" && len(textWords(polished)) < draft*7/10 {
+				loggerFrom(ctx).Warn("polished article is much shorter than the draft, using the draft", "draft_words", draft, "polished_words", len(textWords(polished)))
+				polished = ""
+			}
+			if polished != "" {
+				loggerFrom(ctx).Info("pipeline finished", "steps", len(steps), "sections", len(sections), "reused", run.reused)
+				return "## OUTLINE\n" + outline.String() + "\n## ARTICLE\n\n" + strings.TrimSpace(polished), nil
+			}
+		}
+	}
+	loggerFrom(ctx).Info("pipeline finished", "steps", len(steps), "sections", len(sections), "reused", run.reused)
+	return "## OUTLINE\n" + outline.String() + "\n## ARTICLE\n\n" + assembleArticle(title, introduction, sections, texts, conclusion), nil
+}
+
+// step runs one step, or reuses its stored output when its prompt has not
+// changed. words is the step's length; an outline has none, so the whole
+// article's length does not tempt the model to write it there. check, when
+// set, validates the output before it is stored.
+func (r *pipelineRun) step(ctx context.Context, index, item int, step PipelineStep, vars map[string]string, words int, check func(string) error) (string, error) {
+	params := r.params
+	params.WordCount = words
+	prompt := r.prompt(step, vars, params)
+
+	stored, ok := r.stored[[2]int{index, item}]
+	if ok && stored.Status == StepCompleted && stored.Prompt == prompt {
+		r.reused++
+		return stored.Output, nil
+	}
+
+	// Each call gets enough for its length, within what the context holds
+	tokens := outlineTokens
+	if words > 0 {
+		tokens = words*4/3 + 100
+	}
+	params.MaxTokens = min(tokens, r.budget.ContextLength-estimateTokens(prompt))
+	if params.MaxTokens < minOutputTokens {
+		err := fmt.Errorf("the %s prompt leaves less than %d tokens of the context window for output", step.Role, minOutputTokens)
+		return "", r.fail(ctx, index, item, step, prompt, stored.Attempts+1, err)
+	}
+	return r.call(ctx, index, item, step, prompt, params, stored.Attempts+1, check)
+}
+
+// polish edits the assembled article, when it fits the context window
+// twice: once to read and once to write
+func (r *pipelineRun) polish(ctx context.Context, index int, step PipelineStep, vars map[string]string, article string) (string, error) {
+	params := r.params
+	prompt := r.prompt(step, vars, params)
+
+	stored, ok := r.stored[[2]int{index, 0}]
+	if ok && stored.Status == StepCompleted && stored.Prompt == prompt {
+		r.reused++
+		return stored.Output, nil
+	}
+
+	available := r.budget.ContextLength - estimateTokens(prompt)
+	params.MaxTokens = min(available, estimateTokens(article)*3/2)
+	if available < estimateTokens(article)*5/4 {
+		loggerFrom(ctx).Info("article too long to polish in the context window, skipping", "article_tokens", estimateTokens(article))
+		err := saveJobStep(ctx, r.job.ID, JobStep{Step: index, Role: step.Role, Status: StepSkipped, Prompt: prompt, Attempts: stored.Attempts})
+		return "", err
+	}
+	return r.call(ctx, index, 0, step, prompt, params, stored.Attempts+1, nil)
+}
+
+// call runs a step's prompt on the generator's llama-servers and stores
+// the result
+func (r *pipelineRun) call(ctx context.Context, index, item int, step PipelineStep, prompt string, params GenerationParams, attempts int, check func(string) error) (string, error) {
+	logger := loggerFrom(ctx)
+	if err := saveJobStep(ctx, r.job.ID, JobStep{Step: index, Item: item, Role: step.Role, Status: StepRunning, Prompt: prompt, Attempts: attempts}); err != nil {
+		return "", err
+	}
+	logger.Debug("running pipeline step", "step", index+1, "role", step.Role, "item", item)
+	output, err := r.g.onChain(ctx, func(ctx context.Context, url string) (string, error) {
+		return r.g.llamaServerGeneration(ctx, url, prompt, params)
+	})
+	if err == nil && check != nil {
+		err = check(output)
+	}
+	if err != nil {
+		return "", r.fail(ctx, index, item, step, prompt, attempts, err)
+	}
+	result := JobStep{Step: index, Item: item, Role: step.Role, Status: StepCompleted, Prompt: prompt, Output: output, BackendURL: r.g.usedURL, Attempts: attempts}
+	if err := saveJobStep(ctx, r.job.ID, result); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// fail records a failed step and returns the error the job fails with
+func (r *pipelineRun) fail(ctx context.Context, index, item int, step PipelineStep, prompt string, attempts int, cause error) error {
+	if ctx.Err() != nil {
+		// The job was abandoned, not the step at fault
+		return ctx.Err()
+	}
+	if err := saveJobStep(ctx, r.job.ID, JobStep{Step: index, Item: item, Role: step.Role, Status: StepFailed, Prompt: prompt, Error: cause.Error(), Attempts: attempts}); err != nil {
+		loggerFrom(ctx).Error("failed to record pipeline step", "error", err)
+	}
+	if step.Role == RoleSection {
+		return fmt.Errorf("step %d (%s %d): %v", index+1, step.Role, item+1, cause)
+	}
+	return fmt.Errorf("step %d (%s): %v", index+1, step.Role, cause)
+}
+
+// prompt fills in a step's prompt. Earlier steps' output goes in with the
+// parameters in one pass, so placeholders the model wrote stay as written.
+func (r *pipelineRun) prompt(step PipelineStep, vars map[string]string, params GenerationParams) string {
+	pairs := make([]string, 0, 2*len(vars))
+	for k, v := range vars {
+		pairs = append(pairs, k, v)
+	}
+	return applyParams(step.Prompt, r.job.Topic, params, pairs...)
+}
+
+// previousText introduces the end of the text before a step's
+func previousText(text string) string {
+	if text == "" {
+		return ""
+	}
+	return "\nThe previous section ends:\n" + tail(text, continuityChars) + "\n"
+}
+
+// assembleArticle puts a pipeline's parts together under their headings
+func assembleArticle(title, introduction string, sections, texts []string, conclusion string) string {
+	var b strings.Builder
+	b.WriteString("# " + title + "\n")
+	if introduction != "" {
+		b.WriteString("\n" + introduction + "\n")
+	}
+	for i, section := range sections {
+		if i < len(texts) {
+			b.WriteString("\n## " + section + "\n\n" + texts[i] + "\n")
+		}
+	}
+	if conclusion != "" {
+		b.WriteString("\n## Conclusion\n\n" + conclusion + "\n")
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// pipelineKey describes a pipeline for the generation cache key
+func pipelineKey(steps []PipelineStep) string {
+	var b strings.Builder
+	for _, s := range steps {
+		b.WriteString(s.Role + "\n" + s.Prompt + "\n\n")
+	}
+	return b.String()
+}
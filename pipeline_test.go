@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestValidatePipeline(t *testing.T) {
+	outline := PipelineStep{Role: RoleOutline, Prompt: "plan {{topic}}"}
+	section := PipelineStep{Role: RoleSection, Prompt: "write {{section}}"}
+	polish := PipelineStep{Role: RolePolish, Prompt: "edit {{article}}"}
+	tests := []struct {
+		name  string
+		steps []PipelineStep
+		want  string
+	}{
+		{"empty", nil, ""},
+		{"built-in", builtinPipelines()["blog"], ""},
+		{"minimal", []PipelineStep{outline, section}, ""},
+		{"outline not first", []PipelineStep{section, outline}, "first step must be the outline"},
+		{"unknown role", []PipelineStep{outline, section, {Role: "summary", Prompt: "x"}}, `unknown role "summary"`},
+		{"repeated role", []PipelineStep{outline, section, section}, "more than one section"},
+		{"no prompt", []PipelineStep{outline, {Role: RoleSection, Prompt: " \n"}}, "has no prompt"},
+		{"polish not last", []PipelineStep{outline, polish, section}, "polish step must be last"},
+		{"no section", []PipelineStep{outline, polish}, "section step is required"},
+	}
+	for _, tt := range tests {
+		err := validatePipeline(tt.steps)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: got error %q, want none", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: got error %v, want it to contain %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseOutline(t *testing.T) {
+	tests := []struct {
+		name     string
+		plan     string
+		title    string
+		sections []string
+	}{
+		{"dashes", "Baking Bread\n- Starter\n- Dough\n- Baking", "Baking Bread", []string{"Starter", "Dough", "Baking"}},
+		{"markdown", "# **Title: Baking Bread**\n\n1. ## Starter\n2) *Dough*\n* \"Baking\"", "Baking Bread", []string{"Starter", "Dough", "Baking"}},
+		{"no title", "- Starter\n- Dough", "", []string{"Starter", "Dough"}},
+		{"text after sections", "Bread\n- Starter\nSome chatter\n- Dough", "Bread", []string{"Starter", "Dough"}},
+		{"no sections", "Just a paragraph about bread.", "Just a paragraph about bread.", nil},
+	}
+	for _, tt := range tests {
+		title, sections := parseOutline(tt.plan)
+		if title != tt.title || !reflect.DeepEqual(sections, tt.sections) {
+			t.Errorf("%s: got %q, %q; want %q, %q", tt.name, title, sections, tt.title, tt.sections)
+		}
+	}
+
+	many := "Title\n" + strings.Repeat("- Section\n", maxSections+5)
+	if _, sections := parseOutline(many); len(sections) != maxSections {
+		t.Errorf("got %d sections, want at most %d", len(sections), maxSections)
+	}
+}
+
+func TestAssembleArticle(t *testing.T) {
+	tests := []struct {
+		name         string
+		introduction string
+		texts        []string
+		conclusion   string
+		want         string
+	}{
+		{"full", "Intro.", []string{"One.", "Two."}, "End.", "# T\n\nIntro.\n\n## A\n\nOne.\n\n## B\n\nTwo.\n\n## Conclusion\n\nEnd."},
+		{"sections only", "", []string{"One.", "Two."}, "", "# T\n\n## A\n\nOne.\n\n## B\n\nTwo."},
+		{"missing texts", "", []string{"One."}, "", "# T\n\n## A\n\nOne."},
+	}
+	for _, tt := range tests {
+		if got := assembleArticle("T", tt.introduction, []string{"A", "B"}, tt.texts, tt.conclusion); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStepPrompt(t *testing.T) {
+	run := &pipelineRun{job: &Job{Topic: "bread"}}
+	params := GenerationParams{WordCount: 300, Keywords: []string{"sourdough"}}
+	step := PipelineStep{Role: RoleSection, Prompt: "Article {{title}} about {{topic}}: write {{section}}, {{word_count}}."}
+	vars := map[string]string{"{{title}}": "All about {{topic}}", "{{section}}": "Use {{keywords}}"}
+
+	got := run.prompt(step, vars, params)
+	want := "Article All about {{topic}} about bread: write Use {{keywords}}, about 300 words.\n\nRequirements:\n- Include these keywords: sourdough\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The outline's prompt asks for no length
+	outline := outlinePrompt(builtinPipelines()["blog"], "bread", params)
+	if strings.Contains(outline, "300") || strings.Contains(outline, "Length") {
+		t.Errorf("outline prompt asks for the article's length: %q", outline)
+	}
+}
+
+// fakeLlamaServer answers pipeline prompts by role, failing those that
+// contain fail
+type fakeLlamaServer struct {
+	mu    sync.Mutex
+	fail  string
+	calls []string
+}
+
+func (s *fakeLlamaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prompt string `json:"prompt"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != "" && strings.Contains(req.Prompt, s.fail) {
+		http.Error(w, "model crashed", http.StatusInternalServerError)
+		return
+	}
+
+	var content string
+	switch {
+	case strings.Contains(req.Prompt, "planning an article"):
+		s.calls = append(s.calls, RoleOutline)
+		content = "Baking Bread\n- Starter\n- Dough\n- Baking"
+	case strings.Contains(req.Prompt, "Write only the section"):
+		section := req.Prompt[strings.Index(req.Prompt, `section "`)+len(`section "`):]
+		section = section[:strings.Index(section, `"`)]
+		s.calls = append(s.calls, RoleSection+" "+section)
+		content = "How the " + strings.ToLower(section) + " works, step by step."
+	case strings.Contains(req.Prompt, "Write the introduction"):
+		s.calls = append(s.calls, RoleIntroduction)
+		content = "Bread is worth baking at home."
+	case strings.Contains(req.Prompt, "Write the conclusion"):
+		s.calls = append(s.calls, RoleConclusion)
+		content = "Bake often and take notes."
+	default:
+		s.calls = append(s.calls, RolePolish)
+		content = req.Prompt[strings.Index(req.Prompt, "# "):]
+	}
+	json.NewEncoder(w).Encode(map[string]string{"content": content})
+}
+
+func (s *fakeLlamaServer) run(fail string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := s.calls
+	s.fail, s.calls = fail, nil
+	return calls
+}
+
+// useTestDB points the package at a fresh database for the test
+func useTestDB(t *testing.T) {
+	t.Helper()
+	defer func(path string) { cfg.Storage.DBPath = path }(cfg.Storage.DBPath)
+	cfg.Storage.DBPath = filepath.Join(t.TempDir(), "test.db")
+	if err := initDB(); err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+}
+
+func TestRunPipelineResumes(t *testing.T) {
+	useTestDB(t)
+	server := &fakeLlamaServer{fail: "Write the conclusion"}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	ctx := context.Background()
+	g := &LLMGenerator{backend: BackendLlamaServer, backendURL: srv.URL, client: srv.Client()}
+	job := &Job{ID: 1, Topic: "bread"}
+	steps := builtinPipelines()["blog"]
+	params := GenerationParams{WordCount: 600}
+	budget := &TokenBudget{ContextLength: 4096}
+
+	if _, err := g.runPipeline(ctx, job, steps, params, budget); err == nil || !strings.Contains(err.Error(), "step 4 (conclusion)") {
+		t.Fatalf("got error %v, want the conclusion step to fail", err)
+	}
+	want := []string{RoleOutline, "section Starter", "section Dough", "section Baking", RoleIntroduction}
+	if calls := server.run(""); !reflect.DeepEqual(calls, want) {
+		t.Fatalf("first attempt called %q, want %q", calls, want)
+	}
+	stored, err := jobSteps(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := stored[len(stored)-1]; last.Role != RoleConclusion || last.Status != StepFailed || last.Attempts != 1 {
+		t.Errorf("last stored step is %s %s after %d attempts, want a failed conclusion after 1", last.Role, last.Status, last.Attempts)
+	}
+
+	// The retry resumes from the failed step
+	content, err := g.runPipeline(ctx, job, steps, params, budget)
+	if err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	want = []string{RoleConclusion, RolePolish}
+	if calls := server.run(""); !reflect.DeepEqual(calls, want) {
+		t.Errorf("retry called %q, want %q", calls, want)
+	}
+	for _, part := range []string{"## OUTLINE\n- Starter\n", "# Baking Bread", "## Dough\n\nHow the dough works", "## Conclusion\n\nBake often"} {
+		if !strings.Contains(content, part) {
+			t.Errorf("content lacks %q:\n%s", part, content)
+		}
+	}
+
+	// Another run reuses every step, the polish included
+	again, err := g.runPipeline(ctx, job, steps, params, budget)
+	if err != nil || again != content {
+		t.Errorf("third run got %v and different content", err)
+	}
+	if calls := server.run(""); len(calls) != 0 {
+		t.Errorf("third run called %q, want every step reused", calls)
+	}
+
+	// A new length changes every prompt but the outline's, so the
+	// outline is reused and the rest run again
+	params.WordCount = 900
+	if _, err := g.runPipeline(ctx, job, steps, params, budget); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"section Starter", "section Dough", "section Baking", RoleIntroduction, RoleConclusion, RolePolish}
+	if calls := server.run(""); !reflect.DeepEqual(calls, want) {
+		t.Errorf("run with a new length called %q, want %q", calls, want)
+	}
+}
+
+func TestPipelineFor(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	ws := &Workspace{ID: 1, Backend: BackendLlamaServer}
+	if steps := pipelineFor(ctx, ws, "blog"); len(steps) == 0 {
+		t.Error("llama-server blog job has no pipeline")
+	}
+	if steps := pipelineFor(ctx, ws, "social"); steps != nil {
+		t.Error("type without a pipeline got one")
+	}
+	if steps := pipelineFor(ctx, &Workspace{ID: 1, Backend: BackendLocal}, "blog"); steps != nil {
+		t.Error("local backend job got a pipeline")
+	}
+
+	// The workspace's own template wins
+	if _, err := savePromptTemplate(ws.ID, "blog", "Write a short post about {{topic}}"); err != nil {
+		t.Fatal(err)
+	}
+	if steps := pipelineFor(ctx, ws, "blog"); steps != nil {
+		t.Error("workspace with its own blog template got the pipeline")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// StatusNeedsReview marks a job whose output kept failing the quality
+// checks. A reviewer approves it or retries it.
+const StatusNeedsReview = "needs_review"
+
+// QualityReport records the checks run on a job's latest output
+type QualityReport struct {
+	Passed bool `json:"passed"`
+	// Attempt is the attempt whose output was checked
+	Attempt int `json:"attempt"`
+	// Retries counts the times failed checks have sent the job back to
+	// the queue
+	Retries     int            `json:"retries"`
+	Words       int            `json:"words"`
+	TargetWords int            `json:"target_words"`
+	Checks      []QualityCheck `json:"checks"`
+}
+
+type QualityCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Failed names the checks that did not pass
+func (r *QualityReport) Failed() []string {
+	var names []string
+	for _, c := range r.Checks {
+		if !c.Passed {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+const (
+	// loopGram is the phrase length repetition is measured in
+	loopGram = 8
+	// maxGramRepeats is how often one phrase may recur before it is a loop
+	maxGramRepeats = 3
+	// maxWordRun is the longest run of one word allowed
+	maxWordRun = 3
+)
+
+// sectionMarker matches the upper-case section headings prompts ask for,
+// like "## ARTICLE"
+var sectionMarker = regexp.MustCompile(`(?m)^##\s+[A-Z][A-Z ]*[A-Z]\s*$`)
+
+// checkQuality runs the post-generation checks on output generated from
+// prompt by backend. closest is the most similar earlier job, if any.
+func checkQuality(job *Job, backend, prompt, output string, params GenerationParams, closest *SimilarJob) *QualityReport {
+	body := articleBody(output)
+	words := len(textWords(plainText(body)))
+	target := params.WordCount
+	if target == 0 {
+		ct, ok := contentTypes[job.Type]
+		if !ok {
+			ct = otherContentType
+		}
+		target = ct.minWords
+	}
+
+	report := &QualityReport{Attempt: job.Attempts, Words: words, TargetWords: target}
+	report.Checks = []QualityCheck{
+		checkWordCount(backend, words, target, params.WordCount != 0),
+		checkSections(prompt, output),
+		checkRepetition(output),
+		checkFinished(output),
+		checkBannedPhrases(output),
+		checkLanguage(backend, params.Language, output),
+		checkDuplicate(backend, closest),
+	}
+	report.Passed = len(report.Failed()) == 0
+	return report
+}
+
+// checkWordCount fails output well short of the target. A target the job
+// set explicitly also fails output more than twice as long. The local
+// backend's built-in articles have a fixed length, so its output is not
+// measured.
+func checkWordCount(backend string, words, target int, explicit bool) QualityCheck {
+	check := QualityCheck{Name: "word_count", Passed: true}
+	if backend == BackendLocal {
+		check.Detail = "not checked: the local backend ignores word_count"
+		return check
+	}
+	min := int(float64(target) * cfg.Quality.MinWordRatio)
+	switch {
+	case words < min:
+		check.Passed = false
+		check.Detail = fmt.Sprintf("%d words, expected at least %d of %d", words, min, target)
+	case explicit && words > 2*target:
+		check.Passed = false
+		check.Detail = fmt.Sprintf("%d words, more than twice the %d asked for", words, target)
+	}
+	return check
+}
+
+// checkSections requires every section heading the prompt asks for, each
+// followed by some content
+func checkSections(prompt, output string) QualityCheck {
+	check := QualityCheck{Name: "sections", Passed: true}
+	var missing, empty []string
+	for _, marker := range sectionMarker.FindAllString(prompt, -1) {
+		marker = strings.TrimSpace(marker)
+		i := strings.Index(output, marker)
+		if i < 0 {
+			missing = append(missing, marker)
+			continue
+		}
+		rest := output[i+len(marker):]
+		if next := sectionMarker.FindStringIndex(rest); next != nil {
+			rest = rest[:next[0]]
+		}
+		if strings.TrimSpace(rest) == "" {
+			empty = append(empty, marker)
+		}
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(missing, ", "))
+	}
+	if len(empty) > 0 {
+		problems = append(problems, "empty "+strings.Join(empty, ", "))
+	}
+	if len(problems) > 0 {
+		check.Passed = false
+		check.Detail = strings.Join(problems, "; ")
+	}
+	return check
+}
+
+// checkLanguage fails output clearly in another language than the job
+// asked for. The local backend writes English in languages it has no
+// built-in article for, so that output is not checked.
+func checkLanguage(backend, requested, output string) QualityCheck {
+	check := QualityCheck{Name: "language", Passed: true}
+	if backend == BackendLocal && requested != "" && !hasLocalizedArticle(requested) {
+		check.Detail = "not checked: the local backend has no built-in article in " + languageName(requested)
+		return check
+	}
+	if _, err := checkOutputLanguage(requested, output); err != nil {
+		check.Passed = false
+		check.Detail = err.Error()
+	}
+	return check
+}
+
+// checkRepetition catches generation loops: one word over and over, or the
+// same phrase recurring throughout
+func checkRepetition(output string) QualityCheck {
+	check := QualityCheck{Name: "repetition", Passed: true}
+	words := textWords(plainText(output))
+
+	run := 1
+	for i := 1; i < len(words); i++ {
+		if words[i] != words[i-1] {
+			run = 1
+			continue
+		}
+		run++
+		if run > maxWordRun {
+			check.Passed = false
+			check.Detail = fmt.Sprintf("%q repeated %d times in a row", words[i], run)
+			return check
+		}
+	}
+
+	counts := make(map[string]int)
+	worst, worstCount := "", 0
+	for i := 0; i+loopGram <= len(words); i++ {
+		gram := strings.Join(words[i:i+loopGram], " ")
+		counts[gram]++
+		if counts[gram] > worstCount {
+			worst, worstCount = gram, counts[gram]
+		}
+	}
+	if worstCount > maxGramRepeats {
+		check.Passed = false
+		check.Detail = fmt.Sprintf("%q appears %d times", worst, worstCount)
+	}
+	return check
+}
+
+var emphasizedLine = regexp.MustCompile(`^([*_]+)\S.*\S([*_]+)$`)
+
+// sentenceEnd matches the characters prose may end with
+var sentenceEnd = regexp.MustCompile(`[.!?:;…"'”’»)\]。！？]$`)
+
+// checkFinished fails output that stops mid-sentence or inside a code
+// block, as output cut off at the token limit does
+func checkFinished(output string) QualityCheck {
+	check := QualityCheck{Name: "finished", Passed: true}
+	if strings.Count(output, "```")%2 != 0 {
+		check.Passed = false
+		check.Detail = "code block is not closed"
+		return check
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	last := strings.TrimSpace(lines[len(lines)-1])
+	if strings.HasPrefix(last, "```") || last == "" {
+		return check
+	}
+	if headingLine.MatchString(last) {
+		check.Passed = false
+		check.Detail = "ends with a heading"
+		return check
+	}
+	// List items need no punctuation, and a line wrapped in emphasis,
+	// like a byline, was not cut off before its closing marker
+	if listMarker.MatchString(last) || emphasizedLine.MatchString(last) {
+		return check
+	}
+	prose := strings.TrimRight(last, "*_` ")
+	if !sentenceEnd.MatchString(prose) {
+		check.Passed = false
+		if r := []rune(prose); len(r) > 60 {
+			prose = "..." + string(r[len(r)-57:])
+		}
+		check.Detail = fmt.Sprintf("ends mid-sentence: %q", prose)
+	}
+	return check
+}
+
+func checkBannedPhrases(output string) QualityCheck {
+	check := QualityCheck{Name: "banned_phrases", Passed: true}
+	lower := strings.ToLower(output)
+	var found []string
+	for _, phrase := range cfg.Quality.BannedPhrases {
+		if phrase != "" && strings.Contains(lower, strings.ToLower(phrase)) {
+			found = append(found, fmt.Sprintf("%q", phrase))
+		}
+	}
+	if len(found) > 0 {
+		check.Passed = false
+		check.Detail = "contains " + strings.Join(found, ", ")
+	}
+	return check
+}
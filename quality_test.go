@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestCheckLanguage(t *testing.T) {
+	english := "The garden is a quiet place where we can rest after work. We planted tomatoes and beans in the spring, and the children water them every evening before dinner."
+	tests := []struct {
+		name      string
+		backend   string
+		requested string
+		pass      bool
+	}{
+		{"no language asked for", BackendLlamaServer, "", true},
+		{"matching", BackendLlamaServer, "en-GB", true},
+		{"wrong language", BackendLlamaServer, "de", false},
+		{"local with a built-in article", BackendLocal, "de", false},
+		{"local English fallback", BackendLocal, "ja", true},
+	}
+	for _, tt := range tests {
+		if got := checkLanguage(tt.backend, tt.requested, english); got.Passed != tt.pass {
+			t.Errorf("%s: passed = %v, want %v (%s)", tt.name, got.Passed, tt.pass, got.Detail)
+		}
+	}
+}
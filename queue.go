@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Workers in any number of processes share the jobs table. A worker owns a
+// job once claimJob has moved it from pending to processing under its ID;
+// a claim older than the lease is assumed to belong to a dead worker and
+// the job goes back to pending. A worker renews its claim while the job
+// runs, so the lease bounds how long a worker may be silent, not how long
+// a job may take.
+
+// workerID names this process in claimed_by
+func workerID() string {
+	if cfg.Worker.ID != "" {
+		return cfg.Worker.ID
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "worker"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// claimJob takes a pending job for worker. It reports false when another
+// worker got there first. The claim gets its own trace, linked to the one
+// that created the job.
+func claimJob(job *Job, worker string) (bool, error) {
+	ctx, span := tracer.Start(context.Background(), "claimJob", jobTraceLink(job)...)
+	defer span.End()
+	span.SetAttributes(attribute.Int("job.id", job.ID), attribute.String("worker.id", worker))
+
+	now := time.Now()
+	result, err := dbExec(ctx, "claimJob", `UPDATE jobs SET status = 'processing', claimed_by = ?, claimed_at = ?, attempts = attempts + 1, updated_at = ? WHERE id = ? AND status = 'pending'`,
+		worker, now, now, job.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim job: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		span.SetAttributes(attribute.Bool("job.claimed", false))
+		return false, nil
+	}
+
+	job.Status = "processing"
+	job.ClaimedBy = worker
+	job.Attempts++
+	return true, nil
+}
+
+// finishJob records the result of a claimed job. It fails if the claim has
+// been lost, so a worker whose lease expired cannot overwrite the result of
+// the worker that took the job over.
+func finishJob(ctx context.Context, job *Job, worker, status, output string) error {
+	result, err := dbExec(ctx, "finishJob", `UPDATE jobs SET status = ?, output = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'processing' AND claimed_by = ?`,
+		status, output, job.ID, worker)
+	if err != nil {
+		return fmt.Errorf("failed to update job: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("job not found or claimed by another worker")
+	}
+	return nil
+}
+
+// renewClaim moves a claimed job's claimed_at to now, so a job that runs
+// longer than the lease is not taken for abandoned. Like finishJob it fails
+// if the claim has been lost.
+func renewClaim(ctx context.Context, job *Job, worker string) error {
+	result, err := dbExec(ctx, "renewClaim", `UPDATE jobs SET claimed_at = ? WHERE id = ? AND status = 'processing' AND claimed_by = ?`,
+		time.Now(), job.ID, worker)
+	if err != nil {
+		return fmt.Errorf("failed to renew claim: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("job not found or claimed by another worker")
+	}
+	return nil
+}
+
+// requeueJob returns a claimed job to the queue to be generated again. Like
+// finishJob it fails if the claim has been lost.
+func requeueJob(ctx context.Context, job *Job, worker string) error {
+	result, err := dbExec(ctx, "requeueJob", `UPDATE jobs SET status = 'pending', output = '', claimed_by = NULL, claimed_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'processing' AND claimed_by = ?`,
+		job.ID, worker)
+	if err != nil {
+		return fmt.Errorf("failed to requeue job: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("job not found or claimed by another worker")
+	}
+	return nil
+}
+
+// requeueExpiredClaims returns jobs whose claim is older than lease to the
+// queue. Jobs left processing before claims existed have no claimed_at and
+// are judged by updated_at.
+func requeueExpiredClaims(lease time.Duration) (int, error) {
+	cutoff := time.Now().Add(-lease)
+	result, err := db.Exec(`UPDATE jobs SET status = 'pending', claimed_by = NULL, claimed_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE status = 'processing' AND COALESCE(claimed_at, updated_at) < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue expired claims: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	return int(rowsAffected), nil
+}
+
+// wakeSignal is the worker_signals row /api/process bumps
+const wakeSignal = "wake"
+
+// signalWorkers asks every worker to look for jobs now rather than at its
+// next poll.
+func signalWorkers(ctx context.Context) error {
+	_, err := dbExec(ctx, "signalWorkers", `INSERT INTO worker_signals (name, seq, updated_at) VALUES (?, 1, CURRENT_TIMESTAMP)
+		ON CONFLICT(name) DO UPDATE SET seq = seq + 1, updated_at = CURRENT_TIMESTAMP`, wakeSignal)
+	if err != nil {
+		return fmt.Errorf("failed to signal workers: %v", err)
+	}
+	return nil
+}
+
+func wakeSeq() (int64, error) {
+	var seq int64
+	err := db.QueryRow(`SELECT seq FROM worker_signals WHERE name = ?`, wakeSignal).Scan(&seq)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to read worker signal: %v", err)
+	}
+	return seq, nil
+}
+
+// Worker states reported in the workers table
+const (
+	WorkerIdle    = "idle"
+	WorkerBusy    = "busy"
+	WorkerStopped = "stopped"
+	// WorkerUnresponsive is reported, never stored, for workers that have
+	// missed several heartbeats
+	WorkerUnresponsive = "unresponsive"
+)
+
+// recordWorkerState is a worker's heartbeat: it stores what the worker is
+// doing and when it was last seen.
+func recordWorkerState(worker, state string, jobID *int, startedAt time.Time) error {
+	_, err := db.Exec(`INSERT INTO workers (id, state, job_id, started_at, last_seen_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET state = excluded.state, job_id = excluded.job_id, started_at = excluded.started_at, last_seen_at = excluded.last_seen_at`,
+		worker, state, jobID, startedAt, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to record worker state: %v", err)
+	}
+	return nil
+}
+
+// listWorkers returns workers seen since the given time. An idle worker
+// that has missed heartbeats for staleAfter, or a busy one silent for longer
+// than its lease, is reported as unresponsive.
+func listWorkers(since time.Time, staleAfter time.Duration) ([]WorkerStatus, error) {
+	rows, err := db.Query(`SELECT id, state, job_id, started_at, last_seen_at FROM workers WHERE last_seen_at >= ? ORDER BY id`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workers: %v", err)
+	}
+	defer rows.Close()
+
+	var workers []WorkerStatus
+	for rows.Next() {
+		var ws WorkerStatus
+		var jobID sql.NullInt64
+		if err := rows.Scan(&ws.ID, &ws.State, &jobID, &ws.StartedAt, &ws.LastSeenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan worker: %v", err)
+		}
+		ws.JobID = nullIntPtr(jobID)
+		limit := staleAfter
+		if ws.State == WorkerBusy {
+			limit = cfg.Worker.LeaseTimeout
+		}
+		if ws.State != WorkerStopped && time.Since(ws.LastSeenAt) > limit {
+			ws.State = WorkerUnresponsive
+		}
+		workers = append(workers, ws)
+	}
+	return workers, rows.Err()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// QuotaLimits caps generation per period. Zero means unlimited.
+type QuotaLimits struct {
+	DailyJobs     int `json:"daily_job_limit"`
+	MonthlyJobs   int `json:"monthly_job_limit"`
+	DailyTokens   int `json:"daily_token_limit"`
+	MonthlyTokens int `json:"monthly_token_limit"`
+}
+
+// QuotaUsage is one metered limit: jobs or tokens, per day or month, for a
+// workspace or an API key.
+type QuotaUsage struct {
+	Scope   string    `json:"scope"`
+	Period  string    `json:"period"`
+	Metric  string    `json:"metric"`
+	Used    int       `json:"used"`
+	Limit   int       `json:"limit"`
+	ResetAt time.Time `json:"reset_at"`
+}
+
+func (u QuotaUsage) Exceeded() bool {
+	return u.Limit > 0 && u.Used >= u.Limit
+}
+
+func (u QuotaUsage) Remaining() int {
+	if u.Used >= u.Limit {
+		return 0
+	}
+	return u.Limit - u.Used
+}
+
+// estimateTokens approximates a token count at four characters per token
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// rowQuerier is a *sql.DB, or a *sql.Tx when usage is checked while a job
+// is being created
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// usageSince sums the jobs queued and tokens generated since a time by
+// usage events matching column = id. Events are never removed, so deleting
+// or retrying a job does not give quota back.
+func usageSince(q rowQuerier, column string, id int, since time.Time) (jobs, tokens int, err error) {
+	query := fmt.Sprintf(`SELECT COALESCE(SUM(jobs), 0), COALESCE(SUM(tokens), 0) FROM usage_events WHERE %s = ? AND created_at >= ?`, column)
+	if err := q.QueryRow(query, id, since).Scan(&jobs, &tokens); err != nil {
+		return 0, 0, fmt.Errorf("failed to measure usage: %v", err)
+	}
+	return jobs, tokens, nil
+}
+
+func quotaUsage(q rowQuerier, scope, column string, id int, limits QuotaLimits) ([]QuotaUsage, error) {
+	now := time.Now()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	dayJobs, dayTokens, err := usageSince(q, column, id, startOfDay)
+	if err != nil {
+		return nil, err
+	}
+	monthJobs, monthTokens, err := usageSince(q, column, id, startOfMonth)
+	if err != nil {
+		return nil, err
+	}
+
+	day, month := startOfDay.AddDate(0, 0, 1), startOfMonth.AddDate(0, 1, 0)
+	return []QuotaUsage{
+		{scope, "daily", "jobs", dayJobs, limits.DailyJobs, day},
+		{scope, "monthly", "jobs", monthJobs, limits.MonthlyJobs, month},
+		{scope, "daily", "tokens", dayTokens, limits.DailyTokens, day},
+		{scope, "monthly", "tokens", monthTokens, limits.MonthlyTokens, month},
+	}, nil
+}
+
+// principalQuotaUsage reports every quota that applies to the caller: its
+// workspace's, and its API key's when it authenticated with one.
+func principalQuotaUsage(q rowQuerier, p *Principal) ([]QuotaUsage, error) {
+	ws, err := getWorkspace(p.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := quotaUsage(q, "workspace", "workspace_id", ws.ID, ws.QuotaLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.KeyID != 0 {
+		limits, err := apiKeyQuotaLimits(p.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		keyUsage, err := quotaUsage(q, "api_key", "api_key_id", p.KeyID, limits)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, keyUsage...)
+	}
+	return usage, nil
+}
+
+// QuotaError is returned by createJob when the job would go over a quota
+type QuotaError struct {
+	Quota QuotaUsage
+}
+
+func (e *QuotaError) Error() string {
+	q := e.Quota
+	return fmt.Sprintf("%s %s %s quota of %d reached", q.Scope, q.Period, q.Metric, q.Limit)
+}
+
+// quotaCheck is createJob's check for the caller's quotas. The new job is
+// already counted when it runs, so it is left out of the job totals.
+func quotaCheck(p *Principal) func(q rowQuerier) error {
+	return func(q rowQuerier) error {
+		usage, err := principalQuotaUsage(q, p)
+		if err != nil {
+			return err
+		}
+		for i := range usage {
+			if usage[i].Metric == "jobs" {
+				usage[i].Used--
+			}
+		}
+		if tightest, ok := tightestQuota(usage); ok && tightest.Exceeded() {
+			return &QuotaError{Quota: tightest}
+		}
+		return nil
+	}
+}
+
+// tightestQuota returns the exceeded quota that resets last, or else the
+// limited quota with the least headroom. ok is false when nothing is limited.
+func tightestQuota(usage []QuotaUsage) (tightest QuotaUsage, ok bool) {
+	for _, u := range usage {
+		if u.Limit == 0 {
+			continue
+		}
+		switch {
+		case !ok:
+			tightest, ok = u, true
+		case u.Exceeded() && (!tightest.Exceeded() || u.ResetAt.After(tightest.ResetAt)):
+			tightest = u
+		case !tightest.Exceeded() && !u.Exceeded() && u.Remaining() < tightest.Remaining():
+			tightest = u
+		}
+	}
+	return tightest, ok
+}
+
+// enforceQuota sets the X-Quota-* headers and writes a 429 response when the
+// caller may not queue another job. It reports whether the request may
+// proceed; createJob checks again as it queues the job.
+func enforceQuota(w http.ResponseWriter, p *Principal) bool {
+	usage, err := principalQuotaUsage(db, p)
+	if err != nil {
+		writeErrorResponse(w, "Failed to check quota", http.StatusInternalServerError)
+		return false
+	}
+
+	q, ok := tightestQuota(usage)
+	if !ok {
+		return true
+	}
+
+	w.Header().Set("X-Quota-Limit", strconv.Itoa(q.Limit))
+	w.Header().Set("X-Quota-Remaining", strconv.Itoa(q.Remaining()))
+	w.Header().Set("X-Quota-Reset", strconv.FormatInt(q.ResetAt.Unix(), 10))
+	if q.Exceeded() {
+		writeQuotaExceeded(w, q)
+		return false
+	}
+	return true
+}
+
+// writeQuotaExceeded writes the 429 response for a quota that has been reached
+func writeQuotaExceeded(w http.ResponseWriter, q QuotaUsage) {
+	retry := int(time.Until(q.ResetAt).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeErrorResponse(w, (&QuotaError{Quota: q}).Error(), http.StatusTooManyRequests)
+}
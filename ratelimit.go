@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// RateLimiter keeps one token bucket per client. Buckets idle long enough
+// to be full again are dropped.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow takes a token for client. It returns the tokens left and, when
+// refused, how long until the next token is available.
+func (l *RateLimiter) Allow(client string) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.rate)
+	b.lastSeen = now
+
+	if len(l.buckets) > 10000 {
+		l.prune(now)
+	}
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, 0, wait
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+func (l *RateLimiter) prune(now time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, b := range l.buckets {
+		if now.Sub(b.lastSeen) > full {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// apiRateLimiter limits authenticated API callers; loginRateLimiter limits
+// login attempts per IP address.
+var (
+	apiRateLimiter   *RateLimiter
+	loginRateLimiter *RateLimiter
+)
+
+func initRateLimiters() {
+	apiRateLimiter = NewRateLimiter(cfg.Auth.RateLimitRPS, cfg.Auth.RateLimitBurst)
+	loginRateLimiter = NewRateLimiter(cfg.Auth.LoginRateLimitRPS, cfg.Auth.LoginRateLimitBurst)
+}
+
+// rateLimitMiddleware must run after authMiddleware: callers are limited per
+// API key or user, and by IP address only when neither is known.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !applyRateLimit(w, apiRateLimiter, rateLimitClient(r)) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// applyRateLimit writes the rate limit headers, and the 429 response when
+// the client is over its limit. It reports whether the request may proceed.
+func applyRateLimit(w http.ResponseWriter, limiter *RateLimiter, client string) bool {
+	ok, remaining, wait := limiter.Allow(client)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(limiter.burst)))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeErrorResponse(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func rateLimitClient(r *http.Request) string {
+	if p := principalFromContext(r.Context()); p != nil {
+		if p.UserID != 0 {
+			return fmt.Sprintf("user:%d", p.UserID)
+		}
+		return fmt.Sprintf("key:%d", p.KeyID)
+	}
+	return "ip:" + clientIP(r)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
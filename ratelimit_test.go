@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := NewRateLimiter(1, 3)
+	for want := 2; want >= 0; want-- {
+		ok, remaining, _ := l.Allow("a")
+		if !ok || remaining != want {
+			t.Fatalf("got allowed=%v remaining=%d, want allowed with %d left", ok, remaining, want)
+		}
+	}
+	ok, _, wait := l.Allow("a")
+	if ok {
+		t.Fatal("request past the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("got wait %v, want up to one second", wait)
+	}
+	if ok, _, _ := l.Allow("b"); !ok {
+		t.Error("another client shares the first client's bucket")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := NewRateLimiter(2, 4)
+	for i := 0; i < 4; i++ {
+		l.Allow("a")
+	}
+	l.buckets["a"].lastSeen = time.Now().Add(-time.Second)
+	ok, remaining, _ := l.Allow("a")
+	if !ok || remaining != 1 {
+		t.Errorf("after one second got allowed=%v remaining=%d, want allowed with 1 left", ok, remaining)
+	}
+
+	l.buckets["a"].lastSeen = time.Now().Add(-time.Hour)
+	if _, remaining, _ := l.Allow("a"); remaining != 3 {
+		t.Errorf("after an hour got %d left, want the bucket capped at the burst", remaining)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := NewRateLimiter(1, 2)
+	l.Allow("idle")
+	l.Allow("busy")
+	l.buckets["idle"].lastSeen = time.Now().Add(-time.Minute)
+	l.prune(time.Now())
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("idle bucket was not pruned")
+	}
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Error("busy bucket was pruned")
+	}
+}
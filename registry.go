@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The model registry is every .gguf and .ggml file in generator.model_dirs.
+// Models are known by file name; when two directories hold the same name,
+// the one in the earlier directory wins. The instance default lives in the
+// settings table, so switching it reaches every process without a restart.
+
+const settingDefaultModel = "default_model"
+
+// modelCache keeps parsed metadata by path until the file's size or
+// modification time changes
+var modelCache = struct {
+	sync.Mutex
+	byPath map[string]ModelInfo
+}{byPath: make(map[string]ModelInfo)}
+
+func isModelFile(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".gguf") || strings.HasSuffix(name, ".ggml")
+}
+
+// scanModels lists the models in the model directories, in directory
+// order and then by name, as findModel has always searched them
+func scanModels() []ModelInfo {
+	seen := make(map[string]bool)
+	var models []ModelInfo
+	for _, dir := range cfg.Generator.ModelDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("failed to read model directory", "dir", dir, "error", err)
+			}
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isModelFile(entry.Name()) || seen[entry.Name()] {
+				continue
+			}
+			fi, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			seen[entry.Name()] = true
+			models = append(models, modelInfo(filepath.Join(dir, entry.Name()), fi))
+		}
+	}
+	return models
+}
+
+func modelInfo(path string, fi os.FileInfo) ModelInfo {
+	modelCache.Lock()
+	cached, ok := modelCache.byPath[path]
+	modelCache.Unlock()
+	if ok && cached.SizeBytes == fi.Size() && cached.ModifiedAt.Equal(fi.ModTime()) {
+		return cached
+	}
+
+	info := ModelInfo{
+		Name:       fi.Name(),
+		Path:       path,
+		Format:     strings.TrimPrefix(strings.ToLower(filepath.Ext(fi.Name())), "."),
+		SizeBytes:  fi.Size(),
+		ModifiedAt: fi.ModTime(),
+	}
+	// Whatever the extension says, only a valid GGUF file is usable
+	gguf, err := parseGGUF(path)
+	if err != nil {
+		slog.Warn("model rejected", "model", info.Name, "error", err)
+		info.Error = err.Error()
+	} else {
+		info.GGUF = gguf
+		info.Architecture = gguf.Architecture
+		info.ParameterCount = gguf.ParameterCount
+		info.Quantization = gguf.Quantization
+		info.ContextLength = gguf.ContextLength
+	}
+
+	modelCache.Lock()
+	modelCache.byPath[path] = info
+	modelCache.Unlock()
+	return info
+}
+
+// listModels scans the model directories and marks the instance default:
+// the model set at runtime or, failing that, the first usable one found.
+func listModels(ctx context.Context) ([]ModelInfo, error) {
+	models := scanModels()
+	name, err := getSetting(ctx, settingDefaultModel)
+	if err != nil {
+		return nil, err
+	}
+
+	def := -1
+	for i := range models {
+		if models[i].Name == name && models[i].Error == "" {
+			def = i
+			break
+		}
+	}
+	if def < 0 && name != "" {
+		slog.Warn("default model not found or unusable, using the first model found", "model", name)
+	}
+	for i := range models {
+		if def < 0 && models[i].Error == "" {
+			def = i
+		}
+	}
+	if def >= 0 {
+		models[def].Default = true
+	}
+	return models, nil
+}
+
+// lookupModel finds a usable model by file name
+func lookupModel(name string) (*ModelInfo, error) {
+	for _, m := range scanModels() {
+		if m.Name == name {
+			if m.Error != "" {
+				return nil, fmt.Errorf("model %s is unusable: %s", name, m.Error)
+			}
+			return &m, nil
+		}
+	}
+	return nil, fmt.Errorf("model %s not found", name)
+}
+
+// defaultModel returns the instance default model, or nil when there are
+// no usable models
+func defaultModel(ctx context.Context) (*ModelInfo, error) {
+	models, err := listModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range models {
+		if m.Default {
+			return &m, nil
+		}
+	}
+	return nil, nil
+}
+
+// setDefaultModel switches the instance default. An empty name goes back
+// to the first model found.
+func setDefaultModel(ctx context.Context, name string) error {
+	if name != "" {
+		if _, err := lookupModel(name); err != nil {
+			return err
+		}
+	}
+	return setSetting(ctx, settingDefaultModel, name)
+}
+
+// findModel returns the path of the instance default model, or "" when no
+// model is available
+func findModel() string {
+	m, err := defaultModel(context.Background())
+	if err != nil {
+		slog.Error("failed to find default model", "error", err)
+		reportError(ComponentGenerator, err)
+		return ""
+	}
+	if m == nil {
+		return ""
+	}
+	return m.Path
+}
+
+// logModels reports what each model file is at startup. Rejected files are
+// logged as they are scanned.
+func logModels() {
+	models, err := listModels(context.Background())
+	if err != nil {
+		slog.Error("failed to list models", "error", err)
+		return
+	}
+
+	var def *ModelInfo
+	for i, m := range models {
+		if m.Error != "" {
+			continue
+		}
+		slog.Info("model available", "model", m.Name,
+			"architecture", m.Architecture,
+			"parameters", formatParameterCount(m.ParameterCount),
+			"quantization", m.Quantization,
+			"context_length", m.ContextLength,
+			"chat_template", m.GGUF.ChatTemplate != "",
+			"tokenizer", m.GGUF.Tokenizer.Model,
+			"vocab_size", m.GGUF.Tokenizer.VocabSize)
+		if m.Default {
+			def = &models[i]
+		}
+	}
+
+	if def != nil {
+		slog.Info("local model detected", "model", def.Path)
+	} else {
+		slog.Info("no local model found - using enhanced fallback generation")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// Scheduler picks the next pending job. Higher priorities always go first;
+// within a priority level clients are served round-robin so one large batch
+// cannot starve everyone else queued at the same level. Only admins may
+// queue above the default level, so other callers all share it.
+type Scheduler struct {
+	mu sync.Mutex
+	// lastClient remembers who was served last at each priority level
+	lastClient map[int]string
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{lastClient: make(map[int]string)}
+}
+
+// maxClaimAttempts bounds how often Next retries after other workers claim
+// the job it picked
+const maxClaimAttempts = 5
+
+// Next picks the next job and claims it for worker. It returns nil when
+// there is nothing to do.
+func (s *Scheduler) Next(worker string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		job, err := s.pick()
+		if err != nil || job == nil {
+			return nil, err
+		}
+		claimed, err := claimJob(job, worker)
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			s.lastClient[job.Priority] = job.ClientID
+			return job, nil
+		}
+	}
+	return nil, nil
+}
+
+// pick chooses the pending job to serve next without claiming it
+func (s *Scheduler) pick() (*Job, error) {
+	var priority sql.NullInt64
+	err := db.QueryRow(`SELECT MAX(priority) FROM jobs WHERE status = 'pending'`).Scan(&priority)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find top priority: %v", err)
+	}
+	if !priority.Valid {
+		return nil, nil
+	}
+	level := int(priority.Int64)
+
+	clients, err := pendingClients(level)
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, nil
+	}
+
+	client := nextClient(clients, s.lastClient[level])
+
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE status = 'pending' AND priority = ? AND client_id = ? ORDER BY created_at ASC, id ASC LIMIT 1`
+	job, err := scanJob(db.QueryRow(query, level, client))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get pending job: %v", err)
+	}
+	return job, nil
+}
+
+func pendingClients(priority int) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT client_id FROM jobs WHERE status = 'pending' AND priority = ? ORDER BY client_id`, priority)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending clients: %v", err)
+	}
+	defer rows.Close()
+
+	var clients []string
+	for rows.Next() {
+		var client string
+		if err := rows.Scan(&client); err != nil {
+			return nil, fmt.Errorf("failed to scan client: %v", err)
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+// nextClient returns the first client sorted after last, wrapping around.
+// clients must be sorted.
+func nextClient(clients []string, last string) string {
+	for _, c := range clients {
+		if c > last {
+			return c
+		}
+	}
+	return clients[0]
+}
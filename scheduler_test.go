@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestNextClient(t *testing.T) {
+	clients := []string{"alice", "bob", "carol"}
+	tests := []struct {
+		last string
+		want string
+	}{
+		{"", "alice"},
+		{"alice", "bob"},
+		{"bob", "carol"},
+		{"carol", "alice"},
+		// A client that has no pending jobs left keeps its place in the order
+		{"bobby", "carol"},
+		{"zed", "alice"},
+	}
+	for _, tt := range tests {
+		if got := nextClient(clients, tt.last); got != tt.want {
+			t.Errorf("nextClient after %q = %q, want %q", tt.last, got, tt.want)
+		}
+	}
+
+	if got := nextClient([]string{"alice"}, "alice"); got != "alice" {
+		t.Errorf("only client got %q, want it picked again", got)
+	}
+}
+
+func TestNextClientRoundRobin(t *testing.T) {
+	clients := []string{"a", "b", "c"}
+	counts := make(map[string]int)
+	last := ""
+	for i := 0; i < 30; i++ {
+		last = nextClient(clients, last)
+		counts[last]++
+	}
+	for _, c := range clients {
+		if counts[c] != 10 {
+			t.Errorf("client %q picked %d times in 30, want 10", c, counts[c])
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SEOReport is the publishing metadata derived from a job's output, with
+// an analysis of how well the output is written for search
+type SEOReport struct {
+	MetaTitle       string       `json:"meta_title"`
+	MetaDescription string       `json:"meta_description"`
+	Slug            string       `json:"slug"`
+	Keywords        []string     `json:"keywords"`
+	Headings        []SEOHeading `json:"headings"`
+	// Score is the weighted average of the checks, from 0 to 100
+	Score  int       `json:"score"`
+	Checks SEOChecks `json:"checks"`
+}
+
+type SEOHeading struct {
+	Level int    `json:"level"`
+	Text  string `json:"text"`
+}
+
+type SEOChecks struct {
+	// KeywordDensity's value is the mean density of the keywords, in percent
+	KeywordDensity SEOCheck `json:"keyword_density"`
+	// HeadingHierarchy's value is the number of headings
+	HeadingHierarchy SEOCheck `json:"heading_hierarchy"`
+	// Readability's value is the Flesch reading ease
+	Readability SEOCheck `json:"readability"`
+	// Length's value is the word count
+	Length SEOCheck `json:"length"`
+}
+
+type SEOCheck struct {
+	Score  int      `json:"score"`
+	Value  float64  `json:"value"`
+	Issues []string `json:"issues,omitempty"`
+}
+
+const (
+	maxMetaTitle       = 60
+	maxMetaDescription = 160
+	maxSlug            = 80
+	derivedKeywords    = 5
+
+	// Keyword density in percent that reads naturally
+	minKeywordDensity = 0.5
+	maxKeywordDensity = 2.5
+	// recommendedWords is the length search favours when a job set no target
+	recommendedWords = 600
+)
+
+// Weights of the checks in the overall score
+var seoWeights = struct{ density, headings, readability, length float64 }{0.30, 0.25, 0.20, 0.25}
+
+var headingLine = regexp.MustCompile(`^(#{1,6})\s+(.+?)\s*#*\s*$`)
+
+// articleBody drops the outline generators put before the article
+func articleBody(output string) string {
+	if i := strings.Index(output, "## ARTICLE"); i >= 0 {
+		return strings.TrimSpace(output[i+len("## ARTICLE"):])
+	}
+	return output
+}
+
+// analyzeSEO builds the SEO block for a job's output
+func analyzeSEO(job *Job, output string, params GenerationParams) *SEOReport {
+	body := articleBody(output)
+	headings := parseHeadings(body)
+	stats := analyzeText(body)
+	words := textWords(plainText(body))
+
+	report := &SEOReport{Headings: headings}
+	report.MetaTitle = job.Topic
+	for _, h := range headings {
+		if h.Level == 1 {
+			report.MetaTitle = h.Text
+			break
+		}
+	}
+	report.MetaTitle = truncateWords(report.MetaTitle, maxMetaTitle)
+	report.MetaDescription = truncateWords(firstParagraph(body), maxMetaDescription)
+	report.Slug = slugify(report.MetaTitle)
+	if report.Slug == "" {
+		// A title in a script slugify cannot spell, such as Japanese
+		report.Slug = fmt.Sprintf("job-%d", job.ID)
+	}
+
+	if len(params.Keywords) > 0 {
+		report.Keywords = params.Keywords
+	} else {
+		report.Keywords = deriveKeywords(job.Topic, words)
+	}
+
+	report.Checks = SEOChecks{
+		KeywordDensity:   checkKeywordDensity(report.Keywords, words),
+		HeadingHierarchy: checkHeadings(headings, len(words)),
+		Readability:      checkReadability(stats),
+		Length:           checkLength(job.Type, params.WordCount, len(words)),
+	}
+	report.Score = int(math.Round(
+		seoWeights.density*float64(report.Checks.KeywordDensity.Score) +
+			seoWeights.headings*float64(report.Checks.HeadingHierarchy.Score) +
+			seoWeights.readability*float64(report.Checks.Readability.Score) +
+			seoWeights.length*float64(report.Checks.Length.Score)))
+	return report
+}
+
+func parseHeadings(markdown string) []SEOHeading {
+	headings := []SEOHeading{}
+	for _, line := range strings.Split(markdown, "\n") {
+		m := headingLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		text := strings.TrimSpace(markdownEmphasis.ReplaceAllString(m[2], ""))
+		headings = append(headings, SEOHeading{Level: len(m[1]), Text: text})
+	}
+	return headings
+}
+
+// firstParagraph returns the first run of prose lines, skipping headings,
+// lists and quotes
+func firstParagraph(markdown string) string {
+	var para []string
+	for _, line := range strings.Split(markdown, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || listMarker.MatchString(line) {
+			if len(para) > 0 {
+				break
+			}
+			continue
+		}
+		para = append(para, line)
+	}
+	return plainText(strings.Join(para, " "))
+}
+
+// truncateWords shortens s to at most max characters, cutting at a word
+// boundary
+func truncateWords(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	cut := string(runes[:max-3])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,;:.-") + "..."
+}
+
+var slugFolds = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a",
+	"ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y",
+	"ß", "ss", "æ", "ae", "œ", "oe", "ø", "o",
+	// Cyrillic
+	"а", "a", "б", "b", "в", "v", "г", "g", "д", "d", "е", "e", "ё", "e",
+	"ж", "zh", "з", "z", "и", "i", "й", "y", "к", "k", "л", "l", "м", "m",
+	"н", "n", "о", "o", "п", "p", "р", "r", "с", "s", "т", "t", "у", "u",
+	"ф", "f", "х", "kh", "ц", "ts", "ч", "ch", "ш", "sh", "щ", "shch",
+	"ъ", "", "ы", "y", "ь", "", "э", "e", "ю", "yu", "я", "ya",
+	// Greek, with its digraph first
+	"ου", "ou", "ού", "ou",
+	"α", "a", "ά", "a", "β", "v", "γ", "g", "δ", "d", "ε", "e", "έ", "e",
+	"ζ", "z", "η", "i", "ή", "i", "θ", "th", "ι", "i", "ί", "i", "ϊ", "i",
+	"ΐ", "i", "κ", "k", "λ", "l", "μ", "m", "ν", "n", "ξ", "x", "ο", "o",
+	"ό", "o", "π", "p", "ρ", "r", "σ", "s", "ς", "s", "τ", "t", "υ", "y",
+	"ύ", "y", "ϋ", "y", "ΰ", "y", "φ", "f", "χ", "ch", "ψ", "ps", "ω", "o",
+	"ώ", "o",
+)
+
+// slugify makes a URL path segment from a title: lowercase ASCII letters
+// and digits separated by hyphens. Latin accents are dropped and Cyrillic
+// and Greek transliterated; other scripts leave nothing.
+func slugify(title string) string {
+	s := slugFolds.Replace(strings.ToLower(title))
+	var b strings.Builder
+	dash := false
+	for _, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimSuffix(b.String(), "-")
+	if len(slug) > maxSlug {
+		slug = slug[:maxSlug]
+		if i := strings.LastIndex(slug, "-"); i > 0 {
+			slug = slug[:i]
+		}
+	}
+	return slug
+}
+
+// isStopword reports whether a word is a stopword in any language
+// detection knows
+func isStopword(word string) bool {
+	for _, set := range stopwordSets {
+		if set[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveKeywords uses the topic as the main keyword, followed by the most
+// frequent other words in the text
+func deriveKeywords(topic string, words []string) []string {
+	keywords := []string{}
+	topicWords := make(map[string]bool)
+	if t := strings.ToLower(strings.TrimSpace(topic)); t != "" {
+		keywords = append(keywords, t)
+		for _, w := range textWords(t) {
+			topicWords[w] = true
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, w := range words {
+		if len([]rune(w)) < 4 || isStopword(w) || topicWords[w] || !unicode.IsLetter([]rune(w)[0]) {
+			continue
+		}
+		counts[w]++
+	}
+	terms := make([]string, 0, len(counts))
+	for w, n := range counts {
+		if n > 1 {
+			terms = append(terms, w)
+		}
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if counts[terms[i]] != counts[terms[j]] {
+			return counts[terms[i]] > counts[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	for _, w := range terms {
+		if len(keywords) == derivedKeywords {
+			break
+		}
+		keywords = append(keywords, w)
+	}
+	return keywords
+}
+
+// keywordOccurrences counts a keyword phrase as a run of whole words
+func keywordOccurrences(keyword string, words []string) int {
+	phrase := textWords(keyword)
+	if len(phrase) == 0 {
+		return 0
+	}
+	n := 0
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		match := true
+		for j, p := range phrase {
+			if words[i+j] != p {
+				match = false
+				break
+			}
+		}
+		if match {
+			n++
+		}
+	}
+	return n
+}
+
+func checkKeywordDensity(keywords []string, words []string) SEOCheck {
+	check := SEOCheck{Score: 100}
+	if len(keywords) == 0 || len(words) == 0 {
+		check.Score = 0
+		check.Issues = append(check.Issues, "no keywords to check")
+		return check
+	}
+	total, sum := 0, 0.0
+	for _, k := range keywords {
+		density := float64(keywordOccurrences(k, words)*len(textWords(k))) / float64(len(words)) * 100
+		sum += density
+		score := 100
+		switch {
+		case density == 0:
+			score = 0
+			check.Issues = append(check.Issues, fmt.Sprintf("keyword %q does not appear", k))
+		case density < minKeywordDensity:
+			score = 60
+			check.Issues = append(check.Issues, fmt.Sprintf("keyword %q is rare (%.1f%%)", k, density))
+		case density > 2*maxKeywordDensity:
+			score = 30
+			check.Issues = append(check.Issues, fmt.Sprintf("keyword %q is stuffed (%.1f%%)", k, density))
+		case density > maxKeywordDensity:
+			score = 70
+			check.Issues = append(check.Issues, fmt.Sprintf("keyword %q may be overused (%.1f%%)", k, density))
+		}
+		total += score
+	}
+	check.Score = total / len(keywords)
+	check.Value = round1(sum / float64(len(keywords)))
+	return check
+}
+
+func checkHeadings(headings []SEOHeading, words int) SEOCheck {
+	check := SEOCheck{Score: 100, Value: float64(len(headings))}
+	h1, h2 := 0, 0
+	for i, h := range headings {
+		switch h.Level {
+		case 1:
+			h1++
+		case 2:
+			h2++
+		}
+		if i > 0 && h.Level > headings[i-1].Level+1 {
+			check.Score -= 15
+			check.Issues = append(check.Issues, fmt.Sprintf("heading %q skips from H%d to H%d", h.Text, headings[i-1].Level, h.Level))
+		}
+	}
+	if h1 == 0 {
+		check.Score -= 40
+		check.Issues = append(check.Issues, "no H1 heading")
+	} else if h1 > 1 {
+		check.Score -= 20
+		check.Issues = append(check.Issues, fmt.Sprintf("%d H1 headings, expected one", h1))
+	}
+	if len(headings) > 0 && headings[0].Level != 1 && h1 > 0 {
+		check.Score -= 10
+		check.Issues = append(check.Issues, "first heading is not the H1")
+	}
+	if words >= 300 && h2 < 2 {
+		check.Score -= 20
+		check.Issues = append(check.Issues, "fewer than two H2 sections")
+	}
+	if check.Score < 0 {
+		check.Score = 0
+	}
+	return check
+}
+
+func checkReadability(stats textStats) SEOCheck {
+	ease := stats.fleschReadingEase()
+	check := SEOCheck{Value: round1(ease)}
+	switch {
+	case ease >= 60:
+		check.Score = 100
+	case ease >= 50:
+		check.Score = 80
+		check.Issues = append(check.Issues, "fairly difficult to read")
+	case ease >= 30:
+		check.Score = 60
+		check.Issues = append(check.Issues, "difficult to read")
+	default:
+		check.Score = 30
+		check.Issues = append(check.Issues, "very difficult to read")
+	}
+	return check
+}
+
+// checkLength compares the length with the job's word_count, or without
+// one with what search favours for long-form types
+func checkLength(jobType string, target, words int) SEOCheck {
+	check := SEOCheck{Score: 100, Value: float64(words)}
+	if target > 0 {
+		off := math.Abs(float64(words-target)) / float64(target)
+		if off > 0.2 {
+			check.Score = int(math.Max(0, 100-(off-0.2)*150))
+			check.Issues = append(check.Issues, fmt.Sprintf("%d words, target was %d", words, target))
+		}
+		return check
+	}
+
+	ct, ok := contentTypes[jobType]
+	if !ok {
+		ct = otherContentType
+	}
+	recommended := recommendedWords
+	if ct.maxWords < recommended {
+		recommended = ct.minWords
+	}
+	switch {
+	case words < ct.minWords:
+		check.Score = 40
+		check.Issues = append(check.Issues, fmt.Sprintf("%d words is thin content for %s", words, jobType))
+	case words < recommended:
+		check.Score = 70
+		check.Issues = append(check.Issues, fmt.Sprintf("%d words is short for search, aim for %d", words, recommended))
+	case words > ct.maxWords:
+		check.Score = 80
+		check.Issues = append(check.Issues, fmt.Sprintf("%d words is long for %s", words, jobType))
+	}
+	return check
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Getting Started with Go 1.22", "getting-started-with-go-1-22"},
+		{"  Crème Brûlée: A Guide!  ", "creme-brulee-a-guide"},
+		{"Über Straßen", "uber-strassen"},
+		{"Как испечь хлеб", "kak-ispech-khleb"},
+		{"Ελληνική κουζίνα", "elliniki-kouzina"},
+		{"Python для начинающих", "python-dlya-nachinayushchikh"},
+		{"パンの焼き方", ""},
+		{"---", ""},
+	}
+	for _, tt := range tests {
+		if got := slugify(tt.title); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyzeSEOSlugFallback(t *testing.T) {
+	job := &Job{ID: 42, Topic: "パン", Type: "blog"}
+	report := analyzeSEO(job, "# パンの焼き方\n\n家でパンを焼くのは簡単です。", GenerationParams{})
+	if report.Slug != "job-42" {
+		t.Errorf("got slug %q, want job-42", report.Slug)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outputs are fingerprinted with MinHash over word shingles. The share of
+// matching signature slots between two fingerprints estimates the Jaccard
+// similarity of their shingle sets, so 0.8 means about 80% of the phrases
+// are shared.
+
+const (
+	// minhashSize is the number of hash functions in a signature
+	minhashSize = 64
+	// shingleSize is the number of words in a shingle
+	shingleSize = 3
+
+	defaultSimilarLimit = 10
+	maxSimilarLimit     = 100
+)
+
+// SimilarJob is an archived job compared with another one
+type SimilarJob struct {
+	JobID      int       `json:"job_id"`
+	Topic      string    `json:"topic"`
+	Status     string    `json:"status"`
+	Similarity float64   `json:"similarity"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// fingerprint computes the MinHash signature of a job's article, encoded
+// for storage. Text without words has no fingerprint.
+func fingerprint(output string) []byte {
+	words := textWords(plainText(articleBody(output)))
+	if len(words) == 0 {
+		return nil
+	}
+	size := shingleSize
+	if len(words) < size {
+		size = len(words)
+	}
+
+	var sig [minhashSize]uint32
+	for i := range sig {
+		sig[i] = ^uint32(0)
+	}
+	for i := 0; i+size <= len(words); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+size], " ")))
+		base := h.Sum64()
+		for j := range sig {
+			if v := uint32(mix64(base + uint64(j)*0x9e3779b97f4a7c15)); v < sig[j] {
+				sig[j] = v
+			}
+		}
+	}
+
+	buf := make([]byte, 4*minhashSize)
+	for i, v := range sig {
+		binary.LittleEndian.PutUint32(buf[4*i:], v)
+	}
+	return buf
+}
+
+// mix64 is the splitmix64 finalizer; seeding it differently for each slot
+// gives the independent hash functions MinHash needs
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// similarity estimates the Jaccard similarity of two fingerprints
+func similarity(a, b []byte) float64 {
+	if len(a) != 4*minhashSize || len(b) != 4*minhashSize {
+		return 0
+	}
+	same := 0
+	for i := 0; i < len(a); i += 4 {
+		if binary.LittleEndian.Uint32(a[i:]) == binary.LittleEndian.Uint32(b[i:]) {
+			same++
+		}
+	}
+	return float64(same) / minhashSize
+}
+
+// rankSimilar orders archived jobs by similarity to fp, most similar first
+func rankSimilar(fp []byte, archive []archivedFingerprint, limit int) []SimilarJob {
+	similar := make([]SimilarJob, 0, len(archive))
+	for _, a := range archive {
+		similar = append(similar, SimilarJob{
+			JobID:      a.ID,
+			Topic:      a.Topic,
+			Status:     a.Status,
+			Similarity: round2(similarity(fp, a.Fingerprint)),
+			CreatedAt:  a.CreatedAt,
+		})
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Similarity > similar[j].Similarity
+	})
+	if limit > 0 && len(similar) > limit {
+		similar = similar[:limit]
+	}
+	return similar
+}
+
+// closestJob finds the finished job in the workspace most similar to fp,
+// or nil when there is none to compare with
+func closestJob(ctx context.Context, workspaceID, jobID int, fp []byte) (*SimilarJob, error) {
+	if fp == nil {
+		return nil, nil
+	}
+	archive, err := jobFingerprints(ctx, JobFilter{WorkspaceID: workspaceID}, jobID)
+	if err != nil {
+		return nil, err
+	}
+	ranked := rankSimilar(fp, archive, 1)
+	if len(ranked) == 0 {
+		return nil, nil
+	}
+	return &ranked[0], nil
+}
+
+// isDuplicate reports whether closest passes quality.duplicate_threshold
+func isDuplicate(closest *SimilarJob) bool {
+	return closest != nil && cfg.Quality.DuplicateThreshold > 0 && closest.Similarity >= cfg.Quality.DuplicateThreshold
+}
+
+// checkDuplicate fails output too similar to an archived job. A threshold
+// of zero turns the check off. The local backend's articles share most of
+// their text with each other whatever the topic, so its output is not
+// compared.
+func checkDuplicate(backend string, closest *SimilarJob) QualityCheck {
+	check := QualityCheck{Name: "duplicate", Passed: true}
+	if backend == BackendLocal {
+		check.Detail = "not checked: the local backend writes from a built-in template"
+		return check
+	}
+	if isDuplicate(closest) {
+		check.Passed = false
+		check.Detail = fmt.Sprintf("%.2f similar to job %d (%s)", closest.Similarity, closest.JobID, closest.Topic)
+	}
+	return check
+}
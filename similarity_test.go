@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	articleA = "Sourdough starts with a culture of wild yeast and lactic acid bacteria. " +
+		"Feed the starter flour and water every day until it doubles within a few hours. " +
+		"Mix the dough, let it rest, then fold it every half hour to build strength. " +
+		"Shape the loaf, proof it overnight in the fridge and bake it in a hot covered pot."
+	articleB = "Container gardens suit balconies and small yards where soil is poor. " +
+		"Pick pots with drainage holes and fill them with a light potting mix. " +
+		"Tomatoes, peppers and herbs grow well when they get six hours of sun. " +
+		"Water deeply once the top inch of soil is dry and feed them every two weeks."
+)
+
+func TestFingerprintSimilarity(t *testing.T) {
+	a := fingerprint(articleA)
+	if len(a) != 4*minhashSize {
+		t.Fatalf("fingerprint is %d bytes, want %d", len(a), 4*minhashSize)
+	}
+	if got := similarity(a, fingerprint(articleA)); got != 1 {
+		t.Errorf("identical articles are %.2f similar, want 1", got)
+	}
+	if got := similarity(a, fingerprint("# Bread\n\n## ARTICLE\n**"+articleA+"**")); got != 1 {
+		t.Errorf("same article with markdown and a header block is %.2f similar, want 1", got)
+	}
+	if got := similarity(a, fingerprint(articleB)); got > 0.1 {
+		t.Errorf("unrelated articles are %.2f similar, want near 0", got)
+	}
+
+	// Changing the last sentence keeps about three quarters of the shingles
+	edited := strings.Replace(articleA, "bake it in a hot covered pot", "serve it warm with salted butter", 1)
+	if got := similarity(a, fingerprint(edited)); got < 0.5 || got >= 1 {
+		t.Errorf("lightly edited article is %.2f similar, want between 0.5 and 1", got)
+	}
+}
+
+func TestFingerprintShortText(t *testing.T) {
+	if fp := fingerprint("  **  "); fp != nil {
+		t.Errorf("text without words has fingerprint %x, want nil", fp)
+	}
+	if fp := fingerprint("two words"); len(fp) != 4*minhashSize {
+		t.Errorf("text shorter than a shingle has a %d byte fingerprint", len(fp))
+	}
+	if got := similarity(nil, fingerprint(articleA)); got != 0 {
+		t.Errorf("missing fingerprint is %.2f similar, want 0", got)
+	}
+}
+
+func TestRankSimilar(t *testing.T) {
+	fp := fingerprint(articleA)
+	archive := []archivedFingerprint{
+		{ID: 1, Topic: "gardens", Fingerprint: fingerprint(articleB)},
+		{ID: 2, Topic: "bread", Fingerprint: fingerprint(articleA)},
+		{ID: 3, Topic: "old job"},
+	}
+	ranked := rankSimilar(fp, archive, 2)
+	if len(ranked) != 2 {
+		t.Fatalf("got %d jobs, want the limit of 2", len(ranked))
+	}
+	if ranked[0].JobID != 2 || ranked[0].Similarity != 1 {
+		t.Errorf("most similar is job %d at %.2f, want job 2 at 1", ranked[0].JobID, ranked[0].Similarity)
+	}
+}
+
+func TestCheckDuplicate(t *testing.T) {
+	defer func(threshold float64) { cfg.Quality.DuplicateThreshold = threshold }(cfg.Quality.DuplicateThreshold)
+	cfg.Quality.DuplicateThreshold = 0.8
+
+	near := &SimilarJob{JobID: 7, Topic: "bread", Similarity: 0.9}
+	far := &SimilarJob{JobID: 8, Topic: "gardens", Similarity: 0.3}
+	tests := []struct {
+		name    string
+		backend string
+		closest *SimilarJob
+		pass    bool
+	}{
+		{"no archive", BackendLlamaServer, nil, true},
+		{"different", BackendLlamaServer, far, true},
+		{"duplicate", BackendLlamaServer, near, false},
+		{"local backend", BackendLocal, near, true},
+	}
+	for _, tt := range tests {
+		if got := checkDuplicate(tt.backend, tt.closest); got.Passed != tt.pass {
+			t.Errorf("%s: passed = %v, want %v (%s)", tt.name, got.Passed, tt.pass, got.Detail)
+		}
+	}
+
+	cfg.Quality.DuplicateThreshold = 0
+	if !checkDuplicate(BackendLlamaServer, near).Passed {
+		t.Error("a threshold of 0 still fails duplicates")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=1.2.0 -X main.commit=abc123 -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+var startTime = time.Now()
+
+// Components whose last error /api/status reports
+const (
+	ComponentDatabase  = "database"
+	ComponentGenerator = "generator"
+	ComponentWorker    = "worker"
+)
+
+type ComponentError struct {
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// lastErrors holds the most recent error of each component in this process
+var lastErrors = struct {
+	sync.Mutex
+	byComponent map[string]ComponentError
+}{byComponent: make(map[string]ComponentError)}
+
+func reportError(component string, err error) {
+	lastErrors.Lock()
+	defer lastErrors.Unlock()
+	lastErrors.byComponent[component] = ComponentError{Message: err.Error(), At: time.Now()}
+}
+
+func componentErrors() map[string]ComponentError {
+	lastErrors.Lock()
+	defer lastErrors.Unlock()
+	errs := make(map[string]ComponentError, len(lastErrors.byComponent))
+	for component, e := range lastErrors.byComponent {
+		errs[component] = e
+	}
+	return errs
+}
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	// Fall back to what the Go toolchain stamped into the binary
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			}
+		}
+	}
+	return info
+}
+
+// healthzHandler reports that the process is up. It checks nothing else, so
+// a slow database or model never gets the process restarted.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeSuccessResponse(w, map[string]string{"status": "ok"})
+}
+
+type CheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func checkResult(err error) CheckResult {
+	if err != nil {
+		return CheckResult{OK: false, Error: err.Error()}
+	}
+	return CheckResult{OK: true}
+}
+
+// readyzHandler reports whether this process can do its work: the database
+// answers, every migration has been applied and, for processes that run a
+// worker, every llama-server backend in use responds.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := map[string]CheckResult{
+		"database":   checkResult(db.PingContext(ctx)),
+		"migrations": checkResult(checkMigrations()),
+	}
+	if cfg.Mode != ModeAPI {
+		checks["generator"] = checkResult(checkGeneratorBackends(ctx))
+	}
+
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(APIResponse{
+		Success: ready,
+		Data:    map[string]interface{}{"ready": ready, "checks": checks},
+	})
+}
+
+func checkMigrations() error {
+	missing, err := pendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing columns: %v", missing)
+	}
+	return nil
+}
+
+// llamaServerURLs lists the llama-server backends the workspaces use
+func llamaServerURLs() ([]string, error) {
+	workspaces, err := listWorkspaces()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var urls []string
+	for _, ws := range workspaces {
+		if ws.Backend != BackendLlamaServer {
+			continue
+		}
+		url := ws.BackendURL
+		if url == "" {
+			url = cfg.Generator.BackendURL
+		}
+		if url != "" && !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
+// checkGeneratorBackends calls the /health endpoint of each llama-server in
+// use. The local backend needs no check: it always produces content.
+func checkGeneratorBackends(ctx context.Context) error {
+	urls, err := llamaServerURLs()
+	if err != nil {
+		return err
+	}
+	for _, url := range urls {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/health", nil)
+		if err != nil {
+			return fmt.Errorf("%s: %v", url, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("%s: %v", url, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+		}
+	}
+	return nil
+}
+
+type GeneratorStatus struct {
+	Backend       string   `json:"backend"`
+	BackendURLs   []string `json:"backend_urls,omitempty"`
+	FallbackURLs  []string `json:"fallback_urls,omitempty"`
+	Model         string   `json:"model,omitempty"`
+	ModelDetected bool     `json:"model_detected"`
+	// Circuits are the llama-servers this process's worker has called
+	Circuits []BackendStatus `json:"circuits,omitempty"`
+}
+
+type InstanceStatus struct {
+	Mode          string                    `json:"mode"`
+	Build         BuildInfo                 `json:"build"`
+	StartedAt     time.Time                 `json:"started_at"`
+	UptimeSeconds int64                     `json:"uptime_seconds"`
+	Generator     GeneratorStatus           `json:"generator"`
+	Workers       []WorkerStatus            `json:"workers"`
+	Queue         map[string]int            `json:"queue"`
+	LastErrors    map[string]ComponentError `json:"last_errors"`
+}
+
+// statusHandler describes the whole instance: every worker sharing the
+// database and the queue across workspaces, so it is for instance admins.
+// Last errors are those seen by the process serving the request.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	ws, err := getWorkspace(defaultWorkspaceID)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error getting default workspace", "error", err)
+		writeErrorResponse(w, "Failed to get status", http.StatusInternalServerError)
+		return
+	}
+	urls, err := llamaServerURLs()
+	if err != nil {
+		loggerFrom(r.Context()).Error("error listing generator backends", "error", err)
+		writeErrorResponse(w, "Failed to get status", http.StatusInternalServerError)
+		return
+	}
+
+	var fallbacks []string
+	for _, f := range cfg.Generator.Fallbacks {
+		fallbacks = append(fallbacks, f.URL)
+	}
+
+	model := ws.ModelPath
+	if model == "" {
+		model = findModel()
+	}
+
+	// Idle workers heartbeat every poll interval; allow a few misses
+	staleAfter := 3 * cfg.Worker.PollInterval
+	workers, err := listWorkers(time.Now().Add(-24*time.Hour), staleAfter)
+	if err != nil {
+		loggerFrom(r.Context()).Error("error listing workers", "error", err)
+		writeErrorResponse(w, "Failed to get status", http.StatusInternalServerError)
+		return
+	}
+
+	queue, err := jobCountsByStatus(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("error counting jobs", "error", err)
+		writeErrorResponse(w, "Failed to get status", http.StatusInternalServerError)
+		return
+	}
+
+	writeSuccessResponse(w, InstanceStatus{
+		Mode:          cfg.Mode,
+		Build:         buildInfo(),
+		StartedAt:     startTime,
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		Generator: GeneratorStatus{
+			Backend:       ws.Backend,
+			BackendURLs:   urls,
+			FallbackURLs:  fallbacks,
+			Model:         model,
+			ModelDetected: model != "",
+			Circuits:      backendStatuses(),
+		},
+		Workers:    workers,
+		Queue:      queue,
+		LastErrors: componentErrors(),
+	})
+}
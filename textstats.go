@@ -0,0 +1,247 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// textStats counts what readability formulas need. Syllables and passive
+// voice are judged with English rules.
+type textStats struct {
+	Words     int
+	Sentences int
+	Syllables int
+	// Passive counts sentences with a passive construction
+	Passive int
+	// Diversity is the moving-average type-token ratio over
+	// diversityWindow words, or the plain ratio in shorter text
+	Diversity float64
+}
+
+// Readability is the style analysis of a job's output
+type Readability struct {
+	// ReadingEase is the Flesch reading ease, 0 (very hard) to 100 (very easy)
+	ReadingEase float64 `json:"reading_ease"`
+	// GradeLevel is the Flesch-Kincaid US school grade
+	GradeLevel        float64 `json:"grade_level"`
+	AvgSentenceLength float64 `json:"avg_sentence_length"`
+	// PassiveRatio is the share of sentences in the passive voice
+	PassiveRatio float64 `json:"passive_ratio"`
+	// LexicalDiversity is the share of distinct words, 0 to 1
+	LexicalDiversity float64 `json:"lexical_diversity"`
+}
+
+// readabilityMetrics are Readability's fields, named as in its JSON. Each
+// is a jobs column of the same name, and GET /api/jobs filters on it with
+// min_<name> and max_<name>.
+var readabilityMetrics = []string{"reading_ease", "grade_level", "avg_sentence_length", "passive_ratio", "lexical_diversity"}
+
+// diversityWindow keeps vocabulary diversity comparable between short and
+// long texts
+const diversityWindow = 50
+
+var (
+	markdownEmphasis = regexp.MustCompile("[*_`]+")
+	markdownLink     = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	listMarker       = regexp.MustCompile(`^(\s*([-*+]|\d+[.)])\s+|#{1,6}\s+|>\s*)`)
+)
+
+// plainText strips Markdown markup, keeping one line per source line
+func plainText(markdown string) string {
+	lines := strings.Split(markdown, "\n")
+	for i, line := range lines {
+		line = listMarker.ReplaceAllString(line, "")
+		line = markdownLink.ReplaceAllString(line, "$1")
+		lines[i] = strings.TrimSpace(markdownEmphasis.ReplaceAllString(line, ""))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// textWords splits text into lowercase words
+func textWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+}
+
+// analyzeText measures Markdown text. Headings and list items without
+// closing punctuation count as sentences.
+func analyzeText(markdown string) textStats {
+	var s textStats
+	var all []string
+	for _, sentence := range splitSentences(plainText(markdown)) {
+		words := textWords(sentence)
+		s.Words += len(words)
+		s.Sentences++
+		for _, w := range words {
+			s.Syllables += syllables(w)
+		}
+		if isPassive(words) {
+			s.Passive++
+		}
+		all = append(all, words...)
+	}
+	s.Diversity = lexicalDiversity(all)
+	return s
+}
+
+// splitSentences splits plain text at sentence terminators followed by a
+// space, and at line ends
+func splitSentences(text string) []string {
+	var sentences []string
+	add := func(s string) {
+		if len(textWords(s)) > 0 {
+			sentences = append(sentences, strings.TrimSpace(s))
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		runes := []rune(line)
+		start := 0
+		for i, r := range runes {
+			if r != '.' && r != '!' && r != '?' {
+				continue
+			}
+			// A run of terminators ends one sentence, at its last one
+			if i+1 == len(runes) || unicode.IsSpace(runes[i+1]) {
+				add(string(runes[start : i+1]))
+				start = i + 1
+			}
+		}
+		add(string(runes[start:]))
+	}
+	return sentences
+}
+
+var beForms = map[string]bool{
+	"am": true, "is": true, "are": true, "was": true, "were": true,
+	"be": true, "been": true, "being": true,
+	"isn't": true, "aren't": true, "wasn't": true, "weren't": true,
+}
+
+// irregularParticiples are common past participles not ending in -ed
+var irregularParticiples = map[string]bool{
+	"built": true, "bought": true, "brought": true, "caught": true, "chosen": true,
+	"done": true, "drawn": true, "driven": true, "eaten": true, "felt": true,
+	"found": true, "forgotten": true, "given": true, "grown": true, "held": true,
+	"hidden": true, "kept": true, "known": true, "laid": true, "led": true,
+	"left": true, "lost": true, "made": true, "meant": true, "met": true,
+	"paid": true, "put": true, "read": true, "run": true, "said": true,
+	"seen": true, "sent": true, "set": true, "shown": true, "sold": true,
+	"spent": true, "taken": true, "taught": true, "thought": true, "told": true,
+	"understood": true, "won": true, "worn": true, "written": true,
+}
+
+// isPassive spots a form of "to be" followed by a past participle, allowing
+// one adverb between them, as in "was quickly written"
+func isPassive(words []string) bool {
+	for i, w := range words {
+		if !beForms[w] {
+			continue
+		}
+		for j := i + 1; j < len(words) && j <= i+2; j++ {
+			if isParticiple(words[j]) {
+				return true
+			}
+			if !strings.HasSuffix(words[j], "ly") && words[j] != "not" && words[j] != "also" && words[j] != "often" {
+				break
+			}
+		}
+	}
+	return false
+}
+
+func isParticiple(word string) bool {
+	if irregularParticiples[word] {
+		return true
+	}
+	return len(word) > 4 && strings.HasSuffix(word, "ed") && !strings.HasSuffix(word, "eed")
+}
+
+// lexicalDiversity is the moving-average type-token ratio: the share of
+// distinct words in every window of diversityWindow words, averaged
+func lexicalDiversity(words []string) float64 {
+	if len(words) == 0 {
+		return 0
+	}
+	window := diversityWindow
+	if len(words) < window {
+		window = len(words)
+	}
+	counts := make(map[string]int)
+	for _, w := range words[:window] {
+		counts[w]++
+	}
+	sum := float64(len(counts))
+	for i := window; i < len(words); i++ {
+		out := words[i-window]
+		if counts[out]--; counts[out] == 0 {
+			delete(counts, out)
+		}
+		counts[words[i]]++
+		sum += float64(len(counts))
+	}
+	return sum / float64(len(words)-window+1) / float64(window)
+}
+
+// syllables estimates the syllables in an English word by counting vowel
+// groups, less a silent final e or ed
+func syllables(word string) int {
+	count := 0
+	prevVowel := false
+	for _, r := range word {
+		vowel := strings.ContainsRune("aeiouy", r)
+		if vowel && !prevVowel {
+			count++
+		}
+		prevVowel = vowel
+	}
+	silentE := strings.HasSuffix(word, "e") && !strings.HasSuffix(word, "le")
+	silentED := strings.HasSuffix(word, "ed") && !strings.HasSuffix(word, "ted") && !strings.HasSuffix(word, "ded")
+	if (silentE || silentED) && count > 1 {
+		count--
+	}
+	if count == 0 {
+		count = 1
+	}
+	return count
+}
+
+// fleschReadingEase scores text from 0 (very hard) to 100 (very easy)
+func (s textStats) fleschReadingEase() float64 {
+	if s.Words == 0 || s.Sentences == 0 {
+		return 0
+	}
+	return 206.835 - 1.015*float64(s.Words)/float64(s.Sentences) - 84.6*float64(s.Syllables)/float64(s.Words)
+}
+
+// fleschKincaidGrade estimates the US school grade needed to read the text
+func (s textStats) fleschKincaidGrade() float64 {
+	if s.Words == 0 || s.Sentences == 0 {
+		return 0
+	}
+	return 0.39*float64(s.Words)/float64(s.Sentences) + 11.8*float64(s.Syllables)/float64(s.Words) - 15.59
+}
+
+// readability summarizes the statistics for a job
+func (s textStats) readability() *Readability {
+	r := &Readability{
+		ReadingEase:      round1(s.fleschReadingEase()),
+		GradeLevel:       round1(s.fleschKincaidGrade()),
+		LexicalDiversity: round2(s.Diversity),
+	}
+	if s.Sentences > 0 {
+		r.AvgSentenceLength = round1(float64(s.Words) / float64(s.Sentences))
+		r.PassiveRatio = round2(float64(s.Passive) / float64(s.Sentences))
+	}
+	return r
+}
+
+func round1(f float64) float64 {
+	return math.Round(f*10) / 10
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
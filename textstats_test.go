@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlainText(t *testing.T) {
+	got := plainText("## Setup\n- **Install** the [tool](https://example.com)\n> run `make`\n1. Done")
+	want := "Setup\nInstall the tool\nrun make\nDone"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello there. How are you?", []string{"Hello there.", "How are you?"}},
+		{"Wait... what?! Yes.", []string{"Wait...", "what?!", "Yes."}},
+		{"Rates rose 3.5 percent. Then fell.", []string{"Rates rose 3.5 percent.", "Then fell."}},
+		{"Heading\nA list item\n\n--", []string{"Heading", "A list item"}},
+	}
+	for _, tt := range tests {
+		if got := splitSentences(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitSentences(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSyllables(t *testing.T) {
+	tests := []struct {
+		word string
+		want int
+	}{
+		{"cat", 1},
+		{"the", 1},
+		{"make", 1},
+		{"table", 2},
+		{"jumped", 1},
+		{"wanted", 2},
+		{"rhythm", 1},
+		{"beautiful", 3},
+		{"readability", 5},
+	}
+	for _, tt := range tests {
+		if got := syllables(tt.word); got != tt.want {
+			t.Errorf("syllables(%q) = %d, want %d", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestIsPassive(t *testing.T) {
+	tests := []struct {
+		sentence string
+		want     bool
+	}{
+		{"the cake was eaten", true},
+		{"the report was quickly written", true},
+		{"the seeds were not planted", true},
+		{"the team wrote the report", false},
+		{"she is happy", false},
+		{"they were running late", false},
+	}
+	for _, tt := range tests {
+		if got := isPassive(textWords(tt.sentence)); got != tt.want {
+			t.Errorf("isPassive(%q) = %v, want %v", tt.sentence, got, tt.want)
+		}
+	}
+}
+
+func TestLexicalDiversity(t *testing.T) {
+	tests := []struct {
+		words []string
+		want  float64
+	}{
+		{nil, 0},
+		{[]string{"a", "b", "c", "d"}, 1},
+		{[]string{"a", "a", "a", "a"}, 0.25},
+		{[]string{"a", "b", "a", "b"}, 0.5},
+	}
+	for _, tt := range tests {
+		if got := lexicalDiversity(tt.words); got != tt.want {
+			t.Errorf("lexicalDiversity(%q) = %v, want %v", tt.words, got, tt.want)
+		}
+	}
+
+	// A long text repeating a short vocabulary scores like a short one
+	var long []string
+	for i := 0; i < 40; i++ {
+		long = append(long, "a", "b", "a", "b")
+	}
+	if got := lexicalDiversity(long); got != 2.0/diversityWindow {
+		t.Errorf("long repeated text scores %v, want %v", got, 2.0/diversityWindow)
+	}
+}
+
+func TestAnalyzeText(t *testing.T) {
+	s := analyzeText("# Report\n\nThe report was written by the team. It is short!")
+	if s.Words != 11 || s.Sentences != 3 || s.Passive != 1 {
+		t.Fatalf("got %d words, %d sentences, %d passive; want 11, 3, 1", s.Words, s.Sentences, s.Passive)
+	}
+	r := s.readability()
+	if r.AvgSentenceLength != 3.7 || r.PassiveRatio != 0.33 {
+		t.Errorf("got average sentence length %v and passive ratio %v, want 3.7 and 0.33", r.AvgSentenceLength, r.PassiveRatio)
+	}
+
+	empty := analyzeText("")
+	if r := empty.readability(); *r != (Readability{}) {
+		t.Errorf("empty text has readability %+v, want zeros", *r)
+	}
+}
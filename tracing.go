@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("ai-content-generator")
+
+// propagator reads and writes W3C traceparent headers, and the traceparent
+// stored on each job
+var propagator = propagation.TraceContext{}
+
+// initTracing exports spans over OTLP/HTTP when tracing.endpoint is set.
+// Otherwise the global no-op provider stays in place and spans cost next to
+// nothing. The returned function flushes pending spans.
+func initTracing(c TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+	if c.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(c.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(c.ServiceName),
+		attribute.String("acg.mode", cfg.Mode),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("exporting traces", "endpoint", c.Endpoint, "sample_ratio", c.SampleRatio)
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware continues the caller's trace, if it sent a traceparent,
+// and adds the trace ID to the request's log lines.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+			))
+		defer span.End()
+		if sc := span.SpanContext(); sc.IsValid() {
+			ctx = withLogAttrs(ctx, "trace_id", sc.TraceID().String())
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// recordError marks span failed when err is set
+func recordError(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func startDBSpan(ctx context.Context, op, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "db "+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemSqlite,
+			semconv.DBOperationName(op),
+			semconv.DBQueryText(query),
+		))
+}
+
+// recordDBError marks the span failed and keeps the error for /api/status
+func recordDBError(span trace.Span, err error) {
+	recordError(span, err)
+	if err != nil && err != sql.ErrNoRows {
+		reportError(ComponentDatabase, err)
+	}
+}
+
+// dbExec, dbQuery and dbQueryRow run one statement in its own span, named
+// after op. Spans for queries cover running the query, not reading rows.
+func dbExec(ctx context.Context, op, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startDBSpan(ctx, op, query)
+	defer span.End()
+	result, err := db.ExecContext(ctx, query, args...)
+	recordDBError(span, err)
+	return result, err
+}
+
+func dbQuery(ctx context.Context, op, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startDBSpan(ctx, op, query)
+	defer span.End()
+	rows, err := db.QueryContext(ctx, query, args...)
+	recordDBError(span, err)
+	return rows, err
+}
+
+func dbQueryRow(ctx context.Context, op, query string, args ...interface{}) *sql.Row {
+	ctx, span := startDBSpan(ctx, op, query)
+	defer span.End()
+	row := db.QueryRowContext(ctx, query, args...)
+	recordDBError(span, row.Err())
+	return row
+}
+
+// traceParent encodes the span in ctx for storing on a job
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// jobTraceLink links a worker's spans to the trace that created the job.
+// The job runs later and in another process, so its spans start a new
+// trace rather than extending a request that has long finished.
+func jobTraceLink(job *Job) []trace.SpanStartOption {
+	opts := []trace.SpanStartOption{trace.WithNewRoot()}
+	if job.TraceParent == "" {
+		return opts
+	}
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{"traceparent": job.TraceParent})
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+	}
+	return opts
+}
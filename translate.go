@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const builtinTranslatePrompt = `Translate the following text into {{language}}. Keep its structure and Markdown formatting, and reply with the translation only.
+
+{{text}}`
+
+// validateTranslation checks the fields only translate jobs use
+func validateTranslation(req CreateJobRequest) error {
+	if req.Type != JobTypeTranslate {
+		if req.SourceJobID != nil {
+			return fmt.Errorf("source_job_id is only for %s jobs", JobTypeTranslate)
+		}
+		return nil
+	}
+	if req.SourceJobID == nil {
+		return fmt.Errorf("source_job_id is required for %s jobs", JobTypeTranslate)
+	}
+	if req.Params.Language == "" {
+		return fmt.Errorf("params.language is required for %s jobs", JobTypeTranslate)
+	}
+	return nil
+}
+
+// translationSource loads the job a translate job will translate. Only
+// completed jobs have anything to translate.
+func translationSource(ctx context.Context, workspaceID, sourceID int) (*Job, error) {
+	source, err := getJobByID(ctx, workspaceID, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	if source.Status != "completed" {
+		return nil, fmt.Errorf("source job %d is %s, not completed", source.ID, source.Status)
+	}
+	return source, nil
+}
+
+func jobTranslationSource(ctx context.Context, job *Job) (*Job, error) {
+	if job.SourceJobID == nil {
+		return nil, fmt.Errorf("translate job has no source job")
+	}
+	return translationSource(ctx, job.WorkspaceID, *job.SourceJobID)
+}
+
+// renderTranslationPrompt fills in the workspace's translate template, or
+// the built-in one, with the source job's output. Templates can place
+// {{language}}, {{source_language}} and {{text}}.
+func renderTranslationPrompt(ctx context.Context, workspaceID int, source *Job, params GenerationParams) string {
+	template, err := getPromptTemplate(workspaceID, JobTypeTranslate)
+	if err != nil {
+		loggerFrom(ctx).Error("failed to load workspace prompt template", "workspace_id", workspaceID, "error", err)
+	}
+	if template == "" {
+		template = builtinTranslatePrompt
+	}
+	return strings.NewReplacer(
+		"{{language}}", languageName(params.Language),
+		"{{source_language}}", languageName(source.OutputLanguage),
+		"{{text}}", source.Output,
+	).Replace(template)
+}
+
+// translationParams gives a translation room for the whole source text
+// unless the job set its own token limit
+func translationParams(params GenerationParams, source *Job) GenerationParams {
+	if params.MaxTokens == 0 {
+		params.MaxTokens = estimateTokens(source.Output)*3/2 + 100
+		if params.MaxTokens > maxJobTokens {
+			params.MaxTokens = maxJobTokens
+		}
+	}
+	return params
+}
+
+// checkOutputLanguage detects the language of output. It fails when the
+// job asked for a language detection recognises and the output is
+// confidently in another one.
+func checkOutputLanguage(requested, output string) (string, error) {
+	detected := detectLanguage(output)
+	if requested == "" || detected == "" || !detectableLanguage(requested) {
+		return detected, nil
+	}
+	if detected != baseLanguage(requested) {
+		return detected, fmt.Errorf("output is in %s, not %s", languageName(detected), languageName(requested))
+	}
+	return detected, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User roles. Writers only see their own jobs; editors and admins see all.
+const (
+	RoleWriter = "writer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var validRoles = map[string]bool{
+	RoleWriter: true,
+	RoleEditor: true,
+	RoleAdmin:  true,
+}
+
+const (
+	minPasswordLength = 8
+	sessionCookieName = "acg_session"
+)
+
+// roleScopes maps a dashboard role onto the API key scopes it is equivalent to
+var roleScopes = map[string][]string{
+	RoleWriter: {ScopeJobsRead, ScopeJobsWrite},
+	RoleEditor: {ScopeJobsRead, ScopeJobsWrite},
+	RoleAdmin:  {ScopeAdmin},
+}
+
+// dummyPasswordHash is compared against when a username does not exist
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func createUser(workspaceID int, username, password, role string) (*User, error) {
+	if !validRoles[role] {
+		return nil, fmt.Errorf("invalid role: %s", role)
+	}
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	now := time.Now()
+	result, err := db.Exec(`INSERT INTO users (workspace_id, username, password_hash, role, created_at) VALUES (?, ?, ?, ?, ?)`,
+		workspaceID, username, string(hash), role, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %v", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user ID: %v", err)
+	}
+
+	return &User{ID: int(id), WorkspaceID: workspaceID, Username: username, Role: role, CreatedAt: now}, nil
+}
+
+func listUsers(workspaceID int) ([]User, error) {
+	rows, err := db.Query(`SELECT id, workspace_id, username, role, created_at FROM users WHERE workspace_id = ? ORDER BY id`, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %v", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.WorkspaceID, &u.Username, &u.Role, &u.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %v", err)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// authenticateUser checks a username and password. Unknown users and wrong
+// passwords produce the same error so usernames cannot be probed.
+func authenticateUser(username, password string) (*User, error) {
+	var u User
+	var hash string
+	err := db.QueryRow(`SELECT id, workspace_id, username, role, created_at, password_hash FROM users WHERE username = ?`, username).
+		Scan(&u.ID, &u.WorkspaceID, &u.Username, &u.Role, &u.CreatedAt, &hash)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to look up user: %v", err)
+	}
+	if err == sql.ErrNoRows {
+		// Spend the same time as a real check
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, fmt.Errorf("invalid username or password")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, fmt.Errorf("invalid username or password")
+	}
+	return &u, nil
+}
+
+// createSession starts a session for a user and returns the cookie token.
+// Only a hash of the token is stored.
+func createSession(userID int) (*Session, string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	csrf, err := randomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	session := &Session{UserID: userID, CSRFToken: csrf, ExpiresAt: now.Add(cfg.Auth.SessionLifetime)}
+	_, err = db.Exec(`INSERT INTO sessions (token_hash, user_id, csrf_token, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(token), userID, csrf, now, session.ExpiresAt)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create session: %v", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, now); err != nil {
+		slog.Error("failed to prune expired sessions", "error", err)
+	}
+	return session, token, nil
+}
+
+func lookupSession(token string) (*Session, *User, error) {
+	var s Session
+	var u User
+	err := db.QueryRow(`SELECT s.user_id, s.csrf_token, s.expires_at, u.id, u.workspace_id, u.username, u.role, u.created_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?`, hashToken(token), time.Now()).
+		Scan(&s.UserID, &s.CSRFToken, &s.ExpiresAt, &u.ID, &u.WorkspaceID, &u.Username, &u.Role, &u.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, fmt.Errorf("session not found")
+		}
+		return nil, nil, fmt.Errorf("failed to look up session: %v", err)
+	}
+	return &s, &u, nil
+}
+
+func deleteSession(token string) error {
+	if _, err := db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, hashToken(token)); err != nil {
+		return fmt.Errorf("failed to delete session: %v", err)
+	}
+	return nil
+}
+
+// ensureBootstrapAdmin creates an admin account on first start. Unless
+// auth.bootstrap_admin_password is set, a random password is logged once,
+// the same way the bootstrap API key is.
+func ensureBootstrapAdmin() error {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count); err != nil {
+		return fmt.Errorf("failed to count users: %v", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	password := cfg.Auth.BootstrapAdminPassword
+	if password != "" {
+		if _, err := createUser(defaultWorkspaceID, "admin", password, RoleAdmin); err != nil {
+			return err
+		}
+		slog.Warn("no users found - created dashboard user with the configured password", "username", "admin")
+		return nil
+	}
+
+	password, err := randomToken(12)
+	if err != nil {
+		return err
+	}
+	if _, err := createUser(defaultWorkspaceID, "admin", password, RoleAdmin); err != nil {
+		return err
+	}
+	slog.Warn("no users found - created dashboard user; store the password now, it will not be shown again", "username", "admin", "password", password)
+	return nil
+}
@@ -1,117 +1,441 @@
 package main
 
 import (
-	"database/sql"
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+// ContentWorker processes jobs from the shared job store. Any number of
+// workers, in this process or others, can run against one database.
 type ContentWorker struct {
-	generator *LLMGenerator
+	id        string
+	scheduler *Scheduler
 	running   bool
+	startedAt time.Time
+	// wakeSeq is the last worker signal seen
+	wakeSeq int64
+	// ctx is cancelled by Stop, abandoning the job in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stopped is closed when the worker loop has returned
+	stopped chan struct{}
 }
 
 func NewContentWorker() *ContentWorker {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &ContentWorker{
-		generator: NewLLMGenerator(),
+		id:        workerID(),
+		scheduler: NewScheduler(),
 		running:   true,
+		startedAt: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		stopped:   make(chan struct{}),
 	}
 }
 
 func (w *ContentWorker) Start() {
-	log.Println("Content worker started")
+	slog.Info("content worker started", "worker_id", w.id)
 	go w.run()
 }
 
+// Stop ends the worker loop. A job in progress is abandoned and returned to
+// the queue for another worker.
 func (w *ContentWorker) Stop() {
 	w.running = false
-	log.Println("Content worker stopped")
+	w.cancel()
+	<-w.stopped
+	w.heartbeat(WorkerStopped, nil)
+	slog.Info("content worker stopped", "worker_id", w.id)
 }
 
 func (w *ContentWorker) run() {
-	log.Println("Worker loop started")
+	defer close(w.stopped)
+	slog.Debug("worker loop started", "worker_id", w.id)
+	workerState.WithLabelValues("idle").Inc()
+	defer workerState.WithLabelValues("idle").Dec()
+	w.wakeSeq, _ = wakeSeq()
+	lastRecovery := time.Time{}
 	for w.running {
+		if time.Since(lastRecovery) >= cfg.Worker.PollInterval {
+			w.heartbeat(WorkerIdle, nil)
+			w.recoverExpiredClaims()
+			lastRecovery = time.Now()
+		}
+
 		job := w.getPendingJob()
 		if job != nil {
-			log.Printf("Found pending job: %d", job.ID)
+			w.heartbeat(WorkerBusy, &job.ID)
+			workerState.WithLabelValues("idle").Dec()
+			workerState.WithLabelValues("busy").Inc()
 			w.processJob(job)
-		} else {
-			time.Sleep(2 * time.Second)
+			workerState.WithLabelValues("busy").Dec()
+			workerState.WithLabelValues("idle").Inc()
+			w.heartbeat(WorkerIdle, nil)
+		} else if w.waitForWork() {
+			// Recover stuck jobs too, so a wake-up runs everything
+			lastRecovery = time.Time{}
 		}
 	}
-	log.Println("Worker loop stopped")
+	slog.Debug("worker loop stopped", "worker_id", w.id)
 }
 
-func (w *ContentWorker) ProcessAllPending() {
-	jobs := w.getAllPendingJobs()
-	log.Printf("Processing %d pending jobs", len(jobs))
-	
-	for _, job := range jobs {
-		w.processJob(&job)
+// waitForWork sleeps for the poll interval, returning early, and true, when
+// /api/process signals the workers
+func (w *ContentWorker) waitForWork() bool {
+	deadline := time.Now().Add(cfg.Worker.PollInterval)
+	for w.running && time.Now().Before(deadline) {
+		time.Sleep(minDuration(cfg.Worker.WakeCheckInterval, time.Until(deadline)))
+
+		seq, err := wakeSeq()
+		if err != nil {
+			slog.Error("failed to check worker signal", "error", err)
+			reportError(ComponentWorker, err)
+			continue
+		}
+		if seq != w.wakeSeq {
+			w.wakeSeq = seq
+			slog.Debug("woken by worker signal", "worker_id", w.id)
+			return true
+		}
+	}
+	return false
+}
+
+func (w *ContentWorker) heartbeat(state string, jobID *int) {
+	if err := recordWorkerState(w.id, state, jobID, w.startedAt); err != nil {
+		slog.Error("failed to record worker heartbeat", "error", err)
+		reportError(ComponentWorker, err)
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (w *ContentWorker) recoverExpiredClaims() {
+	n, err := requeueExpiredClaims(cfg.Worker.LeaseTimeout)
+	if err != nil {
+		slog.Error("failed to recover expired claims", "error", err)
+		reportError(ComponentWorker, err)
+		return
+	}
+	if n > 0 {
+		slog.Warn("requeued jobs whose worker stopped responding", "jobs", n)
 	}
 }
 
 func (w *ContentWorker) getPendingJob() *Job {
-	query := `SELECT id, topic, COALESCE(type, 'blog') FROM jobs WHERE status = 'pending' ORDER BY created_at ASC LIMIT 1`
-	
-	var job Job
-	err := db.QueryRow(query).Scan(&job.ID, &job.Topic, &job.Type)
+	job, err := w.scheduler.Next(w.id)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			log.Printf("Error getting pending job: %v", err)
-		}
+		slog.Error("failed to get pending job", "error", err)
+		reportError(ComponentWorker, err)
 		return nil
 	}
-	
-	return &job
+	return job
 }
 
-func (w *ContentWorker) getAllPendingJobs() []Job {
-	query := `SELECT id, topic, COALESCE(type, 'blog') FROM jobs WHERE status = 'pending' ORDER BY created_at ASC`
-	
-	rows, err := db.Query(query)
+// processJob runs a claimed job. Every log line it and the generator emit
+// carries the job ID and attempt, and its spans link to the trace that
+// created the job.
+func (w *ContentWorker) processJob(job *Job) {
+	ctx, span := tracer.Start(w.ctx, "processJob", jobTraceLink(job)...)
+	defer span.End()
+	span.SetAttributes(
+		attribute.Int("job.id", job.ID),
+		attribute.Int("job.attempt", job.Attempts),
+		attribute.String("job.type", job.Type),
+		attribute.Int("workspace.id", job.WorkspaceID),
+	)
+
+	ctx = withLogAttrs(ctx, "job_id", job.ID, "attempt", job.Attempts, "workspace_id", job.WorkspaceID, "worker_id", w.id)
+	if sc := span.SpanContext(); sc.IsValid() {
+		ctx = withLogAttrs(ctx, "trace_id", sc.TraceID().String())
+	}
+	logger := loggerFrom(ctx)
+	logger.Info("processing job", "topic", job.Topic, "type", job.Type, "priority", job.Priority, "client_id", job.ClientID)
+
+	// Generation can take several backend calls; the claim is renewed
+	// while they run, and the work is abandoned if it is lost
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer w.keepClaim(ctx, cancel, job)()
+	defer func() {
+		// A job abandoned at shutdown goes straight back to the queue
+		// rather than waiting out its lease
+		if w.ctx.Err() != nil && requeueJob(context.Background(), job, w.id) == nil {
+			logger.Info("returned job to the queue at shutdown")
+		}
+	}()
+
+	// Each workspace brings its own model, backend and prompt templates
+	ws, err := getWorkspace(job.WorkspaceID)
 	if err != nil {
-		log.Printf("Error getting pending jobs: %v", err)
-		return nil
+		logger.Error("failed to load workspace", "error", err)
+		reportError(ComponentWorker, err)
+		recordError(span, err)
+		w.finish(ctx, job, "failed", "Workspace unavailable")
+		return
+	}
+	generator := NewWorkspaceGenerator(ws)
+	// A model named by the job beats the workspace's and the default
+	if job.Model != "" {
+		model, err := lookupModel(job.Model)
+		if err != nil {
+			logger.Error("failed to find job model", "model", job.Model, "error", err)
+			recordError(span, err)
+			w.finish(ctx, job, "failed", "Model unavailable: "+job.Model)
+			return
+		}
+		generator.modelPath = model.Path
+	}
+	params := job.Params
+	var prompt string
+	if job.Type == JobTypeTranslate {
+		source, err := jobTranslationSource(ctx, job)
+		if err != nil {
+			logger.Error("failed to load source job", "error", err)
+			recordError(span, err)
+			w.finish(ctx, job, "failed", "Source job unavailable")
+			return
+		}
+		params = translationParams(params, source)
+		prompt = renderTranslationPrompt(ctx, ws.ID, source, params)
+	} else {
+		prompt = renderPrompt(ctx, ws.ID, job.Type, job.Topic, params)
+	}
+
+	// Types with a pipeline are written in parts, whatever their length.
+	// The steps' prompts are sent instead of the rendered template.
+	pipeline := pipelineFor(ctx, ws, job.Type)
+	if pipeline != nil {
+		chunked := true
+		params.Chunked = &chunked
+		prompt = outlinePrompt(pipeline, job.Topic, params)
 	}
-	defer rows.Close()
 
-	var jobs []Job
-	for rows.Next() {
-		var job Job
-		err := rows.Scan(&job.ID, &job.Topic, &job.Type)
+	// A llama-server job must fit the model's context window
+	var budget *TokenBudget
+	if generator.backend == BackendLlamaServer {
+		var err error
+		budget, err = generator.planBudget(ctx, job.Type, prompt, params)
+		if err := updateJobBudget(ctx, job.WorkspaceID, job.ID, budget); err != nil {
+			logger.Error("failed to record token budget", "error", err)
+		}
 		if err != nil {
-			log.Printf("Error scanning job: %v", err)
-			continue
+			span.SetStatus(codes.Error, err.Error())
+			w.finish(ctx, job, "failed", "Job does not fit the model: "+err.Error())
+			logger.Warn("job failed: prompt does not fit the context window", "prompt_tokens", budget.PromptTokens, "context_length", budget.ContextLength)
+			return
 		}
-		jobs = append(jobs, job)
+		if budget.Capped() {
+			logger.Warn("capped max_tokens to fit the context window", "requested", budget.Requested, "max_tokens", budget.MaxTokens, "context_length", budget.ContextLength)
+		}
+		params = budget.apply(params)
 	}
 
-	return jobs
-}
+	// Generate content, unless the same generation is cached
+	cachePrompt := prompt
+	if pipeline != nil {
+		cachePrompt = pipelineKey(pipeline) + prompt
+	}
+	cacheKey, content, cached := lookupGeneration(ctx, job, generator, cachePrompt, params)
+	if cached {
+		logger.Info("using cached generation", "chars", len(content))
+	} else if pipeline != nil {
+		// When a step fails on every llama-server the local backend writes
+		// the article, as for other jobs. The steps are kept, so a retry
+		// resumes from the failed one.
+		logger.Debug("generating content in steps", "workspace", ws.Slug, "steps", len(pipeline), "model", modelLabel(generator.modelPath))
+		start := time.Now()
+		var err error
+		content, err = generator.runPipeline(ctx, job, pipeline, params, budget)
+		if err != nil && ctx.Err() == nil {
+			recordError(span, err)
+			reportError(ComponentGenerator, err)
+			logger.Warn("pipeline failed, using local generation", "error", err)
+			content = generator.localGeneration(ctx, job.Topic, params)
+		}
+		logger.Info("generation finished", "chars", len(content), "duration_ms", time.Since(start).Milliseconds())
+	} else {
+		logger.Debug("generating content", "workspace", ws.Slug, "backend", ws.Backend, "model", modelLabel(generator.modelPath))
+		start := time.Now()
+		content = generator.GenerateContent(ctx, job.Topic, prompt, params)
+		logger.Info("generation finished", "chars", len(content), "duration_ms", time.Since(start).Milliseconds())
+	}
 
-func (w *ContentWorker) processJob(job *Job) {
-	log.Printf("Processing job %d: %s", job.ID, job.Topic)
-	
-	// Update status to processing
-	if err := updateJobStatus(job.ID, "processing", ""); err != nil {
-		log.Printf("Failed to update job %d to processing: %v", job.ID, err)
+	if ctx.Err() != nil {
+		// The worker is stopping, or another worker holds the job now;
+		// either way it runs again, resuming any pipeline from its
+		// stored steps
+		if w.ctx.Err() != nil {
+			logger.Info("job abandoned: worker stopping")
+		} else {
+			logger.Warn("job abandoned: claim lost")
+		}
 		return
 	}
-	
-	// Generate content
-	log.Printf("Generating content for job %d", job.ID)
-	content := w.generator.GenerateContent(job.Topic)
-	log.Printf("Generated content length: %d characters", len(content))
-	
+
 	if content != "" {
-		if err := updateJobStatus(job.ID, "completed", content); err != nil {
-			log.Printf("Failed to update job %d to completed: %v", job.ID, err)
-		} else {
-			log.Printf("Job %d completed successfully", job.ID)
+		backend, backendURL := generator.usedBackend, generator.usedURL
+		if cached {
+			backend, backendURL = BackendCache, ""
+		}
+		if err := updateJobBackend(ctx, job.WorkspaceID, job.ID, backend, backendURL); err != nil {
+			logger.Error("failed to record backend", "error", err)
+		}
+
+		// Output in the wrong language fails the language quality check
+		if language := detectLanguage(content); language != "" {
+			if err := updateJobLanguage(ctx, job.WorkspaceID, job.ID, language); err != nil {
+				logger.Error("failed to record output language", "error", err)
+			}
+		}
+
+		tokens := estimateTokens(content)
+		if err := updateJobTokens(ctx, job.WorkspaceID, job.ID, tokens); err != nil {
+			logger.Error("failed to record tokens", "error", err)
+		}
+		if !cached {
+			tokensGenerated.WithLabelValues(job.Type).Add(float64(tokens))
+			if err := recordTokenUsage(ctx, job, tokens); err != nil {
+				logger.Error("failed to record token usage", "error", err)
+			}
+		}
+		seo := analyzeSEO(job, content, params)
+		if err := updateJobSEO(ctx, job.WorkspaceID, job.ID, seo); err != nil {
+			logger.Error("failed to record seo", "error", err)
+		}
+		if err := updateJobReadability(ctx, job.WorkspaceID, job.ID, analyzeText(articleBody(content)).readability()); err != nil {
+			logger.Error("failed to record readability", "error", err)
+		}
+
+		// The archive is searched for the closest earlier output
+		fp := fingerprint(content)
+		closest, err := closestJob(ctx, job.WorkspaceID, job.ID, fp)
+		if err != nil {
+			logger.Error("failed to compare with earlier jobs", "error", err)
+		}
+		// A cache hit repeats an earlier job's output on purpose, and the
+		// local backend's articles are all alike, so neither is held
+		// against the job as a duplicate
+		source := generator.usedBackend
+		if cached {
+			source = generator.backend
+		}
+		duplicateCandidate := closest
+		if cached || source == BackendLocal {
+			duplicateCandidate = nil
+		}
+		var duplicateOf *int
+		if isDuplicate(duplicateCandidate) {
+			duplicateOf = &closest.JobID
+		}
+		if err := updateJobFingerprint(ctx, job.WorkspaceID, job.ID, fp, closest, duplicateOf); err != nil {
+			logger.Error("failed to record fingerprint", "error", err)
+		}
+
+		// Output that fails the quality checks is generated again, and
+		// flagged for review once the retries are used up. A deterministic
+		// generation would only fail the same way again, so it is flagged
+		// at once.
+		report := checkQuality(job, source, prompt, content, params, duplicateCandidate)
+		if job.Quality != nil {
+			report.Retries = job.Quality.Retries
+		}
+		for _, name := range report.Failed() {
+			qualityCheckFailures.WithLabelValues(name).Inc()
+		}
+		retry := !report.Passed && report.Retries < cfg.Quality.MaxRetries && !generator.deterministic(params)
+		if retry {
+			report.Retries++
+		}
+		if err := updateJobQuality(ctx, job.WorkspaceID, job.ID, report); err != nil {
+			logger.Error("failed to record quality report", "error", err)
+		}
+		if retry {
+			if pipeline != nil {
+				if err := deleteJobSteps(ctx, job.ID); err != nil {
+					logger.Error("failed to clear pipeline steps", "error", err)
+				}
+			}
+			if err := requeueJob(ctx, job, w.id); err != nil {
+				logger.Error("failed to requeue job", "error", err)
+				reportError(ComponentWorker, err)
+				return
+			}
+			logger.Warn("output failed quality checks, generating again", "failed", report.Failed(), "retry", report.Retries)
+			return
+		}
+		if !report.Passed {
+			if w.finish(ctx, job, StatusNeedsReview, content) {
+				logger.Warn("job needs review: output failed quality checks", "failed", report.Failed())
+			}
+			return
+		}
+		// Only output that passed is reused
+		if cacheKey != "" && !cached && generator.cacheable() {
+			if err := storeCachedOutput(ctx, cacheKey, content); err != nil {
+				logger.Error("failed to cache generation", "error", err)
+			}
+		}
+		if w.finish(ctx, job, "completed", content) {
+			logger.Info("job completed", "tokens", tokens, "seo_score", seo.Score, "cached", cached)
 		}
 	} else {
-		updateJobStatus(job.ID, "failed", "Content generation failed")
-		log.Printf("Job %d failed - no content generated", job.ID)
+		span.SetStatus(codes.Error, "no content generated")
+		w.finish(ctx, job, "failed", "Content generation failed")
+		logger.Warn("job failed: no content generated")
+		reportError(ComponentGenerator, fmt.Errorf("job %d: no content generated", job.ID))
+	}
+}
+
+// keepClaim renews job's claim every third of the lease until the returned
+// function is called. If the claim is lost to another worker, cancel is
+// called.
+func (w *ContentWorker) keepClaim(ctx context.Context, cancel context.CancelFunc, job *Job) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cfg.Worker.LeaseTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				w.heartbeat(WorkerBusy, &job.ID)
+				if err := renewClaim(ctx, job, w.id); err != nil {
+					loggerFrom(ctx).Error("failed to renew claim", "error", err)
+					reportError(ComponentWorker, err)
+					if strings.Contains(err.Error(), "claimed by another worker") {
+						cancel()
+						return
+					}
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// finish records a job's result, reporting whether it was saved
+func (w *ContentWorker) finish(ctx context.Context, job *Job, status, output string) bool {
+	if err := finishJob(ctx, job, w.id, status, output); err != nil {
+		loggerFrom(ctx).Error("failed to record job result", "status", status, "error", err)
+		reportError(ComponentWorker, err)
+		return false
 	}
+	jobsFinished.WithLabelValues(job.Type, status).Inc()
+	return true
 }
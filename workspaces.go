@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Generator backends a workspace can use
+const (
+	BackendLocal       = "local"
+	BackendLlamaServer = "llama-server"
+)
+
+var validBackends = map[string]bool{
+	BackendLocal:       true,
+	BackendLlamaServer: true,
+}
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+func validateWorkspaceRequest(req WorkspaceRequest) error {
+	if !slugPattern.MatchString(req.Slug) {
+		return fmt.Errorf("slug must be lowercase letters, digits and dashes")
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if !validBackends[req.Backend] {
+		return fmt.Errorf("invalid backend: %s", req.Backend)
+	}
+	if req.Backend == BackendLlamaServer && req.BackendURL == "" && cfg.Generator.BackendURL == "" {
+		return fmt.Errorf("backend_url is required for the %s backend", BackendLlamaServer)
+	}
+	if req.ModelPath != "" {
+		if _, err := os.Stat(req.ModelPath); err != nil {
+			return fmt.Errorf("model_path is not readable: %v", err)
+		}
+		if _, err := parseGGUF(req.ModelPath); err != nil {
+			return fmt.Errorf("model_path is not a usable model: %v", err)
+		}
+	}
+	return validateQuotaLimits(req.QuotaLimits)
+}
+
+func validateQuotaLimits(l QuotaLimits) error {
+	if l.DailyJobs < 0 || l.MonthlyJobs < 0 || l.DailyTokens < 0 || l.MonthlyTokens < 0 {
+		return fmt.Errorf("quota limits cannot be negative")
+	}
+	return nil
+}
+
+const workspaceColumns = `id, slug, name, model_path, backend, backend_url, daily_job_limit, monthly_job_limit, daily_token_limit, monthly_token_limit, created_at`
+
+func scanWorkspace(row rowScanner) (*Workspace, error) {
+	var ws Workspace
+	err := row.Scan(&ws.ID, &ws.Slug, &ws.Name, &ws.ModelPath, &ws.Backend, &ws.BackendURL, &ws.DailyJobs, &ws.MonthlyJobs, &ws.DailyTokens, &ws.MonthlyTokens, &ws.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &ws, nil
+}
+
+func createWorkspace(req WorkspaceRequest) (*Workspace, error) {
+	now := time.Now()
+	result, err := db.Exec(`INSERT INTO workspaces (slug, name, model_path, backend, backend_url, daily_job_limit, monthly_job_limit, daily_token_limit, monthly_token_limit, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		req.Slug, req.Name, req.ModelPath, req.Backend, req.BackendURL, req.DailyJobs, req.MonthlyJobs, req.DailyTokens, req.MonthlyTokens, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %v", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace ID: %v", err)
+	}
+
+	return getWorkspace(int(id))
+}
+
+func getWorkspace(id int) (*Workspace, error) {
+	ws, err := scanWorkspace(db.QueryRow(`SELECT `+workspaceColumns+` FROM workspaces WHERE id = ?`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("workspace not found")
+		}
+		return nil, fmt.Errorf("failed to get workspace: %v", err)
+	}
+	return ws, nil
+}
+
+func listWorkspaces() ([]Workspace, error) {
+	rows, err := db.Query(`SELECT ` + workspaceColumns + ` FROM workspaces ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workspaces: %v", err)
+	}
+	defer rows.Close()
+
+	var workspaces []Workspace
+	for rows.Next() {
+		ws, err := scanWorkspace(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan workspace: %v", err)
+		}
+		workspaces = append(workspaces, *ws)
+	}
+	return workspaces, rows.Err()
+}
+
+func updateWorkspace(id int, req WorkspaceRequest) (*Workspace, error) {
+	result, err := db.Exec(`UPDATE workspaces SET slug = ?, name = ?, model_path = ?, backend = ?, backend_url = ?, daily_job_limit = ?, monthly_job_limit = ?, daily_token_limit = ?, monthly_token_limit = ? WHERE id = ?`,
+		req.Slug, req.Name, req.ModelPath, req.Backend, req.BackendURL, req.DailyJobs, req.MonthlyJobs, req.DailyTokens, req.MonthlyTokens, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update workspace: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return nil, fmt.Errorf("workspace not found")
+	}
+
+	return getWorkspace(id)
+}
+
+// getPromptTemplate returns the workspace's template for a content type, or
+// "" when the workspace has not defined one.
+func getPromptTemplate(workspaceID int, jobType string) (string, error) {
+	var body string
+	err := db.QueryRow(`SELECT body FROM prompt_templates WHERE workspace_id = ? AND type = ?`, workspaceID, jobType).Scan(&body)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get prompt template: %v", err)
+	}
+	return body, nil
+}
+
+func listPromptTemplates(workspaceID int) ([]PromptTemplate, error) {
+	rows, err := db.Query(`SELECT workspace_id, type, body, updated_at FROM prompt_templates WHERE workspace_id = ? ORDER BY type`, workspaceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prompt templates: %v", err)
+	}
+	defer rows.Close()
+
+	var templates []PromptTemplate
+	for rows.Next() {
+		var t PromptTemplate
+		if err := rows.Scan(&t.WorkspaceID, &t.Type, &t.Body, &t.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan prompt template: %v", err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+func savePromptTemplate(workspaceID int, jobType, body string) (*PromptTemplate, error) {
+	now := time.Now()
+	_, err := db.Exec(`INSERT INTO prompt_templates (workspace_id, type, body, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(workspace_id, type) DO UPDATE SET body = excluded.body, updated_at = excluded.updated_at`,
+		workspaceID, jobType, body, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save prompt template: %v", err)
+	}
+	return &PromptTemplate{WorkspaceID: workspaceID, Type: jobType, Body: body, UpdatedAt: now}, nil
+}